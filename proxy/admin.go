@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// Longest path a Unix socket can be bound to on Linux, including the NUL
+const maxUnixSocketPath = 107
+
+// An admin connection idle for longer than this is closed
+const adminSocketIdleTimeout = time.Minute
+
+// The admin socket is process-wide like the metrics server: the first
+// filter-level config with AdminSocketPath opens it, and it is closed, and
+// its file removed, when the last of them is destroyed. Commands act on every
+// registered config.
+var (
+	adminSocketMu sync.Mutex
+	adminListener net.Listener
+	adminSocketAt string
+	adminConfigs  = map[*PluginConfig]struct{}{}
+)
+
+// registers a filter-level config with the admin socket, opening it on first
+// use. Failing to open it is logged, it never fails the config.
+func acquireAdminSocket(conf *PluginConfig) {
+	adminSocketMu.Lock()
+	defer adminSocketMu.Unlock()
+
+	adminConfigs[conf] = struct{}{}
+	if adminListener != nil {
+		if conf.AdminSocketPath != adminSocketAt {
+			api.LogWarnf("Admin socket already open on %s, not opening %s", adminSocketAt, conf.AdminSocketPath)
+		}
+		return
+	}
+
+	listener, err := listenAdminSocket(conf.AdminSocketPath)
+	if err != nil {
+		api.LogErrorf("Failed to open admin socket on %s: %v", conf.AdminSocketPath, err)
+		return
+	}
+	adminListener, adminSocketAt = listener, conf.AdminSocketPath
+	api.LogInfof("Admin socket listening on %s", adminSocketAt)
+	go serveAdminSocket(listener)
+}
+
+// drops a config registered by acquireAdminSocket, closing the socket when
+// no config needs it anymore
+func releaseAdminSocket(conf *PluginConfig) {
+	adminSocketMu.Lock()
+	defer adminSocketMu.Unlock()
+
+	delete(adminConfigs, conf)
+	if len(adminConfigs) > 0 || adminListener == nil {
+		return
+	}
+	// Closing a listener made by net.Listen also unlinks the socket file
+	if err := adminListener.Close(); err != nil {
+		api.LogWarnf("Failed to close admin socket on %s: %v", adminSocketAt, err)
+	}
+	adminListener = nil
+	api.LogInfof("Admin socket on %s closed", adminSocketAt)
+}
+
+// binds path, replacing a socket left behind by a process that didn't exit
+// cleanly. Anything at path that isn't a socket is left alone. Only the
+// owner can connect.
+func listenAdminSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// accepts connections until the listener is closed
+func serveAdminSocket(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				api.LogWarnf("Admin socket stopped accepting connections: %v", err)
+			}
+			return
+		}
+		go serveAdminConn(conn)
+	}
+}
+
+// answers one command per line until the client hangs up or goes idle
+func serveAdminConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(adminSocketIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		arg = strings.TrimSpace(arg)
+
+		w := bufio.NewWriter(conn)
+		switch command {
+		case "":
+			continue
+		case "config":
+			writeAdminConfig(w)
+		case "stats":
+			writeAdminStats(w)
+		case "flush":
+			if arg == "" {
+				fmt.Fprintln(w, "usage: flush <tenant>")
+				break
+			}
+			writeAdminFlush(w, arg)
+		case "refresh":
+			io.WriteString(w, refreshReport(refreshAll()))
+		case "maintenance":
+			writeAdminMaintenance(w, arg)
+		default:
+			fmt.Fprintf(w, "unknown command %q, expected config, stats, flush <tenant>, refresh or maintenance [on|off|config]\n", command)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// returns the registered configs, ordered by mapping
+func registeredAdminConfigs() []*PluginConfig {
+	adminSocketMu.Lock()
+	defer adminSocketMu.Unlock()
+
+	configs := make([]*PluginConfig, 0, len(adminConfigs))
+	for conf := range adminConfigs {
+		configs = append(configs, conf)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return mappingSourceID(configs[i]) < mappingSourceID(configs[j])
+	})
+	return configs
+}
+
+// config: the redacted effective config of every registered filter config
+func writeAdminConfig(w io.Writer) {
+	for _, conf := range registeredAdminConfigs() {
+		fmt.Fprintf(w, "%s: %s\n", mappingSourceID(conf), conf.RedactedSummary())
+	}
+}
+
+// stats: every counter and gauge, one sample per line
+func writeAdminStats(w io.Writer) {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		fmt.Fprintf(w, "partial stats: %v\n", err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				value = metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			default:
+				continue
+			}
+
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			if len(labels) > 0 {
+				fmt.Fprintf(w, "%s{%s} %g\n", family.GetName(), strings.Join(labels, ","), value)
+			} else {
+				fmt.Fprintf(w, "%s %g\n", family.GetName(), value)
+			}
+		}
+	}
+}
+
+// flush: drops the tenant from the process-wide caches and Redis cache of
+// every registered config, one line per config. The tenant is a lookup key,
+// tenant/environment for environment-scoped entries. Per-stream memory
+// caches go away with their streams and are not touched.
+func writeAdminFlush(w io.Writer, tenantID string) {
+	for _, conf := range registeredAdminConfigs() {
+		key := conf.cacheKey(tenantID)
+		var flushed []string
+
+		if conf.SharedMemoryCache {
+			cacheKey := memoryCacheKey{mapping: mappingSourceID(conf), size: conf.MemoryCacheSize, eviction: conf.MemoryCacheEviction}
+			if cache, ok := memoryCaches.Load(cacheKey); ok && cache.(memoryCacheStore).Remove(key) {
+				flushed = append(flushed, "memory")
+			}
+		}
+		if redisKey, ok := conf.redisKey(tenantID); ok && conf.MappingOverlayPrefix != "" {
+			if cache, ok := overlayCaches.Load(conf.RedisAddr + "/" + conf.MappingOverlayPrefix); ok && cache.(*overlayCache).remove(redisKey) {
+				flushed = append(flushed, "overlay cache")
+			}
+		}
+		if conf.EnableRedisCache {
+			removed, err := flushRedisCache(conf, tenantID)
+			if err != nil {
+				fmt.Fprintf(w, "%s: failed to flush %s from Redis: %v\n", mappingSourceID(conf), tenantID, err)
+				continue
+			}
+			if removed {
+				flushed = append(flushed, "redis")
+			}
+		}
+
+		if len(flushed) == 0 {
+			fmt.Fprintf(w, "%s: %s not cached\n", mappingSourceID(conf), tenantID)
+			continue
+		}
+		fmt.Fprintf(w, "%s: flushed %s from %s\n", mappingSourceID(conf), tenantID, strings.Join(flushed, ", "))
+		conf.log().info("flushed tenant from the admin socket", "tenant", tenantID, "tiers", flushed)
+	}
+}
+
+// maintenance [on|off|config]: forces maintenance mode on or off for every
+// config with a holding shard, or hands it back to their maintenance_mode,
+// then reports the state of each registered config
+func writeAdminMaintenance(w io.Writer, arg string) {
+	switch arg {
+	case "":
+	case "on":
+		setMaintenanceSwitch(maintenanceForcedOn)
+	case "off":
+		setMaintenanceSwitch(maintenanceForcedOff)
+	case "config":
+		setMaintenanceSwitch(maintenanceFromConfig)
+	default:
+		fmt.Fprintln(w, "usage: maintenance [on|off|config]")
+		return
+	}
+
+	for _, conf := range registeredAdminConfigs() {
+		switch {
+		case conf.MaintenanceShardID == "":
+			fmt.Fprintf(w, "%s: no maintenance_shard_id\n", mappingSourceID(conf))
+		case conf.inMaintenance():
+			fmt.Fprintf(w, "%s: in maintenance, routing to %s\n", mappingSourceID(conf), conf.MaintenanceShardID)
+		default:
+			fmt.Fprintf(w, "%s: routing by mapping\n", mappingSourceID(conf))
+		}
+	}
+}
+
+// deletes the tenant's Redis cache entry, reporting whether there was one
+func flushRedisCache(conf *PluginConfig, tenantID string) (bool, error) {
+	redisKey, ok := conf.redisKey(tenantID)
+	if !ok {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.RedisTimeout)
+	defer cancel()
+
+	client := sharedRedisClient(conf, conf.RedisAddr)
+	var cmd *redis.IntCmd
+	if conf.RedisStorageMode == RedisStorageHash {
+		cmd = client.HDel(ctx, conf.RedisHashKey, redisKey)
+	} else {
+		cmd = client.Del(ctx, conf.RedisKeyPrefix+redisKey)
+	}
+	removed, err := cmd.Result()
+	return removed > 0, err
+}
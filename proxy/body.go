@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Represents one step of a parsed JSONPath: an object member, or an array
+// index when key is empty
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// parses the supported JSONPath subset: a leading "$" followed by ".member"
+// and "[index]" steps, e.g. "$.params[0].tenant"
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+
+	var steps []jsonPathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath %q has an empty member name", path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an unterminated index", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an invalid index %q", path, rest[1:end])
+			}
+			steps = append(steps, jsonPathStep{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q is not supported, use $.member and [index] steps", path)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("JSONPath %q selects the whole document", path)
+	}
+	return steps, nil
+}
+
+// evaluates a parsed JSONPath against a JSON document, returning the selected
+// string or number as a string
+func lookupJSONPath(body []byte, steps []jsonPathStep) (string, error) {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %v", err)
+	}
+
+	for _, step := range steps {
+		switch node := value.(type) {
+		case map[string]any:
+			if step.key == "" {
+				return "", errors.New("JSONPath indexes an object")
+			}
+			value = node[step.key]
+		case []any:
+			if step.key != "" || step.index >= len(node) {
+				return "", errors.New("JSONPath does not match the body")
+			}
+			value = node[step.index]
+		default:
+			return "", errors.New("JSONPath does not match the body")
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", errors.New("JSONPath does not select a string or number")
+	}
+}
+
+// reports whether the request's content type is one the body may be parsed for
+func (f *ShardRouterFilter) bodyContentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range f.config.TenantBodyContentTypes {
+		if strings.EqualFold(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
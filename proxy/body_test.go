@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []jsonPathStep
+		wantErr bool
+	}{
+		{path: "$.tenant", want: []jsonPathStep{{key: "tenant"}}},
+		{path: "$.params[0].tenant", want: []jsonPathStep{{key: "params"}, {index: 0}, {key: "tenant"}}},
+		{path: "$[2]", want: []jsonPathStep{{index: 2}}},
+		{path: "$.a.b[10]", want: []jsonPathStep{{key: "a"}, {key: "b"}, {index: 10}}},
+		{path: "tenant", wantErr: true},
+		{path: "$", wantErr: true},
+		{path: "$.", wantErr: true},
+		{path: "$..tenant", wantErr: true},
+		{path: "$.params[0", wantErr: true},
+		{path: "$.params[-1]", wantErr: true},
+		{path: "$.params[x]", wantErr: true},
+		{path: "$['tenant']", wantErr: true},
+		{path: "$.tenant*", want: []jsonPathStep{{key: "tenant*"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONPath(tt.path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseJSONPath(%q) = %v, want an error", tt.path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJSONPath(%q) failed: %v", tt.path, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	tests := []struct {
+		path, body string
+		want       string
+		wantErr    bool
+	}{
+		{path: "$.tenant", body: `{"tenant": "acme"}`, want: "acme"},
+		{path: "$.params[1].tenant", body: `{"params": [{}, {"tenant": "acme"}]}`, want: "acme"},
+		{path: "$.org.id", body: `{"org": {"id": 12345678901234567890}}`, want: "12345678901234567890"},
+		{path: "$[0]", body: `["acme", "other"]`, want: "acme"},
+		{path: "$.tenant", body: `{"other": "acme"}`, wantErr: true},
+		{path: "$.tenant", body: `{"tenant": {"id": "acme"}}`, wantErr: true},
+		{path: "$.tenant", body: `{"tenant": true}`, wantErr: true},
+		{path: "$.tenant", body: `{"tenant": null}`, wantErr: true},
+		{path: "$.params[2]", body: `{"params": ["a", "b"]}`, wantErr: true},
+		{path: "$[0]", body: `{"0": "acme"}`, wantErr: true},
+		{path: "$.tenant", body: `["acme"]`, wantErr: true},
+		{path: "$.tenant", body: `{"tenant": "acme"`, wantErr: true},
+		{path: "$.tenant", body: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		steps, err := parseJSONPath(tt.path)
+		if err != nil {
+			t.Fatalf("parseJSONPath(%q): %v", tt.path, err)
+		}
+		got, err := lookupJSONPath([]byte(tt.body), steps)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s in %s = %q, want an error", tt.path, tt.body, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s in %s = %q, %v; want %q", tt.path, tt.body, got, err, tt.want)
+		}
+	}
+}
+
+func TestBodyContentTypeAllowed(t *testing.T) {
+	f := &ShardRouterFilter{config: &PluginConfig{TenantBodyContentTypes: []string{"application/json"}}}
+	for contentType, want := range map[string]bool{
+		"application/json":                  true,
+		"Application/JSON; charset=utf-8":   true,
+		"application/x-www-form-urlencoded": false,
+		"":                                  false,
+		"application/json;;":                false,
+	} {
+		if got := f.bodyContentTypeAllowed(contentType); got != want {
+			t.Errorf("bodyContentTypeAllowed(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// Returned instead of calling a dependency whose breaker is open
+type breakerOpenError struct {
+	name       string
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open, retry after %v", e.name, e.retryAfter)
+}
+
+// Stops calling a dependency after consecutive failures. Once the cooldown
+// has passed a single probe is let through: success closes the breaker
+// again, failure re-opens it for another cooldown.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+	parseSeq  uint64 // of the config threshold and cooldown come from
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+var breakers sync.Map // name -> *circuitBreaker
+
+// returns the process-wide breaker for a dependency, so every filter instance
+// talking to the same Redis or S3 object shares its failure history. An
+// existing breaker takes on conf's threshold and cooldown if conf is newer
+// than the config it has them from.
+func breakerFor(name string, conf *PluginConfig) *circuitBreaker {
+	if b, ok := breakers.Load(name); ok {
+		b.(*circuitBreaker).adopt(conf)
+		return b.(*circuitBreaker)
+	}
+	b, loaded := breakers.LoadOrStore(name, &circuitBreaker{
+		name:      name,
+		threshold: conf.BreakerFailureThreshold,
+		cooldown:  conf.BreakerCooldown,
+		parseSeq:  conf.parseSeq,
+	})
+	if loaded {
+		b.(*circuitBreaker).adopt(conf)
+	}
+	return b.(*circuitBreaker)
+}
+
+// names the breaker of a Redis server
+func redisBreakerName(addr string) string {
+	return "redis:" + addr
+}
+
+// switches to conf's threshold and cooldown unless they come from an older
+// config. Disabling the breaker closes it.
+func (b *circuitBreaker) adopt(conf *PluginConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if conf.parseSeq <= b.parseSeq {
+		return
+	}
+	b.threshold, b.cooldown, b.parseSeq = conf.BreakerFailureThreshold, conf.BreakerCooldown, conf.parseSeq
+	if b.threshold <= 0 && b.state != breakerClosed {
+		b.failures, b.probing = 0, false
+		b.setState(breakerClosed)
+	}
+}
+
+// reports whether the dependency may be called, the caller must report the
+// outcome with success or failure. A nil breaker always allows.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	switch b.state {
+	case breakerOpen:
+		if remaining := b.cooldown - time.Since(b.openedAt); remaining > 0 {
+			return &breakerOpenError{name: b.name, retryAfter: remaining}
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return &breakerOpenError{name: b.name, retryAfter: b.cooldown}
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.failures = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		api.LogInfof("Circuit breaker for %s closed", b.name)
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		api.LogWarnf("Circuit breaker for %s opened after %d failures, cooling down for %v", b.name, b.failures, b.cooldown)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// releases a probe whose outcome is unknown, e.g. because the caller gave up,
+// so the next call can probe instead
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.probing = false
+}
+
+// must be called with b.mu held
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	breakerStateGauge.WithLabelValues(b.name).Set(float64(state))
+}
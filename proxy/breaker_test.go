@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Steps: s success, f failure, a abandon, c cooldown passes, then
+	// whether the next call is allowed
+	tests := []struct {
+		name    string
+		steps   string
+		allowed bool
+		state   breakerState
+	}{
+		{name: "new", steps: "", allowed: true, state: breakerClosed},
+		{name: "below threshold", steps: "ff", allowed: true, state: breakerClosed},
+		{name: "success resets the count", steps: "ffsff", allowed: true, state: breakerClosed},
+		{name: "opens at threshold", steps: "fff", allowed: false, state: breakerOpen},
+		{name: "probe after cooldown", steps: "fffc", allowed: true, state: breakerHalfOpen},
+		{name: "one probe at a time", steps: "fffcA", allowed: false, state: breakerHalfOpen},
+		{name: "abandoned probe frees the slot", steps: "fffcAa", allowed: true, state: breakerHalfOpen},
+		{name: "probe success closes", steps: "fffcAs", allowed: true, state: breakerClosed},
+		{name: "probe failure reopens", steps: "fffcAf", allowed: false, state: breakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{name: "test", threshold: 3, cooldown: time.Minute}
+			for _, step := range tt.steps {
+				switch step {
+				case 's':
+					b.success()
+				case 'f':
+					b.failure()
+				case 'a':
+					b.abandon()
+				case 'c':
+					b.openedAt = b.openedAt.Add(-b.cooldown)
+				case 'A':
+					if err := b.allow(); err != nil {
+						t.Fatalf("probe not allowed: %v", err)
+					}
+				}
+			}
+
+			err := b.allow()
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("allow() = %v, want allowed %v", err, tt.allowed)
+			}
+			var openErr *breakerOpenError
+			if err != nil && (!errors.As(err, &openErr) || openErr.retryAfter <= 0) {
+				t.Errorf("allow() = %v, want a breakerOpenError with a retry delay", err)
+			}
+			if b.state != tt.state {
+				t.Errorf("state %v, want %v", b.state, tt.state)
+			}
+		})
+	}
+}
+
+func TestDisabledBreaker(t *testing.T) {
+	var nilBreaker *circuitBreaker
+	disabled := &circuitBreaker{name: "test", threshold: 0, cooldown: time.Minute}
+	for _, b := range []*circuitBreaker{nilBreaker, disabled} {
+		for range 10 {
+			b.failure()
+		}
+		if err := b.allow(); err != nil {
+			t.Errorf("disabled breaker: allow() = %v", err)
+		}
+	}
+}
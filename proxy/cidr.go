@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Envoy attribute holding the downstream connection's address, as ip:port
+const sourceAddressProperty = "source.address"
+
+// A TenantCIDRRules entry
+type cidrRule struct {
+	prefix netip.Prefix
+	tenant string
+}
+
+// parses CIDR -> tenant rules, ordered so the first match is the longest
+// prefix. Bare addresses are taken as single-address prefixes.
+func parseCIDRRules(rules map[string]string) ([]cidrRule, error) {
+	parsed := make([]cidrRule, 0, len(rules))
+	for cidr, tenant := range rules {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		parsed = append(parsed, cidrRule{prefix: prefix.Masked(), tenant: tenant})
+	}
+
+	sort.Slice(parsed, func(i, j int) bool {
+		if parsed[i].prefix.Bits() != parsed[j].prefix.Bits() {
+			return parsed[i].prefix.Bits() > parsed[j].prefix.Bits()
+		}
+		// Equal lengths never overlap unless equal, this only keeps it stable
+		return parsed[i].prefix.String() < parsed[j].prefix.String()
+	})
+	return parsed, nil
+}
+
+// extracts the tenant ID from the client address, matched against
+// TenantCIDRRules with the longest prefix winning
+func (f *ShardRouterFilter) extractTenantFromAddress(header api.RequestHeaderMap) (string, error) {
+	addr, err := f.clientAddress(header)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range f.config.tenantCIDRs {
+		if rule.prefix.Contains(addr) {
+			api.LogDebugf("Extracted tenant ID from client address %s in %s: %s", addr, rule.prefix, rule.tenant)
+			return rule.tenant, nil
+		}
+	}
+	return "", fmt.Errorf("client address %s matches no tenant_cidr_rules", addr)
+}
+
+// returns the client's address: the connection's peer, or with
+// TenantXFFTrustedHops set, the x-forwarded-for entry added by the outermost
+// trusted proxy. Entries left of it may be forged by the client.
+func (f *ShardRouterFilter) clientAddress(header api.RequestHeaderMap) (netip.Addr, error) {
+	hops := f.config.TenantXFFTrustedHops
+	if hops == 0 {
+		source, err := f.callbacks.GetProperty(sourceAddressProperty)
+		if err != nil || source == "" {
+			return netip.Addr{}, errors.New("downstream address unavailable")
+		}
+		return parseClientAddress(source)
+	}
+
+	var entries []string
+	for _, value := range header.Values("x-forwarded-for") {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	if len(entries) < hops {
+		return netip.Addr{}, fmt.Errorf("x-forwarded-for has %d entries, fewer than the %d trusted hops", len(entries), hops)
+	}
+	return parseClientAddress(entries[len(entries)-hops])
+}
+
+// parses an address that may carry a port or brackets, unmapping IPv4
+// addresses written as IPv6
+func parseClientAddress(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		addrPort, portErr := netip.ParseAddrPort(s)
+		if portErr != nil {
+			return netip.Addr{}, fmt.Errorf("invalid client address %q", s)
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap().WithZone(""), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Request headers carrying only x-forwarded-for, one value per header line
+type xffHeaderMap struct {
+	api.RequestHeaderMap
+	xff []string
+}
+
+func (h xffHeaderMap) Values(name string) []string {
+	if name != "x-forwarded-for" {
+		return nil
+	}
+	return h.xff
+}
+
+func TestExtractTenantFromAddress(t *testing.T) {
+	rules, err := parseCIDRRules(map[string]string{
+		"10.0.0.0/8":          "corp",
+		"10.1.0.0/16":         "corp-eu",
+		"10.1.2.3":            "corp-eu-bastion",
+		"2001:db8::/32":       "ipv6-tenant",
+		"::ffff:10.9.0.0/112": "mapped",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		hops    int
+		xff     []string
+		want    string
+		wantErr bool
+	}{
+		{name: "shortest prefix", hops: 1, xff: []string{"10.200.0.1"}, want: "corp"},
+		{name: "longest prefix wins", hops: 1, xff: []string{"10.1.9.9"}, want: "corp-eu"},
+		{name: "bare address", hops: 1, xff: []string{"10.1.2.3"}, want: "corp-eu-bastion"},
+		{name: "ipv6", hops: 1, xff: []string{"2001:db8::1"}, want: "ipv6-tenant"},
+		{name: "ipv4-mapped address", hops: 1, xff: []string{"::ffff:10.1.2.3"}, want: "corp-eu-bastion"},
+		{name: "ipv4-mapped rule", hops: 1, xff: []string{"10.9.0.1"}, want: "mapped"},
+		{name: "address with port", hops: 1, xff: []string{"10.1.9.9:443"}, want: "corp-eu"},
+		{name: "bracketed ipv6 with port", hops: 1, xff: []string{"[2001:db8::1]:443"}, want: "ipv6-tenant"},
+		{name: "ignores entries left of the trusted hop", hops: 1, xff: []string{"10.1.2.3, 192.0.2.1"}, wantErr: true},
+		{name: "trusted hops across header lines", hops: 2, xff: []string{"10.1.2.3", "10.200.0.1, 192.0.2.1"}, want: "corp"},
+		{name: "fewer entries than trusted hops", hops: 3, xff: []string{"10.1.2.3, 192.0.2.1"}, wantErr: true},
+		{name: "no matching rule", hops: 1, xff: []string{"192.0.2.1"}, wantErr: true},
+		{name: "invalid address", hops: 1, xff: []string{"not-an-ip"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &ShardRouterFilter{config: &PluginConfig{tenantCIDRs: rules, TenantXFFTrustedHops: tt.hops}}
+			got, err := f.extractTenantFromAddress(xffHeaderMap{xff: tt.xff})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("extracted %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("extracted %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDRRulesRejectsInvalid(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0", "corp", ""} {
+		if _, err := parseCIDRRules(map[string]string{cidr: "corp"}); err == nil {
+			t.Errorf("parseCIDRRules(%q) succeeded", cidr)
+		}
+	}
+}
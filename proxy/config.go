@@ -1,59 +1,583 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	xds "github.com/cncf/xds/go/xds/type/v3"
 	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
-	"github.com/envoyproxy/envoy/contrib/golang/filters/http/source/go/pkg/http"
-	"github.com/hashicorp/golang-lru/v2"
 	"github.com/redis/go-redis/v9"
 )
 
 const Name = "shard_router"
 
-func init() {
-	http.RegisterHttpFilterFactoryAndConfigParser(Name, filterFactory, &parser{})
-}
+// Supported Redis storage layouts for tenant-shard mappings
+const (
+	RedisStorageString = "string"
+	RedisStorageHash   = "hash"
+)
+
+// Supported networks for reaching Redis
+const (
+	RedisNetworkTCP  = "tcp"
+	RedisNetworkUnix = "unix" // RedisAddr is a socket path, e.g. for a local sidecar
+)
+
+// Supported encodings of values written to Redis
+const (
+	RedisValueCodecRaw  = "raw"
+	RedisValueCodecZstd = "zstd"
+)
 
 // Represents individual tenant to shard mapping
 type TenantShardMapping struct {
-	TenantID string `json:"tenant_id"`
-	ShardID  string `json:"shard_id"`
+	TenantID string `json:"tenant_id" yaml:"tenant_id"`
+	ShardID  string `json:"shard_id" yaml:"shard_id"`
+
+	// Optional, scopes the entry to one environment of the tenant
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+
+	// Optional traffic split used while migrating a tenant, takes precedence over ShardID
+	WeightedShards []WeightedShard `json:"weighted_shards,omitempty" yaml:"weighted_shards,omitempty"`
+
+	// Optional shards that can serve the tenant besides the one routed to,
+	// reported to clients in x-shard-candidates
+	ReplicaShardIDs []string `json:"replica_shard_ids,omitempty" yaml:"replica_shard_ids,omitempty"`
+
+	// Optional cache TTL for this tenant, replacing memory_cache_ttl_from_s3
+	// and redis_ttl
+	TTLSeconds int `json:"ttl_seconds,omitempty" yaml:"ttl_seconds,omitempty"`
+
+	// Optional migration window, taking precedence over ShardID and
+	// WeightedShards: until MigrationUntil the tenant is routed between
+	// FromShard and ToShard by MigrationPolicy, then to ToShard only
+	FromShard       string     `json:"from_shard,omitempty" yaml:"from_shard,omitempty"`
+	ToShard         string     `json:"to_shard,omitempty" yaml:"to_shard,omitempty"`
+	MigrationUntil  *time.Time `json:"migration_until,omitempty" yaml:"migration_until,omitempty"`
+	MigrationPolicy string     `json:"migration_policy,omitempty" yaml:"migration_policy,omitempty"`
+}
+
+// Represents a shard receiving a share of a tenant's traffic
+type WeightedShard struct {
+	ShardID string `json:"shard_id" yaml:"shard_id"`
+	Weight  int    `json:"weight" yaml:"weight"`
 }
 
 // Represents the complete mapping data structure from S3
 type MappingData struct {
-	Mappings []TenantShardMapping `json:"mappings"`
+	Mappings []TenantShardMapping `json:"mappings" yaml:"mappings"`
+
+	// Alternative tenant IDs resolved to their canonical tenant before lookup
+	Aliases map[string]string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+
+	// Optional generation of the mapping, reported in MappingVersionHeader
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+
+	// Rules for tenants without an exact entry, the first matching one wins
+	Patterns []PatternShardMapping `json:"patterns,omitempty" yaml:"patterns,omitempty"`
 }
 
+// Represents a rule mapping every tenant whose lookup key matches a glob
+// pattern, e.g. "demo-*"
+type PatternShardMapping struct {
+	Pattern        string          `json:"pattern" yaml:"pattern"`
+	ShardID        string          `json:"shard_id" yaml:"shard_id"`
+	WeightedShards []WeightedShard `json:"weighted_shards,omitempty" yaml:"weighted_shards,omitempty"`
+	TTLSeconds     int             `json:"ttl_seconds,omitempty" yaml:"ttl_seconds,omitempty"`
+}
+
+// Supported ways of extracting the tenant ID from a request
+const (
+	TenantExtractionAuto      = "auto" // header, falling back to the Host subdomain
+	TenantExtractionHeader    = "header"
+	TenantExtractionSubdomain = "subdomain"
+	TenantExtractionCookie    = "cookie"
+	TenantExtractionPath      = "path"
+	TenantExtractionQuery     = "query"
+	TenantExtractionBody      = "body" // opt-in, buffers the request body
+	TenantExtractionMTLS      = "mtls" // a URI SAN of the client certificate
+	TenantExtractionCIDR      = "cidr" // the client address, by TenantCIDRRules
+)
+
+// Supported sources of the client certificate for mtls extraction
+const (
+	TenantSANSourceConnection = "connection" // the TLS connection Envoy terminated
+	TenantSANSourceXFCC       = "xfcc"       // x-forwarded-client-cert from a trusted proxy
+)
+
+// What to do with a request whose resolved shard is in the unhealthy set
+const (
+	UnhealthyShardPolicyFail      = "fail"      // fail the lookup, FailureMode decides
+	UnhealthyShardPolicyAlternate = "alternate" // another weighted shard, else fail
+	UnhealthyShardPolicyFallback  = "fallback"  // UnhealthyFallbackShardID
+)
+
+// Supported memory cache eviction policies
+const (
+	MemoryCacheEvictionLRU = "lru"
+	MemoryCacheEvictionLFU = "lfu"
+)
+
+// Supported normalizations of tenant keys before they are used as cache keys
+const (
+	CacheKeyHashNone   = "none"
+	CacheKeyHashSHA256 = "sha256"
+	CacheKeyHashXXHash = "xxhash"
+)
+
+// What to do with a Redis key longer than MaxRedisKeyLength
+const (
+	RedisLongKeyHash   = "hash"   // use the key's SHA-256 instead
+	RedisLongKeyReject = "reject" // don't cache the tenant in Redis
+)
+
+// Supported sources of truth for the mapping
+const (
+	MappingBackendS3   = "s3"
+	MappingBackendFile = "file"
+
+	// One small object per tenant, fetched directly by key
+	MappingBackendS3ObjectPerTenant = "s3-object-per-tenant"
+)
+
+// What a request gets when the shard cannot be resolved because a dependency failed
+const (
+	FailureModeOpen   = "open"   // forward without a shard
+	FailureModeClosed = "closed" // reject with 503
+)
+
+// Supported encodings of the mapping object
+const (
+	MappingFormatJSON   = "json"
+	MappingFormatYAML   = "yaml"
+	MappingFormatNDJSON = "ndjson" // one mapping object per line
+)
+
 // Represents the plugin configuration
 type PluginConfig struct {
+	// Source of truth for the mapping, and the local path for the file backend
+	MappingBackend  string `json:"mapping_backend"`
+	MappingFilePath string `json:"mapping_file_path"`
+
+	// Source-of-truth backends tried in order, each only when the ones before
+	// it failed. Just MappingBackend unless mapping_backends is given, in
+	// which case MappingBackend is its first entry.
+	MappingBackends []string `json:"mapping_backends"`
+
 	S3Bucket   string `json:"s3_bucket"`
 	S3Key      string `json:"s3_key"`
 	S3Region   string `json:"s3_region"`
 	S3Endpoint string `json:"s3_endpoint"`
+	S3Format   string `json:"s3_format"`
+
+	// Longest line of an ndjson mapping, a longer one fails the read
+	NDJSONMaxLineBytes int `json:"ndjson_max_line_bytes"`
+
+	// Address buckets as endpoint/bucket rather than bucket.endpoint. Defaults
+	// to true with a custom endpoint, which is what Minio needs.
+	S3PathStyle bool `json:"s3_path_style"`
+
+	// Endpoint URLs by SDK service ID ("s3", "sts") for stores that need more
+	// than S3Endpoint, signed for S3SigningRegion (S3Region when empty)
+	S3ServiceEndpoints map[string]string `json:"s3_service_endpoints"`
+	S3SigningRegion    string            `json:"s3_signing_region"`
+
+	// Pins S3Key to one object version, e.g. during a rollback. The latest
+	// version is read when empty.
+	S3VersionID string `json:"s3_version_id"`
+
+	// SSE-C: the base64 256-bit key the mapping objects were encrypted with,
+	// sent with every read. S3 only accepts AES256 as the algorithm.
+	S3SSECustomerKey       string `json:"s3_sse_customer_key" redact:"true"`
+	S3SSECustomerAlgorithm string `json:"s3_sse_customer_algorithm"`
+
+	// Largest mapping object or file that is read, 0 for no limit
+	MaxMappingBytes int64 `json:"max_mapping_bytes"`
+
+	// Several mapping objects merged into one view, later keys win on
+	// conflicts. Takes the place of S3Key when set.
+	S3Keys []string `json:"s3_keys"`
+
+	// Key of a tenant's object for the object-per-tenant backend, with
+	// {tenant} standing in for the tenant
+	S3KeyTemplate string `json:"s3_key_template"`
+
+	// Cross-account access: assume this role before talking to S3
+	S3RoleARN    string `json:"s3_role_arn"`
+	S3ExternalID string `json:"s3_external_id"`
 
+	// Cache tiers in front of the mapping backend, both enabled by default
+	EnableMemoryCache bool `json:"enable_memory_cache"`
+	EnableRedisCache  bool `json:"enable_redis_cache"`
+
+	RedisNetwork   string `json:"redis_network"`
 	RedisAddr      string `json:"redis_addr"`
-	RedisPassword  string `json:"redis_password"`
+	RedisUsername  string `json:"redis_username"` // Redis 6+ ACL user
+	RedisPassword  string `json:"redis_password" redact:"true"`
 	RedisDB        int    `json:"redis_db"`
 	RedisKeyPrefix string `json:"redis_key_prefix"`
 
-	MemoryCacheSize int           `json:"memory_cache_size"`
-	RedisTTL        time.Duration `json:"redis_ttl"`
+	// Read, never written, when a key is missing under RedisKeyPrefix, for
+	// moving to a new prefix without a flag day
+	RedisFallbackKeyPrefix string `json:"redis_fallback_key_prefix"`
+
+	// Read-only replicas serving lookups round-robin, writes stay on RedisAddr
+	RedisReplicaAddrs []string `json:"redis_replica_addrs"`
+
+	// RedisStorageMode selects between one prefixed key per tenant ("string")
+	// and a single hash holding every tenant as a field ("hash")
+	RedisStorageMode string `json:"redis_storage_mode"`
+	RedisHashKey     string `json:"redis_hash_key"`
+
+	// Compresses values on write. Reads detect compressed values whatever
+	// the codec, so switching it needs no flush.
+	RedisValueCodec string `json:"redis_value_codec"`
+
+	// Connection pool tuning passed through to go-redis
+	RedisPoolSize     int           `json:"redis_pool_size"`
+	RedisMinIdleConns int           `json:"redis_min_idle_conns"`
+	RedisMaxRetries   int           `json:"redis_max_retries"`
+	RedisDialTimeout  time.Duration `json:"redis_dial_timeout"`
+
+	// Write cache fills from a background worker instead of the request path,
+	// buffering up to RedisWriteBehindBufferSize writes before dropping them
+	RedisWriteBehind           bool `json:"redis_write_behind"`
+	RedisWriteBehindBufferSize int  `json:"redis_write_behind_buffer_size"`
+
+	// Keys per MGET/HSCAN round trip when reading mappings from Redis in bulk
+	RedisBatchSize int `json:"redis_batch_size"`
+
+	MemoryCacheSize int `json:"memory_cache_size"`
+
+	// Eviction policy of the memory cache, "lfu" keeps hot tenants through
+	// bursts of new ones
+	MemoryCacheEviction string `json:"memory_cache_eviction"`
+
+	// Share one memory cache per mapping, size and eviction policy across the
+	// process, instead of starting each stream's filter with an empty one
+	SharedMemoryCache bool `json:"shared_memory_cache"`
+
+	// How long a memory entry stays valid, by the tier it was promoted from.
+	// Redis may itself be stale, so its results usually get the shorter TTL.
+	// 0 keeps entries until they are evicted.
+	MemoryCacheTTLFromS3    time.Duration `json:"memory_cache_ttl_from_s3"`
+	MemoryCacheTTLFromRedis time.Duration `json:"memory_cache_ttl_from_redis"`
+
+	// Serve an expired memory entry at most StaleMaxAge past its TTL while
+	// it is refreshed in the background, instead of waiting on the lower tiers
+	StaleWhileRevalidate bool          `json:"stale_while_revalidate"`
+	StaleMaxAge          time.Duration `json:"stale_max_age"`
+
+	// Keep expired memory entries and serve them, however old, when every
+	// tier behind the memory cache fails, flagging the response x-shard-stale
+	ServeLastKnownGoodOnOutage bool `json:"serve_last_known_good_on_outage"`
+
+	// Expiry of Redis entries, unless RedisNoExpiry keeps them until evicted.
+	// A redis_ttl of 0s is the same as redis_no_expiry.
+	RedisTTL      time.Duration `json:"redis_ttl"`
+	RedisNoExpiry bool          `json:"redis_no_expiry"`
+
+	// Hash applied to lookup keys in the memory and Redis tiers to bound key size
+	CacheKeyHash string `json:"cache_key_hash"`
+
+	// Percent-encode characters that make awkward Redis keys, and hash or
+	// reject keys longer than MaxRedisKeyLength (0 allows any length)
+	SanitizeRedisKeys  bool   `json:"sanitize_redis_keys"`
+	MaxRedisKeyLength  int    `json:"max_redis_key_length"`
+	RedisLongKeyPolicy string `json:"redis_long_key_policy"`
 
-	TenantHeaderName string `json:"tenant_header_name"`
+	// Shard for requests without an extractable tenant, unrouted when empty
+	AnonymousShardID string `json:"anonymous_shard_id"`
+
+	// Sends every request to MaintenanceShardID, skipping the lookup. The
+	// admin socket can force it on or off for every config with a holding shard.
+	MaintenanceMode    bool   `json:"maintenance_mode"`
+	MaintenanceShardID string `json:"maintenance_shard_id"`
+
+	// Extracted tenants must match this regex in full, anything else is
+	// treated as no tenant. Lowercasing happens before matching.
+	TenantIDPattern   string `json:"tenant_id_pattern"`
+	TenantIDLowercase bool   `json:"tenant_id_lowercase"`
+
+	// Paths served without a lookup, e.g. health checks. An entry ending in
+	// "*" matches as a prefix, anything else must match exactly.
+	SkipPaths []string `json:"skip_paths"`
+
+	// An inbound x-shard-id is only trusted when this header is present, with
+	// TrustShardHeaderValue if set, and otherwise removed and re-derived.
+	// When empty every inbound x-shard-id is trusted.
+	TrustShardHeaderName  string `json:"trust_shard_header_name"`
+	TrustShardHeaderValue string `json:"trust_shard_header_value"`
+
+	// Where the tenant ID comes from, and the name or position used by each source
+	TenantExtractionMode string `json:"tenant_extraction_mode"`
+	TenantHeaderName     string `json:"tenant_header_name"`
+	TenantCookieName     string `json:"tenant_cookie_name"`
+	TenantPathSegment    int    `json:"tenant_path_segment"` // 0-based
+	TenantQueryParam     string `json:"tenant_query_param"`
+
+	// header extraction: fall back to the Host subdomain when the tenant
+	// header is missing, like auto does
+	FallbackToSubdomain bool `json:"fallback_to_subdomain"`
+
+	// subdomain extraction: how many leading host labels make up the tenant,
+	// and the domain they are under, never part of the tenant when set
+	SubdomainLabelCount int    `json:"subdomain_label_count"`
+	BaseDomain          string `json:"base_domain"`
+
+	// mtls extraction: where the client certificate's URI SANs are read from,
+	// and the pattern whose single capture group is the tenant
+	TenantSANSource  string `json:"tenant_san_source"`
+	TenantSANPattern string `json:"tenant_san_pattern"`
+
+	// cidr extraction: the tenant of each client address range, the longest
+	// matching prefix winning, and the proxies in front of Envoy that append
+	// to x-forwarded-for (0 uses the connection's address)
+	TenantCIDRRules      map[string]string `json:"tenant_cidr_rules"`
+	TenantXFFTrustedHops int               `json:"tenant_xff_trusted_hops"`
+
+	// Body extraction: the member holding the tenant, the content types the
+	// body is parsed for, and the largest body that is buffered for it
+	TenantBodyJSONPath     string   `json:"tenant_body_json_path"`
+	TenantBodyContentTypes []string `json:"tenant_body_content_types"`
+	MaxBodyBytes           int      `json:"max_body_bytes"`
+
+	// Optional environment combined with the tenant into the lookup key, read
+	// from this header or else from this 0-based host label (0 disables it,
+	// label 0 is the tenant)
+	EnvironmentHeaderName string `json:"environment_header_name"`
+	EnvironmentHostLabel  int    `json:"environment_host_label"`
+
+	// Header hashed to pick a shard from weighted assignments
+	StickinessHeader string `json:"stickiness_header"`
+
+	// Headers hashed together in place of StickinessHeader, so a user keeps
+	// to one shard of the tenant's weighted assignment, e.g. X-User-ID and
+	// X-Tenant-ID. Missing headers count as empty.
+	HashHeaders []string `json:"hash_headers"`
+
+	// Headers added to the upstream request, by name, with a lookup result:
+	// tenant, environment, shard, tier or candidates. Inbound copies are
+	// always removed so clients can't forge them.
+	RequestHeaders map[string]string `json:"request_headers"`
+
+	// Shared secret guarding privileged request features, sent in AdminTokenHeaderName
+	AdminToken           string `json:"admin_token" redact:"true"`
+	AdminTokenHeaderName string `json:"admin_token_header_name"`
+
+	// Path answering "?tenant=<id>[&environment=<env>]" with the tenant's shard
+	// as JSON instead of proxying, requires the admin token. Empty disables it.
+	ResolvePath string `json:"resolve_path"`
+
+	// Lets QA pin a request to a shard, requires the admin token
+	AllowShardOverrideHeader bool   `json:"allow_shard_override_header"`
+	ShardOverrideHeaderName  string `json:"shard_override_header_name"`
+
+	// Header a client may name its expected shard in. The hint is followed
+	// when it is one of the resolved candidates, else the resolved shard is.
+	ShardHintHeaderName string `json:"shard_hint_header_name"`
 
 	RedisTimeout time.Duration `json:"redis_timeout"`
 	S3Timeout    time.Duration `json:"s3_timeout"`
+
+	// Bound on a whole lookup across tiers, 0 leaves only the per-tier
+	// timeouts. The backend is skipped once less than a fifth of it is left.
+	LookupBudget time.Duration `json:"lookup_budget"`
+
+	// Retries of a lookup's S3 GetObject on transient errors, within S3Timeout
+	S3MaxRetries int `json:"s3_max_retries"`
+
+	// Lookups fetching from S3 at once per mapping source, unbounded when 0.
+	// A lookup waits up to S3LookupQueueTimeout for a slot before failing.
+	MaxConcurrentS3Lookups int           `json:"max_concurrent_s3_lookups"`
+	S3LookupQueueTimeout   time.Duration `json:"s3_lookup_queue_timeout"`
+
+	// Keep per-request S3 lookups from rescanning unchanged mapping objects by
+	// caching a parsed index per object, revalidated by ETag
+	S3IndexCache bool `json:"s3_index_cache"`
+
+	// Load the complete mapping from S3 on this interval, 0 fetches per lookup
+	S3RefreshInterval time.Duration `json:"s3_refresh_interval"`
+
+	// Bound on fetching and parsing each mapping object in a refresh, which
+	// may take far longer than a lookup's S3Timeout for a large mapping
+	S3RefreshTimeout time.Duration `json:"s3_refresh_timeout"`
+
+	// Stagger the periodic refresh loop across replicas
+	RefreshJitter bool `json:"refresh_jitter"`
+
+	// Seed the refresh snapshot from Redis before the first S3 load completes
+	WarmFromRedis bool `json:"warm_from_redis"`
+
+	// Shards that exist, e.g. the Envoy clusters routed to. Each refresh
+	// counts the mappings referencing any other shard, and is rejected when
+	// there are more than MaxUnknownShardReferences (-1 never rejects).
+	KnownShards               []string `json:"known_shards"`
+	MaxUnknownShardReferences int      `json:"max_unknown_shard_references"`
+
+	// Notified with a POST whenever a refresh loads a changed mapping, each
+	// notification bounded by ChangeWebhookTimeout
+	ChangeWebhookURL     string        `json:"change_webhook_url" redact:"true"`
+	ChangeWebhookTimeout time.Duration `json:"change_webhook_timeout"`
+
+	// Check <prefix>override:<tenant> in Redis before any tier, for pinning
+	// tenants to a shard during an incident
+	EnableRedisOverrides bool `json:"enable_redis_overrides"`
+
+	// Redis key prefix of the mapping overlay, where tenants changed since the
+	// last refresh are published. It outranks every tier but overrides, and
+	// its answers are remembered for MappingOverlayCacheTTL. Empty disables it.
+	MappingOverlayPrefix   string        `json:"mapping_overlay_prefix"`
+	MappingOverlayCacheTTL time.Duration `json:"mapping_overlay_cache_ttl"`
+
+	// Redis set of shards not to route to, read every
+	// UnhealthyShardsRefreshInterval. Empty disables the check.
+	UnhealthyShardsKey             string        `json:"unhealthy_shards_key"`
+	UnhealthyShardsRefreshInterval time.Duration `json:"unhealthy_shards_refresh_interval"`
+	UnhealthyShardPolicy           string        `json:"unhealthy_shard_policy"`
+	UnhealthyFallbackShardID       string        `json:"unhealthy_fallback_shard_id"`
+
+	// Percentage of each shard's tenants diverted away from it, e.g. while it
+	// is drained for maintenance, to their other shards or DrainFallbackShardID
+	DrainShards          map[string]int `json:"drain_shards"`
+	DrainFallbackShardID string         `json:"drain_fallback_shard_id"`
+
+	// Behavior when lookups fail because Redis or S3 is unavailable
+	FailureMode string `json:"failure_mode"`
+
+	// Consecutive failures that open a dependency's breaker (0 disables), and
+	// how long it stays open before a probe is let through
+	BreakerFailureThreshold int           `json:"breaker_failure_threshold"`
+	BreakerCooldown         time.Duration `json:"breaker_cooldown"`
+
+	// Resolve and report shards without setting x-shard-id, for validating a rollout
+	DryRun bool `json:"dry_run"`
+
+	// Debugging aid: report lookup latency and the answering tier in response headers
+	EmitTimingHeader bool `json:"emit_timing_header"`
+
+	// Report x-shard-id in the response trailers rather than the headers, for
+	// gRPC clients that read metadata from trailers
+	ShardInTrailers bool `json:"shard_in_trailers"`
+
+	// Publish the resolved shard as dynamic metadata for routes and subset
+	// load balancing to select on, under routeMetadataNamespace
+	EmitRouteMetadata bool `json:"emit_route_metadata"`
+
+	// Route later streams of a downstream connection with the same authority
+	// as the first one was for this long, without extraction or lookup. Only
+	// when the tenant is fixed per connection; 0 disables it.
+	ConnectionCacheTTL  time.Duration `json:"connection_cache_ttl"`
+	ConnectionCacheSize int           `json:"connection_cache_size"`
+
+	// Response header reporting the loaded mapping's version, disabled when empty
+	MappingVersionHeader string `json:"mapping_version_header"`
+
+	// Address for the process-wide Prometheus /metrics server, disabled when empty
+	MetricsAddr string `json:"metrics_addr"`
+
+	// Unix socket answering admin commands, opened by the first filter-level
+	// config that sets it
+	AdminSocketPath string `json:"admin_socket_path"`
+
+	// How long after startup lookups are left out of cache_hit_ratio, while
+	// the caches fill. Process-wide, the first filter-level config starts it.
+	WarmupGracePeriod time.Duration `json:"warmup_grace_period"`
+
+	// Half-life of the recent hit ratio gauges. Process-wide, the last
+	// filter-level config parsed sets it.
+	HitRatioHalfLife time.Duration `json:"hit_ratio_half_life"`
+
+	// Minimum level of the filter's own log messages, on top of Envoy's
+	LogLevel string `json:"log_level"`
+
+	// Fraction of lookups, 0 to 1, logged step by step at info level
+	// whatever LogLevel is. 0 disables sampling.
+	DebugSampleRate float64 `json:"debug_sample_rate"`
+
+	// TenantBodyJSONPath parsed in Parse
+	tenantBodyPath []jsonPathStep
+
+	// LogLevel parsed in Parse
+	minLogLevel api.LogType
+
+	// TenantIDPattern compiled in Parse, nil when unset
+	tenantIDPattern *regexp.Regexp
+
+	// TenantSANPattern compiled in Parse
+	tenantSANPattern *regexp.Regexp
+
+	// S3SSECustomerKey decoded in Parse, with the base64 MD5 S3 checks it against
+	sseCustomerKey    string
+	sseCustomerKeyMD5 string
+
+	// TenantCIDRRules parsed in Parse, longest prefixes first
+	tenantCIDRs []cidrRule
+
+	// KnownShards as a set, built in Parse
+	knownShards map[string]struct{}
+
+	// Built in Parse or Merge with ConnectionCacheTTL, one per effective config
+	connectionCache *connectionCache
+
+	// Set on filter-level configs that hold a metrics server reference
+	holdsMetricsServer bool
+
+	// Set on filter-level configs that hold a shared state reference
+	holdsSharedState bool
+
+	// Set on filter-level configs registered with the admin socket
+	holdsAdminSocket bool
+
+	// Set on filter-level configs counted in the maintenance_mode gauge
+	holdsMaintenance bool
+
+	// Order in which configs were parsed. The shared refreshers, breakers and
+	// write-behind workers run with the settings of the newest config using them.
+	parseSeq uint64
+
+	// Web identity or assume-role credentials verified in Parse, refreshed by the SDK
+	s3Credentials *credentials.Credentials
+
+	// Config keys explicitly present in the parsed config, used by Merge
+	set map[string]bool
+}
+
+// reports whether key was explicitly specified rather than defaulted
+func (c *PluginConfig) isSet(key string) bool {
+	return c.set[key]
+}
+
+// Represents a memory cache value with the tier it was promoted from
+type memoryCacheEntry struct {
+	assignment string
+	source     string // tierRedis, tierS3 or tierFile
+	cachedAt   time.Time
+	ttl        time.Duration // the tenant's own TTL, 0 for the tier's
 }
 
 // Represents the main filter with multi-tiered caching
@@ -64,17 +588,81 @@ type ShardRouterFilter struct {
 	config    *PluginConfig
 
 	// Caching layers
-	memoryCache *lru.Cache[string, string]
-	redisClient *redis.Client
-	s3Client    *s3.S3
+	memoryCache memoryCacheStore
+	redisClient redis.Cmdable
+	redisReader redis.Cmdable // a replica when configured, else redisClient
+	writeBehind *redisWriteBehind
+	s3Client    s3Getter
+	refresher   *mappingRefresher
+
+	// Process-wide breakers guarding the dependencies above
+	redisBreaker       *circuitBreaker
+	redisReaderBreaker *circuitBreaker
+	s3Breaker          *circuitBreaker
+
+	// Process-wide bound on concurrent S3 lookups, nil when unbounded
+	s3Limiter *s3Limiter
+
+	// Process-wide view of the unhealthy shard set, nil without one
+	unhealthyShards *unhealthyShardWatcher
 
 	// Current request state
-	currentShardID string
+	requestHeader   api.RequestHeaderMap // kept for setRequestHeaders, nil without RequestHeaders
+	tenantID        string
+	currentShardID  string
+	shardCandidates []string // currentShardID and its replicas, nil without replicas
+	lookupElapsed   time.Duration
+	lookupTier      string // empty when no lookup ran
+	redisResult     string // hit, miss, error or breaker_open, empty when Redis wasn't asked
+	servedStale     bool   // an expired memory entry was served through an outage
+	connKey         string // connection cache key, empty when not cached per connection
+	shardHint       string // the client's ShardHintHeaderName, empty without one
+
+	// Set while the body is buffered for tenant extraction, along with the
+	// values already taken from the headers
+	awaitingBody bool
+	environment  string
+	stickyKey    string
+
+	// Parent of all lookup contexts, canceled when the stream is destroyed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// Synchronization
 	mu sync.RWMutex
 }
 
+// RedactedSummary renders the effective configuration as key=value pairs
+// using the config field names, with secrets (fields tagged redact) masked
+func (c *PluginConfig) RedactedSummary() string {
+	var b strings.Builder
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+
+		value := v.Field(i)
+		if field.Tag.Get("redact") == "true" && !value.IsZero() {
+			b.WriteString("<redacted>")
+		} else {
+			fmt.Fprintf(&b, "%v", value.Interface())
+		}
+	}
+
+	return b.String()
+}
+
 type parser struct {
 }
 
@@ -86,195 +674,1537 @@ func (p *parser) Parse(any *anypb.Any, callbacks api.ConfigCallbackHandler) (any
 	}
 
 	v := configStruct.Value
-	conf := &PluginConfig{}
+	conf := &PluginConfig{parseSeq: parseSeq.Add(1)}
 
-	// Parse S3 configuration
-	if s3Bucket, ok := v.AsMap()["s3_bucket"]; ok {
-		if str, ok := s3Bucket.(string); ok {
-			conf.S3Bucket = str
-		} else {
-			return nil, errors.New("s3_bucket must be a string")
-		}
-	} else {
-		return nil, errors.New("missing s3_bucket")
+	// Resolve ${ENV_VAR} references so secrets can come from the pod environment
+	// and read the settings once, AsMap converts the whole struct on every call
+	settings := expandEnvValues(v.AsMap())
+	var err error
+
+	// Track which keys were given so Merge can tell explicit values from defaults
+	conf.set = make(map[string]bool)
+	for key := range settings {
+		conf.set[key] = true
 	}
 
-	if s3Key, ok := v.AsMap()["s3_key"]; ok {
-		if str, ok := s3Key.(string); ok {
-			conf.S3Key = str
-		} else {
-			return nil, errors.New("s3_key must be a string")
-		}
-	} else {
-		return nil, errors.New("missing s3_key")
+	// Parse mapping backend configuration
+	if conf.MappingBackend, err = getString(settings, "mapping_backend", MappingBackendS3); err != nil {
+		return nil, err
 	}
 
-	if s3Region, ok := v.AsMap()["s3_region"]; ok {
-		if str, ok := s3Region.(string); ok {
-			conf.S3Region = str
-		} else {
-			return nil, errors.New("s3_region must be a string")
+	if conf.MappingBackends, err = getStringList(settings, "mapping_backends", []string{conf.MappingBackend}); err != nil {
+		return nil, err
+	}
+	if conf.isSet("mapping_backends") {
+		if conf.isSet("mapping_backend") {
+			return nil, errors.New("mapping_backend and mapping_backends are mutually exclusive")
 		}
-	} else {
-		conf.S3Region = "us-east-1" // default
+		if len(conf.MappingBackends) == 0 {
+			return nil, errors.New("mapping_backends must not be empty")
+		}
+		conf.MappingBackend = conf.MappingBackends[0]
 	}
 
-	if s3Endpoint, ok := v.AsMap()["s3_endpoint"]; ok {
-		if str, ok := s3Endpoint.(string); ok {
-			conf.S3Endpoint = str
-		} else {
-			return nil, errors.New("s3_endpoint must be a string")
+	s3Backends := 0
+	for i, backend := range conf.MappingBackends {
+		switch backend {
+		case MappingBackendS3, MappingBackendS3ObjectPerTenant:
+			s3Backends++
+		case MappingBackendFile:
+		default:
+			return nil, fmt.Errorf("invalid mapping_backend: %s", backend)
 		}
+		if slices.Contains(conf.MappingBackends[:i], backend) {
+			return nil, fmt.Errorf("mapping_backends lists %s twice", backend)
+		}
+	}
+	// They would share a breaker and a concurrency limit
+	if s3Backends > 1 {
+		return nil, errors.New("mapping_backends may hold only one of s3 and s3-object-per-tenant")
 	}
 
-	// Parse Redis configuration
-	if redisAddr, ok := v.AsMap()["redis_addr"]; ok {
-		if str, ok := redisAddr.(string); ok {
-			conf.RedisAddr = str
-		} else {
-			return nil, errors.New("redis_addr must be a string")
-		}
-	} else {
-		return nil, errors.New("missing redis_addr")
+	// Per-route configs are merged over the filter-level one, so only the
+	// filter-level config must give the required settings
+
+	if conf.MappingFilePath, err = getString(settings, "mapping_file_path", ""); err != nil {
+		return nil, err
+	}
+	if callbacks != nil && conf.hasBackend(MappingBackendFile) && !conf.isSet("mapping_file_path") {
+		return nil, errors.New("missing mapping_file_path")
 	}
 
-	if redisPassword, ok := v.AsMap()["redis_password"]; ok {
-		if str, ok := redisPassword.(string); ok {
-			conf.RedisPassword = str
-		}
+	// Parse S3 configuration, the bucket and key are only needed by the S3 backend
+	if conf.S3Bucket, err = getString(settings, "s3_bucket", ""); err != nil {
+		return nil, err
+	}
+	if callbacks != nil && conf.usesS3() && !conf.isSet("s3_bucket") {
+		return nil, errors.New("missing s3_bucket")
 	}
 
-	if redisDB, ok := v.AsMap()["redis_db"]; ok {
-		if num, ok := redisDB.(float64); ok {
-			conf.RedisDB = int(num)
-		} else {
-			return nil, errors.New("redis_db must be a number")
-		}
+	if conf.S3Keys, err = getStringList(settings, "s3_keys", nil); err != nil {
+		return nil, err
+	}
+	if conf.isSet("s3_keys") && len(conf.S3Keys) == 0 {
+		return nil, errors.New("s3_keys must not be empty")
 	}
 
-	if redisKeyPrefix, ok := v.AsMap()["redis_key_prefix"]; ok {
-		if str, ok := redisKeyPrefix.(string); ok {
-			conf.RedisKeyPrefix = str
-		}
-	} else {
-		conf.RedisKeyPrefix = "shard_router:"
+	if conf.S3Key, err = getString(settings, "s3_key", ""); err != nil {
+		return nil, err
+	}
+	if callbacks != nil && conf.hasBackend(MappingBackendS3) && !conf.isSet("s3_key") && len(conf.S3Keys) == 0 {
+		return nil, errors.New("missing s3_key or s3_keys")
 	}
 
-	// Parse cache configuration
-	if cacheSize, ok := v.AsMap()["memory_cache_size"]; ok {
-		if num, ok := cacheSize.(float64); ok {
-			conf.MemoryCacheSize = int(num)
-		} else {
-			return nil, errors.New("memory_cache_size must be a number")
-		}
-	} else {
-		conf.MemoryCacheSize = 1000 // default
+	if conf.S3KeyTemplate, err = getString(settings, "s3_key_template", "mappings/{tenant}"); err != nil {
+		return nil, err
+	}
+	if conf.hasBackend(MappingBackendS3ObjectPerTenant) && !strings.Contains(conf.S3KeyTemplate, "{tenant}") {
+		return nil, errors.New("s3_key_template must contain {tenant}")
 	}
 
-	if redisTTL, ok := v.AsMap()["redis_ttl"]; ok {
-		if str, ok := redisTTL.(string); ok {
-			ttl, err := time.ParseDuration(str)
-			if err != nil {
-				return nil, fmt.Errorf("invalid redis_ttl format: %v", err)
-			}
-			conf.RedisTTL = ttl
-		} else {
-			return nil, errors.New("redis_ttl must be a string duration")
-		}
-	} else {
-		conf.RedisTTL = 5 * time.Minute // default
+	if conf.S3VersionID, err = getString(settings, "s3_version_id", ""); err != nil {
+		return nil, err
+	}
+	// A version ID belongs to a single object
+	if conf.S3VersionID != "" && (len(conf.S3Keys) > 0 || conf.hasBackend(MappingBackendS3ObjectPerTenant)) {
+		return nil, errors.New("s3_version_id requires a single s3_key")
 	}
 
-	// Parse tenant extraction configuration
-	if headerName, ok := v.AsMap()["tenant_header_name"]; ok {
-		if str, ok := headerName.(string); ok {
-			conf.TenantHeaderName = str
+	if conf.S3SSECustomerKey, err = getString(settings, "s3_sse_customer_key", ""); err != nil {
+		return nil, err
+	}
+	if conf.S3SSECustomerAlgorithm, err = getString(settings, "s3_sse_customer_algorithm", s3.ServerSideEncryptionAes256); err != nil {
+		return nil, err
+	}
+	if conf.S3SSECustomerAlgorithm != s3.ServerSideEncryptionAes256 {
+		return nil, fmt.Errorf("s3_sse_customer_algorithm must be %s", s3.ServerSideEncryptionAes256)
+	}
+	if conf.S3SSECustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(conf.S3SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			// The key itself is never part of the error
+			return nil, errors.New("s3_sse_customer_key must be a base64 encoded 256-bit key")
 		}
-	} else {
-		conf.TenantHeaderName = "X-Tenant-ID"
+		sum := md5.Sum(key)
+		conf.sseCustomerKey = string(key)
+		conf.sseCustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
 	}
 
-	// Parse timeouts
-	if redisTimeout, ok := v.AsMap()["redis_timeout"]; ok {
-		if str, ok := redisTimeout.(string); ok {
-			timeout, err := time.ParseDuration(str)
-			if err != nil {
-				return nil, fmt.Errorf("invalid redis_timeout format: %v", err)
-			}
-			conf.RedisTimeout = timeout
-		} else {
-			return nil, errors.New("redis_timeout must be a string duration")
-		}
-	} else {
-		conf.RedisTimeout = 2 * time.Second // default
+	if conf.S3Region, err = getString(settings, "s3_region", "us-east-1"); err != nil {
+		return nil, err
 	}
 
-	if s3Timeout, ok := v.AsMap()["s3_timeout"]; ok {
-		if str, ok := s3Timeout.(string); ok {
-			timeout, err := time.ParseDuration(str)
-			if err != nil {
-				return nil, fmt.Errorf("invalid s3_timeout format: %v", err)
+	if conf.S3Endpoint, err = getString(settings, "s3_endpoint", ""); err != nil {
+		return nil, err
+	}
+	// The SDK refuses to send SSE-C keys in the clear
+	if conf.sseCustomerKey != "" && strings.HasPrefix(conf.S3Endpoint, "http://") {
+		return nil, errors.New("s3_sse_customer_key requires an https s3_endpoint")
+	}
+
+	if serviceEndpoints, ok := settings["s3_service_endpoints"]; ok {
+		services, ok := serviceEndpoints.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("s3_service_endpoints must be a map of service to URL")
+		}
+		conf.S3ServiceEndpoints = make(map[string]string, len(services))
+		for service, endpoint := range services {
+			if service != endpoints.S3ServiceID && service != endpoints.StsServiceID {
+				return nil, fmt.Errorf("s3_service_endpoints: unsupported service %q, expected s3 or sts", service)
 			}
-			conf.S3Timeout = timeout
-		} else {
-			return nil, errors.New("s3_timeout must be a string duration")
+			str, ok := endpoint.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3_service_endpoints: endpoint for %s must be a string", service)
+			}
+			parsed, err := url.Parse(str)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("s3_service_endpoints: endpoint for %s must be an http or https URL", service)
+			}
+			conf.S3ServiceEndpoints[service] = str
 		}
-	} else {
-		conf.S3Timeout = 5 * time.Second // default
+	}
+	if _, ok := conf.S3ServiceEndpoints[endpoints.S3ServiceID]; ok && conf.S3Endpoint != "" {
+		return nil, errors.New("s3_endpoint and an s3 entry in s3_service_endpoints are mutually exclusive")
 	}
 
-	return conf, nil
-}
-
-// Merge configuration from the inherited parent configuration
-// This is needed by Envoy to allow for configuration inheritance
-func (p *parser) Merge(parent any, child any) any {
-	parentConfig := parent.(*PluginConfig)
-	childConfig := child.(*PluginConfig)
+	if conf.S3SigningRegion, err = getString(settings, "s3_signing_region", ""); err != nil {
+		return nil, err
+	}
 
-	// copy one, do not update parentConfig directly.
-	newConfig := *parentConfig
+	if conf.S3PathStyle, err = getBool(settings, "s3_path_style", defaultS3PathStyle(conf)); err != nil {
+		return nil, err
+	}
 
-	// Override with child configuration values
-	if childConfig.S3Bucket != "" {
-		newConfig.S3Bucket = childConfig.S3Bucket
+	if conf.S3Format, err = getString(settings, "s3_format", MappingFormatJSON); err != nil {
+		return nil, err
 	}
-	if childConfig.S3Key != "" {
-		newConfig.S3Key = childConfig.S3Key
+	if conf.S3Format != MappingFormatJSON && conf.S3Format != MappingFormatYAML && conf.S3Format != MappingFormatNDJSON {
+		return nil, fmt.Errorf("invalid s3_format: %s", conf.S3Format)
 	}
-	if childConfig.S3Region != "" {
-		newConfig.S3Region = childConfig.S3Region
+
+	if conf.NDJSONMaxLineBytes, err = getInt(settings, "ndjson_max_line_bytes", 64*1024); err != nil {
+		return nil, err
 	}
-	if childConfig.S3Endpoint != "" {
-		newConfig.S3Endpoint = childConfig.S3Endpoint
+	if conf.NDJSONMaxLineBytes < 1 {
+		return nil, errors.New("ndjson_max_line_bytes must be positive")
 	}
-	if childConfig.RedisAddr != "" {
-		newConfig.RedisAddr = childConfig.RedisAddr
+
+	maxMappingBytes, err := getInt(settings, "max_mapping_bytes", 128<<20)
+	if err != nil {
+		return nil, err
 	}
-	if childConfig.RedisPassword != "" {
-		newConfig.RedisPassword = childConfig.RedisPassword
+	if maxMappingBytes < 0 {
+		return nil, errors.New("max_mapping_bytes must not be negative")
 	}
-	if childConfig.RedisDB != 0 {
-		newConfig.RedisDB = childConfig.RedisDB
+	conf.MaxMappingBytes = int64(maxMappingBytes)
+
+	if conf.S3RoleARN, err = getString(settings, "s3_role_arn", ""); err != nil {
+		return nil, err
 	}
-	if childConfig.RedisKeyPrefix != "" {
-		newConfig.RedisKeyPrefix = childConfig.RedisKeyPrefix
+
+	if conf.S3ExternalID, err = getString(settings, "s3_external_id", ""); err != nil {
+		return nil, err
 	}
-	if childConfig.MemoryCacheSize != 0 {
-		newConfig.MemoryCacheSize = childConfig.MemoryCacheSize
+	if conf.S3ExternalID != "" && conf.S3RoleARN == "" {
+		return nil, errors.New("s3_external_id requires s3_role_arn")
 	}
-	if childConfig.RedisTTL != 0 {
-		newConfig.RedisTTL = childConfig.RedisTTL
+
+	// Parse cache tier toggles. The mapping backend validated above always
+	// remains as the source of truth, so either cache may be turned off.
+	if conf.EnableMemoryCache, err = getBool(settings, "enable_memory_cache", true); err != nil {
+		return nil, err
 	}
-	if childConfig.TenantHeaderName != "" {
-		newConfig.TenantHeaderName = childConfig.TenantHeaderName
+
+	if conf.EnableRedisCache, err = getBool(settings, "enable_redis_cache", true); err != nil {
+		return nil, err
 	}
-	if childConfig.RedisTimeout != 0 {
+
+	// Parse Redis configuration, the address is only needed with the Redis tier
+	if conf.RedisAddr, err = getString(settings, "redis_addr", ""); err != nil {
+		return nil, err
+	}
+	if callbacks != nil && conf.EnableRedisCache && !conf.isSet("redis_addr") {
+		return nil, errors.New("missing redis_addr")
+	}
+
+	if conf.RedisReplicaAddrs, err = getStringList(settings, "redis_replica_addrs", nil); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisNetwork, err = getString(settings, "redis_network", RedisNetworkTCP); err != nil {
+		return nil, err
+	}
+	switch conf.RedisNetwork {
+	case RedisNetworkTCP:
+	case RedisNetworkUnix:
+		// Replicas are reached over the same network as the primary
+		for _, addr := range append([]string{conf.RedisAddr}, conf.RedisReplicaAddrs...) {
+			if addr != "" && !filepath.IsAbs(addr) {
+				return nil, fmt.Errorf("redis_network unix requires socket paths, got %q", addr)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid redis_network: %s", conf.RedisNetwork)
+	}
+
+	if conf.RedisUsername, err = getString(settings, "redis_username", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisPassword, err = getString(settings, "redis_password", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisDB, err = getInt(settings, "redis_db", 0); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisKeyPrefix, err = getString(settings, "redis_key_prefix", "shard_router:"); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisFallbackKeyPrefix, err = getString(settings, "redis_fallback_key_prefix", ""); err != nil {
+		return nil, err
+	}
+	if conf.isSet("redis_fallback_key_prefix") && conf.RedisFallbackKeyPrefix == conf.RedisKeyPrefix {
+		return nil, errors.New("redis_fallback_key_prefix must differ from redis_key_prefix")
+	}
+
+	if conf.RedisStorageMode, err = getString(settings, "redis_storage_mode", RedisStorageString); err != nil {
+		return nil, err
+	}
+	if conf.RedisStorageMode != RedisStorageString && conf.RedisStorageMode != RedisStorageHash {
+		return nil, fmt.Errorf("invalid redis_storage_mode: %s", conf.RedisStorageMode)
+	}
+	if conf.RedisFallbackKeyPrefix != "" && conf.RedisStorageMode != RedisStorageString {
+		return nil, errors.New("redis_fallback_key_prefix requires redis_storage_mode string")
+	}
+
+	if conf.RedisHashKey, err = getString(settings, "redis_hash_key", "shards"); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisValueCodec, err = getString(settings, "redis_value_codec", RedisValueCodecRaw); err != nil {
+		return nil, err
+	}
+	if conf.RedisValueCodec != RedisValueCodecRaw && conf.RedisValueCodec != RedisValueCodecZstd {
+		return nil, fmt.Errorf("invalid redis_value_codec: %s", conf.RedisValueCodec)
+	}
+
+	// Parse Redis connection pool configuration
+	// The default is the same as go-redis's
+	if conf.RedisPoolSize, err = getInt(settings, "redis_pool_size", 10*runtime.GOMAXPROCS(0)); err != nil {
+		return nil, err
+	}
+	if conf.RedisPoolSize <= 0 {
+		return nil, errors.New("redis_pool_size must be positive")
+	}
+
+	if conf.RedisMinIdleConns, err = getInt(settings, "redis_min_idle_conns", 2); err != nil {
+		return nil, err
+	}
+	// The default is kept even with a smaller pool
+	if conf.isSet("redis_min_idle_conns") && (conf.RedisMinIdleConns < 0 || conf.RedisMinIdleConns > conf.RedisPoolSize) {
+		return nil, errors.New("redis_min_idle_conns must be between 0 and redis_pool_size")
+	}
+
+	if conf.RedisMaxRetries, err = getInt(settings, "redis_max_retries", 3); err != nil {
+		return nil, err
+	}
+	// -1 disables retries in go-redis
+	if conf.RedisMaxRetries < -1 {
+		return nil, errors.New("redis_max_retries must be -1 or greater")
+	}
+
+	if conf.RedisDialTimeout, err = getDuration(settings, "redis_dial_timeout", 5*time.Second); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisBatchSize, err = getInt(settings, "redis_batch_size", 500); err != nil {
+		return nil, err
+	}
+	if conf.RedisBatchSize <= 0 {
+		return nil, errors.New("redis_batch_size must be positive")
+	}
+
+	if conf.RedisWriteBehind, err = getBool(settings, "redis_write_behind", false); err != nil {
+		return nil, err
+	}
+
+	if conf.RedisWriteBehindBufferSize, err = getInt(settings, "redis_write_behind_buffer_size", 10000); err != nil {
+		return nil, err
+	}
+	if conf.RedisWriteBehindBufferSize <= 0 {
+		return nil, errors.New("redis_write_behind_buffer_size must be positive")
+	}
+
+	// Parse cache configuration
+	if conf.MemoryCacheSize, err = getInt(settings, "memory_cache_size", 1000); err != nil {
+		return nil, err
+	}
+	if conf.MemoryCacheSize < 1 {
+		return nil, errors.New("memory_cache_size must be positive")
+	}
+
+	if conf.MemoryCacheEviction, err = getString(settings, "memory_cache_eviction", MemoryCacheEvictionLRU); err != nil {
+		return nil, err
+	}
+	if conf.MemoryCacheEviction != MemoryCacheEvictionLRU && conf.MemoryCacheEviction != MemoryCacheEvictionLFU {
+		return nil, fmt.Errorf("invalid memory_cache_eviction: %s", conf.MemoryCacheEviction)
+	}
+
+	if conf.SharedMemoryCache, err = getBool(settings, "shared_memory_cache", false); err != nil {
+		return nil, err
+	}
+
+	if conf.MemoryCacheTTLFromS3, err = getDuration(settings, "memory_cache_ttl_from_s3", 0); err != nil {
+		return nil, err
+	}
+	if conf.MemoryCacheTTLFromS3 < 0 {
+		return nil, errors.New("memory_cache_ttl_from_s3 must not be negative")
+	}
+
+	if conf.MemoryCacheTTLFromRedis, err = getDuration(settings, "memory_cache_ttl_from_redis", 0); err != nil {
+		return nil, err
+	}
+	if conf.MemoryCacheTTLFromRedis < 0 {
+		return nil, errors.New("memory_cache_ttl_from_redis must not be negative")
+	}
+
+	if conf.StaleWhileRevalidate, err = getBool(settings, "stale_while_revalidate", false); err != nil {
+		return nil, err
+	}
+
+	if conf.StaleMaxAge, err = getDuration(settings, "stale_max_age", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if conf.StaleMaxAge <= 0 {
+		return nil, errors.New("stale_max_age must be positive")
+	}
+
+	if conf.ServeLastKnownGoodOnOutage, err = getBool(settings, "serve_last_known_good_on_outage", false); err != nil {
+		return nil, err
+	}
+	if conf.ServeLastKnownGoodOnOutage && !conf.EnableMemoryCache {
+		return nil, errors.New("serve_last_known_good_on_outage requires enable_memory_cache")
+	}
+
+	if conf.RedisTTL, err = getDuration(settings, "redis_ttl", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if conf.RedisTTL < 0 {
+		return nil, errors.New("redis_ttl must not be negative")
+	}
+
+	if conf.RedisNoExpiry, err = getBool(settings, "redis_no_expiry", conf.RedisTTL == 0); err != nil {
+		return nil, err
+	}
+	if !conf.RedisNoExpiry && conf.RedisTTL == 0 {
+		return nil, errors.New("redis_ttl of 0s means no expiry, it contradicts redis_no_expiry: false")
+	}
+
+	if conf.CacheKeyHash, err = getString(settings, "cache_key_hash", CacheKeyHashNone); err != nil {
+		return nil, err
+	}
+	switch conf.CacheKeyHash {
+	case CacheKeyHashNone, CacheKeyHashSHA256, CacheKeyHashXXHash:
+	default:
+		return nil, fmt.Errorf("invalid cache_key_hash: %s", conf.CacheKeyHash)
+	}
+
+	if conf.SanitizeRedisKeys, err = getBool(settings, "sanitize_redis_keys", false); err != nil {
+		return nil, err
+	}
+
+	if conf.MaxRedisKeyLength, err = getInt(settings, "max_redis_key_length", 0); err != nil {
+		return nil, err
+	}
+	if conf.MaxRedisKeyLength < 0 {
+		return nil, errors.New("max_redis_key_length must not be negative")
+	}
+
+	if conf.RedisLongKeyPolicy, err = getString(settings, "redis_long_key_policy", RedisLongKeyHash); err != nil {
+		return nil, err
+	}
+	if conf.RedisLongKeyPolicy != RedisLongKeyHash && conf.RedisLongKeyPolicy != RedisLongKeyReject {
+		return nil, fmt.Errorf("invalid redis_long_key_policy: %s", conf.RedisLongKeyPolicy)
+	}
+	// A hashed key must fit itself
+	if minLength := len(conf.RedisKeyPrefix) + len(hashedRedisKeyPrefix) + sha256.Size*2; conf.MaxRedisKeyLength > 0 &&
+		conf.RedisLongKeyPolicy == RedisLongKeyHash && conf.MaxRedisKeyLength < minLength {
+		return nil, fmt.Errorf("max_redis_key_length must be at least %d to fit a hashed key", minLength)
+	}
+
+	if conf.AnonymousShardID, err = getString(settings, "anonymous_shard_id", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.MaintenanceMode, err = getBool(settings, "maintenance_mode", false); err != nil {
+		return nil, err
+	}
+	if conf.MaintenanceShardID, err = getString(settings, "maintenance_shard_id", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.TenantIDPattern, err = getString(settings, "tenant_id_pattern", ""); err != nil {
+		return nil, err
+	}
+	if conf.TenantIDPattern != "" {
+		re, err := regexp.Compile(`^(?:` + conf.TenantIDPattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenant_id_pattern: %v", err)
+		}
+		conf.tenantIDPattern = re
+	}
+
+	if conf.TenantIDLowercase, err = getBool(settings, "tenant_id_lowercase", false); err != nil {
+		return nil, err
+	}
+
+	if conf.SkipPaths, err = getStringList(settings, "skip_paths", nil); err != nil {
+		return nil, err
+	}
+
+	if conf.TrustShardHeaderName, err = getString(settings, "trust_shard_header_name", ""); err != nil {
+		return nil, err
+	}
+	if conf.TrustShardHeaderValue, err = getString(settings, "trust_shard_header_value", ""); err != nil {
+		return nil, err
+	}
+
+	// Parse tenant extraction configuration. Every source has a default name so
+	// routes can switch the mode without repeating the rest.
+	if conf.TenantExtractionMode, err = getString(settings, "tenant_extraction_mode", TenantExtractionAuto); err != nil {
+		return nil, err
+	}
+	switch conf.TenantExtractionMode {
+	case TenantExtractionAuto, TenantExtractionHeader, TenantExtractionSubdomain,
+		TenantExtractionCookie, TenantExtractionPath, TenantExtractionQuery, TenantExtractionBody,
+		TenantExtractionMTLS, TenantExtractionCIDR:
+	default:
+		return nil, fmt.Errorf("invalid tenant_extraction_mode: %s", conf.TenantExtractionMode)
+	}
+
+	if conf.TenantHeaderName, err = getString(settings, "tenant_header_name", "X-Tenant-ID"); err != nil {
+		return nil, err
+	}
+
+	if conf.FallbackToSubdomain, err = getBool(settings, "fallback_to_subdomain", false); err != nil {
+		return nil, err
+	}
+
+	if conf.SubdomainLabelCount, err = getInt(settings, "subdomain_label_count", 1); err != nil {
+		return nil, err
+	}
+	if conf.SubdomainLabelCount < 1 {
+		return nil, errors.New("subdomain_label_count must be positive")
+	}
+
+	if conf.BaseDomain, err = getString(settings, "base_domain", ""); err != nil {
+		return nil, err
+	}
+	conf.BaseDomain = strings.ToLower(strings.Trim(conf.BaseDomain, "."))
+
+	if conf.TenantCookieName, err = getString(settings, "tenant_cookie_name", "tenant_id"); err != nil {
+		return nil, err
+	}
+	if conf.TenantCookieName == "" {
+		return nil, errors.New("tenant_cookie_name must not be empty")
+	}
+
+	if conf.TenantPathSegment, err = getInt(settings, "tenant_path_segment", 0); err != nil {
+		return nil, err
+	}
+	if conf.TenantPathSegment < 0 {
+		return nil, errors.New("tenant_path_segment must not be negative")
+	}
+
+	if conf.TenantQueryParam, err = getString(settings, "tenant_query_param", "tenant"); err != nil {
+		return nil, err
+	}
+	if conf.TenantQueryParam == "" {
+		return nil, errors.New("tenant_query_param must not be empty")
+	}
+
+	if conf.TenantSANSource, err = getString(settings, "tenant_san_source", TenantSANSourceConnection); err != nil {
+		return nil, err
+	}
+	if conf.TenantSANSource != TenantSANSourceConnection && conf.TenantSANSource != TenantSANSourceXFCC {
+		return nil, fmt.Errorf("invalid tenant_san_source: %s", conf.TenantSANSource)
+	}
+
+	if conf.TenantSANPattern, err = getString(settings, "tenant_san_pattern", `/tenant/([^/]+)$`); err != nil {
+		return nil, err
+	}
+	if conf.TenantSANPattern == "" {
+		return nil, errors.New("tenant_san_pattern must not be empty")
+	}
+	sanRe, err := regexp.Compile(conf.TenantSANPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_san_pattern: %v", err)
+	}
+	if sanRe.NumSubexp() != 1 {
+		return nil, errors.New("tenant_san_pattern must have exactly one capture group")
+	}
+	conf.tenantSANPattern = sanRe
+
+	if cidrRules, ok := settings["tenant_cidr_rules"]; ok {
+		rules, ok := cidrRules.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("tenant_cidr_rules must be a map of CIDR to tenant")
+		}
+		conf.TenantCIDRRules = make(map[string]string, len(rules))
+		for cidr, tenant := range rules {
+			str, ok := tenant.(string)
+			if !ok || str == "" {
+				return nil, fmt.Errorf("tenant_cidr_rules: tenant for %s must be a non-empty string", cidr)
+			}
+			conf.TenantCIDRRules[cidr] = str
+		}
+		compiled, err := parseCIDRRules(conf.TenantCIDRRules)
+		if err != nil {
+			return nil, fmt.Errorf("tenant_cidr_rules: %v", err)
+		}
+		conf.tenantCIDRs = compiled
+	}
+	if conf.TenantExtractionMode == TenantExtractionCIDR && len(conf.tenantCIDRs) == 0 {
+		return nil, errors.New("cidr tenant extraction requires tenant_cidr_rules")
+	}
+
+	if conf.TenantXFFTrustedHops, err = getInt(settings, "tenant_xff_trusted_hops", 0); err != nil {
+		return nil, err
+	}
+	if conf.TenantXFFTrustedHops < 0 {
+		return nil, errors.New("tenant_xff_trusted_hops must not be negative")
+	}
+
+	if conf.TenantBodyJSONPath, err = getString(settings, "tenant_body_json_path", "$.tenant_id"); err != nil {
+		return nil, err
+	}
+	steps, err := parseJSONPath(conf.TenantBodyJSONPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_body_json_path: %v", err)
+	}
+	conf.tenantBodyPath = steps
+
+	if conf.TenantBodyContentTypes, err = getStringList(settings, "tenant_body_content_types", []string{"application/json"}); err != nil {
+		return nil, err
+	}
+
+	if conf.MaxBodyBytes, err = getInt(settings, "max_body_bytes", 64*1024); err != nil {
+		return nil, err
+	}
+	if conf.MaxBodyBytes <= 0 {
+		return nil, errors.New("max_body_bytes must be positive")
+	}
+
+	if conf.EnvironmentHeaderName, err = getString(settings, "environment_header_name", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.EnvironmentHostLabel, err = getInt(settings, "environment_host_label", 0); err != nil {
+		return nil, err
+	}
+	if conf.EnvironmentHostLabel < 0 {
+		return nil, errors.New("environment_host_label must not be negative")
+	}
+
+	if conf.StickinessHeader, err = getString(settings, "stickiness_header", "X-Request-ID"); err != nil {
+		return nil, err
+	}
+	if conf.HashHeaders, err = getStringList(settings, "hash_headers", nil); err != nil {
+		return nil, err
+	}
+
+	// Parse admin configuration
+	if conf.AdminToken, err = getString(settings, "admin_token", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.AdminTokenHeaderName, err = getString(settings, "admin_token_header_name", "X-Shard-Router-Admin-Token"); err != nil {
+		return nil, err
+	}
+
+	if conf.ResolvePath, err = getString(settings, "resolve_path", ""); err != nil {
+		return nil, err
+	}
+	if conf.ResolvePath != "" && !strings.HasPrefix(conf.ResolvePath, "/") {
+		return nil, fmt.Errorf("resolve_path %q must start with /", conf.ResolvePath)
+	}
+
+	if conf.AllowShardOverrideHeader, err = getBool(settings, "allow_shard_override_header", false); err != nil {
+		return nil, err
+	}
+
+	if requestHeaders, ok := settings["request_headers"]; ok {
+		raw, ok := requestHeaders.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("request_headers must be a map of header name to lookup result")
+		}
+		headers, err := parseRequestHeaders(raw)
+		if err != nil {
+			return nil, fmt.Errorf("request_headers: %v", err)
+		}
+		conf.RequestHeaders = headers
+	}
+
+	if conf.ShardOverrideHeaderName, err = getString(settings, "shard_override_header_name", "X-Shard-Override"); err != nil {
+		return nil, err
+	}
+
+	if conf.ShardHintHeaderName, err = getString(settings, "shard_hint_header_name", ""); err != nil {
+		return nil, err
+	}
+
+	// Parse timeouts
+	if conf.RedisTimeout, err = getDuration(settings, "redis_timeout", 2*time.Second); err != nil {
+		return nil, err
+	}
+
+	if conf.S3Timeout, err = getDuration(settings, "s3_timeout", 5*time.Second); err != nil {
+		return nil, err
+	}
+
+	if conf.S3IndexCache, err = getBool(settings, "s3_index_cache", true); err != nil {
+		return nil, err
+	}
+
+	if conf.S3MaxRetries, err = getInt(settings, "s3_max_retries", 2); err != nil {
+		return nil, err
+	}
+	if conf.S3MaxRetries < 0 {
+		return nil, errors.New("s3_max_retries must not be negative")
+	}
+
+	if conf.MaxConcurrentS3Lookups, err = getInt(settings, "max_concurrent_s3_lookups", 0); err != nil {
+		return nil, err
+	}
+	if conf.MaxConcurrentS3Lookups < 0 {
+		return nil, errors.New("max_concurrent_s3_lookups must not be negative")
+	}
+
+	if conf.S3LookupQueueTimeout, err = getDuration(settings, "s3_lookup_queue_timeout", 50*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if conf.S3LookupQueueTimeout <= 0 {
+		return nil, errors.New("s3_lookup_queue_timeout must be positive")
+	}
+
+	if conf.LookupBudget, err = getDuration(settings, "lookup_budget", 0); err != nil {
+		return nil, err
+	}
+	if conf.LookupBudget < 0 {
+		return nil, errors.New("lookup_budget must not be negative")
+	}
+
+	if conf.S3RefreshInterval, err = getDuration(settings, "s3_refresh_interval", 0); err != nil {
+		return nil, err
+	}
+	if conf.S3RefreshInterval < 0 {
+		return nil, errors.New("s3_refresh_interval must not be negative")
+	}
+	if conf.S3RefreshInterval > 0 && conf.MappingBackend == MappingBackendS3ObjectPerTenant {
+		return nil, errors.New("s3_refresh_interval is not supported by the s3-object-per-tenant backend")
+	}
+
+	if conf.S3RefreshTimeout, err = getDuration(settings, "s3_refresh_timeout", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if conf.S3RefreshTimeout <= 0 {
+		return nil, errors.New("s3_refresh_timeout must be positive")
+	}
+
+	// Web identity (EKS IRSA) comes from the environment and, when present,
+	// is also what the cross-account role is assumed with. Per-route configs
+	// inherit the filter-level credentials through Merge, unless they name a
+	// role of their own.
+	if callbacks != nil || conf.S3RoleARN != "" {
+		webIdentity, err := webIdentityCredentials(conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.s3Credentials = webIdentity
+
+		if conf.S3RoleARN != "" {
+			creds, err := assumeS3Role(conf, webIdentity)
+			if err != nil {
+				return nil, err
+			}
+			conf.s3Credentials = creds
+		}
+	}
+
+	// Checked once per filter-level config, not on every route config load
+	if callbacks != nil && conf.hasBackend(MappingBackendS3) {
+		if err := verifyS3Access(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.RefreshJitter, err = getBool(settings, "refresh_jitter", true); err != nil {
+		return nil, err
+	}
+
+	if conf.WarmFromRedis, err = getBool(settings, "warm_from_redis", false); err != nil {
+		return nil, err
+	}
+	if conf.WarmFromRedis && conf.S3RefreshInterval == 0 {
+		return nil, errors.New("warm_from_redis requires s3_refresh_interval")
+	}
+	if conf.WarmFromRedis && !conf.EnableRedisCache {
+		return nil, errors.New("warm_from_redis requires enable_redis_cache")
+	}
+
+	if conf.KnownShards, err = getStringList(settings, "known_shards", nil); err != nil {
+		return nil, err
+	}
+	if conf.isSet("known_shards") {
+		conf.knownShards = make(map[string]struct{}, len(conf.KnownShards))
+		for _, shardID := range conf.KnownShards {
+			conf.knownShards[shardID] = struct{}{}
+		}
+		if len(conf.KnownShards) == 0 {
+			return nil, errors.New("known_shards must not be empty")
+		}
+		if conf.S3RefreshInterval == 0 {
+			return nil, errors.New("known_shards requires s3_refresh_interval")
+		}
+	}
+
+	if conf.MaxUnknownShardReferences, err = getInt(settings, "max_unknown_shard_references", -1); err != nil {
+		return nil, err
+	}
+	if conf.MaxUnknownShardReferences < -1 {
+		return nil, errors.New("max_unknown_shard_references must be -1 or more")
+	}
+	if conf.MaxUnknownShardReferences >= 0 && len(conf.KnownShards) == 0 {
+		return nil, errors.New("max_unknown_shard_references requires known_shards")
+	}
+
+	if conf.ChangeWebhookURL, err = getString(settings, "change_webhook_url", ""); err != nil {
+		return nil, err
+	}
+	if conf.ChangeWebhookURL != "" {
+		parsed, err := url.Parse(conf.ChangeWebhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, errors.New("change_webhook_url must be an http or https URL")
+		}
+		if conf.S3RefreshInterval == 0 {
+			return nil, errors.New("change_webhook_url requires s3_refresh_interval")
+		}
+	}
+
+	if conf.ChangeWebhookTimeout, err = getDuration(settings, "change_webhook_timeout", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if conf.ChangeWebhookTimeout <= 0 {
+		return nil, errors.New("change_webhook_timeout must be positive")
+	}
+
+	if conf.EnableRedisOverrides, err = getBool(settings, "enable_redis_overrides", false); err != nil {
+		return nil, err
+	}
+	if conf.EnableRedisOverrides && !conf.EnableRedisCache {
+		return nil, errors.New("enable_redis_overrides requires enable_redis_cache")
+	}
+
+	if conf.MappingOverlayPrefix, err = getString(settings, "mapping_overlay_prefix", ""); err != nil {
+		return nil, err
+	}
+	if conf.MappingOverlayPrefix != "" && !conf.EnableRedisCache {
+		return nil, errors.New("mapping_overlay_prefix requires enable_redis_cache")
+	}
+	// The overlay must not read the cache tier's own entries as its own
+	if conf.MappingOverlayPrefix != "" && conf.RedisStorageMode == RedisStorageString && conf.MappingOverlayPrefix == conf.RedisKeyPrefix {
+		return nil, errors.New("mapping_overlay_prefix must differ from redis_key_prefix")
+	}
+
+	if conf.MappingOverlayCacheTTL, err = getDuration(settings, "mapping_overlay_cache_ttl", time.Second); err != nil {
+		return nil, err
+	}
+	if conf.MappingOverlayCacheTTL < 0 {
+		return nil, errors.New("mapping_overlay_cache_ttl must not be negative")
+	}
+
+	if conf.UnhealthyShardsKey, err = getString(settings, "unhealthy_shards_key", ""); err != nil {
+		return nil, err
+	}
+	if conf.UnhealthyShardsKey != "" && !conf.EnableRedisCache {
+		return nil, errors.New("unhealthy_shards_key requires enable_redis_cache")
+	}
+
+	if conf.UnhealthyShardsRefreshInterval, err = getDuration(settings, "unhealthy_shards_refresh_interval", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if conf.UnhealthyShardsRefreshInterval <= 0 {
+		return nil, errors.New("unhealthy_shards_refresh_interval must be positive")
+	}
+
+	if conf.UnhealthyShardPolicy, err = getString(settings, "unhealthy_shard_policy", UnhealthyShardPolicyAlternate); err != nil {
+		return nil, err
+	}
+	switch conf.UnhealthyShardPolicy {
+	case UnhealthyShardPolicyFail, UnhealthyShardPolicyAlternate, UnhealthyShardPolicyFallback:
+	default:
+		return nil, fmt.Errorf("invalid unhealthy_shard_policy: %s", conf.UnhealthyShardPolicy)
+	}
+
+	if conf.UnhealthyFallbackShardID, err = getString(settings, "unhealthy_fallback_shard_id", ""); err != nil {
+		return nil, err
+	}
+	if conf.UnhealthyShardPolicy == UnhealthyShardPolicyFallback && conf.UnhealthyFallbackShardID == "" {
+		return nil, errors.New("unhealthy_shard_policy fallback requires unhealthy_fallback_shard_id")
+	}
+
+	if drainShards, ok := settings["drain_shards"]; ok {
+		shards, ok := drainShards.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("drain_shards must be a map of shard to percentage")
+		}
+		conf.DrainShards = make(map[string]int, len(shards))
+		for shardID, percent := range shards {
+			num, ok := percent.(float64)
+			if !ok || num < 0 || num > 100 || num != float64(int(num)) {
+				return nil, fmt.Errorf("drain_shards: percentage for %s must be a whole number from 0 to 100", shardID)
+			}
+			conf.DrainShards[shardID] = int(num)
+		}
+	}
+
+	if conf.DrainFallbackShardID, err = getString(settings, "drain_fallback_shard_id", ""); err != nil {
+		return nil, err
+	}
+	if conf.DrainShards[conf.DrainFallbackShardID] > 0 {
+		return nil, fmt.Errorf("drain_fallback_shard_id %s is itself in drain_shards", conf.DrainFallbackShardID)
+	}
+
+	// Parse failure handling configuration
+	if conf.FailureMode, err = getString(settings, "failure_mode", FailureModeOpen); err != nil {
+		return nil, err
+	}
+	if conf.FailureMode != FailureModeOpen && conf.FailureMode != FailureModeClosed {
+		return nil, fmt.Errorf("invalid failure_mode %q, must be %q or %q", conf.FailureMode, FailureModeOpen, FailureModeClosed)
+	}
+
+	if conf.BreakerFailureThreshold, err = getInt(settings, "breaker_failure_threshold", 5); err != nil {
+		return nil, err
+	}
+	if conf.BreakerFailureThreshold < 0 {
+		return nil, errors.New("breaker_failure_threshold must not be negative")
+	}
+
+	if conf.BreakerCooldown, err = getDuration(settings, "breaker_cooldown", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if conf.BreakerCooldown <= 0 {
+		return nil, errors.New("breaker_cooldown must be positive")
+	}
+
+	if conf.DryRun, err = getBool(settings, "dry_run", false); err != nil {
+		return nil, err
+	}
+
+	if conf.EmitTimingHeader, err = getBool(settings, "emit_timing_header", false); err != nil {
+		return nil, err
+	}
+
+	if conf.MappingVersionHeader, err = getString(settings, "mapping_version_header", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.ShardInTrailers, err = getBool(settings, "shard_in_trailers", false); err != nil {
+		return nil, err
+	}
+
+	if conf.EmitRouteMetadata, err = getBool(settings, "emit_route_metadata", false); err != nil {
+		return nil, err
+	}
+
+	if conf.ConnectionCacheTTL, err = getDuration(settings, "connection_cache_ttl", 0); err != nil {
+		return nil, err
+	}
+	if conf.ConnectionCacheTTL < 0 {
+		return nil, errors.New("connection_cache_ttl must not be negative")
+	}
+
+	if conf.ConnectionCacheSize, err = getInt(settings, "connection_cache_size", 10000); err != nil {
+		return nil, err
+	}
+	if conf.ConnectionCacheSize < 1 {
+		return nil, errors.New("connection_cache_size must be positive")
+	}
+	if conf.ConnectionCacheTTL > 0 {
+		if err := connectionCacheIneligible(conf); err != nil {
+			return nil, fmt.Errorf("connection_cache_ttl: %v", err)
+		}
+		cache, err := newConnectionCache(conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create connection cache: %v", err)
+		}
+		conf.connectionCache = cache
+	}
+
+	// Parse metrics configuration
+	if conf.LogLevel, err = getString(settings, "log_level", "debug"); err != nil {
+		return nil, err
+	}
+	conf.LogLevel = strings.ToLower(conf.LogLevel)
+	if level, ok := logLevels[conf.LogLevel]; ok {
+		conf.minLogLevel = level
+	} else {
+		return nil, fmt.Errorf("invalid log_level %q", conf.LogLevel)
+	}
+
+	if conf.DebugSampleRate, err = getFloat(settings, "debug_sample_rate", 0); err != nil {
+		return nil, err
+	}
+	if conf.DebugSampleRate < 0 || conf.DebugSampleRate > 1 {
+		return nil, errors.New("debug_sample_rate must be between 0 and 1")
+	}
+
+	if conf.MetricsAddr, err = getString(settings, "metrics_addr", ""); err != nil {
+		return nil, err
+	}
+
+	if conf.AdminSocketPath, err = getString(settings, "admin_socket_path", ""); err != nil {
+		return nil, err
+	}
+	if len(conf.AdminSocketPath) > maxUnixSocketPath {
+		return nil, fmt.Errorf("admin_socket_path must be at most %d bytes", maxUnixSocketPath)
+	}
+
+	if conf.HitRatioHalfLife, err = getDuration(settings, "hit_ratio_half_life", time.Minute); err != nil {
+		return nil, err
+	}
+	if conf.HitRatioHalfLife <= 0 {
+		return nil, errors.New("hit_ratio_half_life must be positive")
+	}
+
+	if conf.WarmupGracePeriod, err = getDuration(settings, "warmup_grace_period", 0); err != nil {
+		return nil, err
+	}
+	if conf.WarmupGracePeriod < 0 {
+		return nil, errors.New("warmup_grace_period must not be negative")
+	}
+
+	// A route config may give one of a pair of settings and inherit the
+	// other, so Merge checks the pairs once both sides are known
+	if callbacks != nil {
+		if err := checkSettingPairs(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	// Route configs are parsed without callbacks and never own the server
+	// or the shared state
+	if callbacks != nil && conf.MetricsAddr != "" {
+		acquireMetricsServer()
+		conf.holdsMetricsServer = true
+	}
+	if callbacks != nil {
+		acquireSharedState()
+		conf.holdsSharedState = true
+		adoptSharedSettings(conf)
+	}
+	if callbacks != nil && conf.MaintenanceShardID != "" {
+		acquireMaintenance(conf)
+		conf.holdsMaintenance = true
+	}
+	if callbacks != nil && conf.AdminSocketPath != "" {
+		acquireAdminSocket(conf)
+		conf.holdsAdminSocket = true
+	}
+	if callbacks != nil {
+		setHitRatioHalfLife(conf.HitRatioHalfLife)
+	}
+	if callbacks != nil && conf.WarmupGracePeriod > 0 {
+		beginWarmup(conf.WarmupGracePeriod)
+	}
+
+	return conf, nil
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// replaces ${ENV_VAR} references in every string value, including list items
+// and the values of nested maps, with the variable's value. References to unset variables are left as they
+// are and logged without the surrounding value, which may be a secret.
+func expandEnvValues(values map[string]interface{}) map[string]interface{} {
+	var expand func(key string, value interface{}) interface{}
+	expand = func(key string, value interface{}) interface{} {
+		switch v := value.(type) {
+		case string:
+			return envReference.ReplaceAllStringFunc(v, func(ref string) string {
+				name := envReference.FindStringSubmatch(ref)[1]
+				if env, ok := os.LookupEnv(name); ok {
+					return env
+				}
+				api.LogWarnf("Environment variable %s referenced by %s is not set, keeping the literal value", name, key)
+				return ref
+			})
+		case []interface{}:
+			for i, item := range v {
+				v[i] = expand(key, item)
+			}
+			return v
+		case map[string]interface{}:
+			for name, item := range v {
+				v[name] = expand(key+"."+name, item)
+			}
+			return v
+		default:
+			return value
+		}
+	}
+
+	for key, value := range values {
+		values[key] = expand(key, value)
+	}
+	return values
+}
+
+// Destroy is called by Envoy when the config is removed or replaced
+func (c *PluginConfig) Destroy() {
+	if c.holdsMetricsServer {
+		c.holdsMetricsServer = false
+		releaseMetricsServer()
+	}
+	if c.holdsAdminSocket {
+		c.holdsAdminSocket = false
+		releaseAdminSocket(c)
+	}
+	if c.holdsMaintenance {
+		c.holdsMaintenance = false
+		releaseMaintenance(c)
+	}
+	if c.holdsSharedState {
+		c.holdsSharedState = false
+		releaseSharedState()
+	}
+}
+
+// returns a copy of c that doesn't hold c's share of the process-wide state,
+// so destroying it releases nothing
+func (c *PluginConfig) unownedCopy() PluginConfig {
+	copied := *c
+	copied.holdsMetricsServer = false
+	copied.holdsSharedState = false
+	copied.holdsAdminSocket = false
+	copied.holdsMaintenance = false
+	return copied
+}
+
+// checks settings that require another one, on the filter-level config and
+// on each merged config
+func checkSettingPairs(conf *PluginConfig) error {
+	if conf.MaintenanceMode && conf.MaintenanceShardID == "" {
+		return errors.New("maintenance_mode requires maintenance_shard_id")
+	}
+	if conf.AllowShardOverrideHeader && conf.AdminToken == "" {
+		return errors.New("allow_shard_override_header requires admin_token")
+	}
+	if conf.ResolvePath != "" && conf.AdminToken == "" {
+		return errors.New("resolve_path requires admin_token")
+	}
+	if conf.isSet("trust_shard_header_value") && conf.TrustShardHeaderName == "" {
+		return errors.New("trust_shard_header_value requires trust_shard_header_name")
+	}
+	if conf.RedisUsername != "" && conf.RedisPassword == "" {
+		return errors.New("redis_username requires redis_password")
+	}
+	return nil
+}
+
+// Merge configuration from the inherited parent configuration
+// This is needed by Envoy to allow for configuration inheritance
+func (p *parser) Merge(parent any, child any) any {
+	parentConfig := parent.(*PluginConfig)
+	childConfig := child.(*PluginConfig)
+
+	// copy one, do not update parentConfig directly.
+	newConfig := parentConfig.unownedCopy()
+	newConfig.parseSeq = max(parentConfig.parseSeq, childConfig.parseSeq)
+
+	// The merged config may itself be merged again, so it has every field
+	// that either side set
+	newConfig.set = make(map[string]bool, len(parentConfig.set)+len(childConfig.set))
+	for key := range parentConfig.set {
+		newConfig.set[key] = true
+	}
+	for key := range childConfig.set {
+		newConfig.set[key] = true
+	}
+
+	// Override with child configuration values that were explicitly set,
+	// so zero values like redis_db: 0 are honored and defaults filled in
+	// by Parse never clobber the parent
+	if childConfig.isSet("s3_key_template") {
+		newConfig.S3KeyTemplate = childConfig.S3KeyTemplate
+	}
+	if childConfig.isSet("mapping_backend") || childConfig.isSet("mapping_backends") {
+		newConfig.MappingBackend = childConfig.MappingBackend
+		newConfig.MappingBackends = childConfig.MappingBackends
+	}
+	if childConfig.isSet("mapping_file_path") {
+		newConfig.MappingFilePath = childConfig.MappingFilePath
+	}
+	if childConfig.isSet("s3_bucket") {
+		newConfig.S3Bucket = childConfig.S3Bucket
+	}
+	if childConfig.isSet("s3_key") {
+		newConfig.S3Key = childConfig.S3Key
+	}
+	if childConfig.isSet("s3_keys") {
+		newConfig.S3Keys = childConfig.S3Keys
+	}
+	if childConfig.isSet("s3_version_id") {
+		newConfig.S3VersionID = childConfig.S3VersionID
+	}
+	if childConfig.isSet("s3_sse_customer_key") {
+		newConfig.S3SSECustomerKey = childConfig.S3SSECustomerKey
+		newConfig.sseCustomerKey = childConfig.sseCustomerKey
+		newConfig.sseCustomerKeyMD5 = childConfig.sseCustomerKeyMD5
+	}
+	if childConfig.isSet("s3_sse_customer_algorithm") {
+		newConfig.S3SSECustomerAlgorithm = childConfig.S3SSECustomerAlgorithm
+	}
+	if childConfig.isSet("s3_region") {
+		newConfig.S3Region = childConfig.S3Region
+	}
+	if childConfig.isSet("s3_endpoint") {
+		newConfig.S3Endpoint = childConfig.S3Endpoint
+	}
+	if childConfig.isSet("s3_service_endpoints") {
+		newConfig.S3ServiceEndpoints = childConfig.S3ServiceEndpoints
+	}
+	if childConfig.isSet("s3_path_style") {
+		newConfig.S3PathStyle = childConfig.S3PathStyle
+	} else if childConfig.isSet("s3_endpoint") || childConfig.isSet("s3_service_endpoints") {
+		newConfig.S3PathStyle = defaultS3PathStyle(&newConfig)
+	}
+	if childConfig.isSet("s3_signing_region") {
+		newConfig.S3SigningRegion = childConfig.S3SigningRegion
+	}
+	if childConfig.isSet("s3_format") {
+		newConfig.S3Format = childConfig.S3Format
+	}
+	if childConfig.isSet("ndjson_max_line_bytes") {
+		newConfig.NDJSONMaxLineBytes = childConfig.NDJSONMaxLineBytes
+	}
+	if childConfig.isSet("max_mapping_bytes") {
+		newConfig.MaxMappingBytes = childConfig.MaxMappingBytes
+	}
+	if childConfig.isSet("s3_role_arn") {
+		newConfig.S3RoleARN = childConfig.S3RoleARN
+		newConfig.S3ExternalID = childConfig.S3ExternalID
+		newConfig.s3Credentials = childConfig.s3Credentials
+	}
+	if childConfig.isSet("enable_memory_cache") {
+		newConfig.EnableMemoryCache = childConfig.EnableMemoryCache
+	}
+	if childConfig.isSet("enable_redis_cache") {
+		newConfig.EnableRedisCache = childConfig.EnableRedisCache
+	}
+	if childConfig.isSet("redis_network") {
+		newConfig.RedisNetwork = childConfig.RedisNetwork
+	}
+	if childConfig.isSet("redis_addr") {
+		newConfig.RedisAddr = childConfig.RedisAddr
+	}
+	if childConfig.isSet("redis_replica_addrs") {
+		newConfig.RedisReplicaAddrs = childConfig.RedisReplicaAddrs
+	}
+	if childConfig.isSet("redis_username") {
+		newConfig.RedisUsername = childConfig.RedisUsername
+	}
+	if childConfig.isSet("redis_password") {
+		newConfig.RedisPassword = childConfig.RedisPassword
+	}
+	if childConfig.isSet("redis_db") {
+		newConfig.RedisDB = childConfig.RedisDB
+	}
+	if childConfig.isSet("redis_key_prefix") {
+		newConfig.RedisKeyPrefix = childConfig.RedisKeyPrefix
+	}
+	if childConfig.isSet("redis_fallback_key_prefix") {
+		newConfig.RedisFallbackKeyPrefix = childConfig.RedisFallbackKeyPrefix
+	}
+	if childConfig.isSet("redis_storage_mode") {
+		newConfig.RedisStorageMode = childConfig.RedisStorageMode
+	}
+	if childConfig.isSet("redis_hash_key") {
+		newConfig.RedisHashKey = childConfig.RedisHashKey
+	}
+	if childConfig.isSet("redis_value_codec") {
+		newConfig.RedisValueCodec = childConfig.RedisValueCodec
+	}
+	if childConfig.isSet("redis_pool_size") {
+		newConfig.RedisPoolSize = childConfig.RedisPoolSize
+	}
+	if childConfig.isSet("redis_min_idle_conns") {
+		newConfig.RedisMinIdleConns = childConfig.RedisMinIdleConns
+	}
+	if childConfig.isSet("redis_max_retries") {
+		newConfig.RedisMaxRetries = childConfig.RedisMaxRetries
+	}
+	if childConfig.isSet("redis_dial_timeout") {
+		newConfig.RedisDialTimeout = childConfig.RedisDialTimeout
+	}
+	if childConfig.isSet("redis_write_behind") {
+		newConfig.RedisWriteBehind = childConfig.RedisWriteBehind
+	}
+	if childConfig.isSet("redis_write_behind_buffer_size") {
+		newConfig.RedisWriteBehindBufferSize = childConfig.RedisWriteBehindBufferSize
+	}
+	if childConfig.isSet("redis_batch_size") {
+		newConfig.RedisBatchSize = childConfig.RedisBatchSize
+	}
+	if childConfig.isSet("memory_cache_size") {
+		newConfig.MemoryCacheSize = childConfig.MemoryCacheSize
+	}
+	if childConfig.isSet("memory_cache_eviction") {
+		newConfig.MemoryCacheEviction = childConfig.MemoryCacheEviction
+	}
+	if childConfig.isSet("shared_memory_cache") {
+		newConfig.SharedMemoryCache = childConfig.SharedMemoryCache
+	}
+	if childConfig.isSet("memory_cache_ttl_from_s3") {
+		newConfig.MemoryCacheTTLFromS3 = childConfig.MemoryCacheTTLFromS3
+	}
+	if childConfig.isSet("memory_cache_ttl_from_redis") {
+		newConfig.MemoryCacheTTLFromRedis = childConfig.MemoryCacheTTLFromRedis
+	}
+	if childConfig.isSet("stale_while_revalidate") {
+		newConfig.StaleWhileRevalidate = childConfig.StaleWhileRevalidate
+	}
+	if childConfig.isSet("stale_max_age") {
+		newConfig.StaleMaxAge = childConfig.StaleMaxAge
+	}
+	if childConfig.isSet("serve_last_known_good_on_outage") {
+		newConfig.ServeLastKnownGoodOnOutage = childConfig.ServeLastKnownGoodOnOutage
+	}
+	// A route's redis_ttl also decides RedisNoExpiry, unless that is given too
+	if childConfig.isSet("redis_ttl") {
+		newConfig.RedisTTL = childConfig.RedisTTL
+		newConfig.RedisNoExpiry = childConfig.RedisNoExpiry
+	}
+	if childConfig.isSet("redis_no_expiry") {
+		newConfig.RedisNoExpiry = childConfig.RedisNoExpiry
+	}
+	if childConfig.isSet("cache_key_hash") {
+		newConfig.CacheKeyHash = childConfig.CacheKeyHash
+	}
+	if childConfig.isSet("sanitize_redis_keys") {
+		newConfig.SanitizeRedisKeys = childConfig.SanitizeRedisKeys
+	}
+	if childConfig.isSet("max_redis_key_length") {
+		newConfig.MaxRedisKeyLength = childConfig.MaxRedisKeyLength
+	}
+	if childConfig.isSet("redis_long_key_policy") {
+		newConfig.RedisLongKeyPolicy = childConfig.RedisLongKeyPolicy
+	}
+	if childConfig.isSet("anonymous_shard_id") {
+		newConfig.AnonymousShardID = childConfig.AnonymousShardID
+	}
+	if childConfig.isSet("maintenance_mode") {
+		newConfig.MaintenanceMode = childConfig.MaintenanceMode
+	}
+	if childConfig.isSet("maintenance_shard_id") {
+		newConfig.MaintenanceShardID = childConfig.MaintenanceShardID
+	}
+	if childConfig.isSet("tenant_id_pattern") {
+		newConfig.TenantIDPattern = childConfig.TenantIDPattern
+		newConfig.tenantIDPattern = childConfig.tenantIDPattern
+	}
+	if childConfig.isSet("tenant_id_lowercase") {
+		newConfig.TenantIDLowercase = childConfig.TenantIDLowercase
+	}
+	if childConfig.isSet("skip_paths") {
+		newConfig.SkipPaths = childConfig.SkipPaths
+	}
+	if childConfig.isSet("trust_shard_header_name") {
+		newConfig.TrustShardHeaderName = childConfig.TrustShardHeaderName
+	}
+	if childConfig.isSet("trust_shard_header_value") {
+		newConfig.TrustShardHeaderValue = childConfig.TrustShardHeaderValue
+	}
+	// Extraction fields are independent, a route may override any subset
+	if childConfig.isSet("tenant_extraction_mode") {
+		newConfig.TenantExtractionMode = childConfig.TenantExtractionMode
+	}
+	if childConfig.isSet("tenant_header_name") {
+		newConfig.TenantHeaderName = childConfig.TenantHeaderName
+	}
+	if childConfig.isSet("fallback_to_subdomain") {
+		newConfig.FallbackToSubdomain = childConfig.FallbackToSubdomain
+	}
+	if childConfig.isSet("subdomain_label_count") {
+		newConfig.SubdomainLabelCount = childConfig.SubdomainLabelCount
+	}
+	if childConfig.isSet("base_domain") {
+		newConfig.BaseDomain = childConfig.BaseDomain
+	}
+	if childConfig.isSet("tenant_cookie_name") {
+		newConfig.TenantCookieName = childConfig.TenantCookieName
+	}
+	if childConfig.isSet("tenant_path_segment") {
+		newConfig.TenantPathSegment = childConfig.TenantPathSegment
+	}
+	if childConfig.isSet("tenant_query_param") {
+		newConfig.TenantQueryParam = childConfig.TenantQueryParam
+	}
+	if childConfig.isSet("tenant_san_source") {
+		newConfig.TenantSANSource = childConfig.TenantSANSource
+	}
+	if childConfig.isSet("tenant_san_pattern") {
+		newConfig.TenantSANPattern = childConfig.TenantSANPattern
+		newConfig.tenantSANPattern = childConfig.tenantSANPattern
+	}
+	if childConfig.isSet("tenant_cidr_rules") {
+		newConfig.TenantCIDRRules = childConfig.TenantCIDRRules
+		newConfig.tenantCIDRs = childConfig.tenantCIDRs
+	}
+	if childConfig.isSet("tenant_xff_trusted_hops") {
+		newConfig.TenantXFFTrustedHops = childConfig.TenantXFFTrustedHops
+	}
+	if childConfig.isSet("tenant_body_json_path") {
+		newConfig.TenantBodyJSONPath = childConfig.TenantBodyJSONPath
+		newConfig.tenantBodyPath = childConfig.tenantBodyPath
+	}
+	if childConfig.isSet("tenant_body_content_types") {
+		newConfig.TenantBodyContentTypes = childConfig.TenantBodyContentTypes
+	}
+	if childConfig.isSet("max_body_bytes") {
+		newConfig.MaxBodyBytes = childConfig.MaxBodyBytes
+	}
+	if childConfig.isSet("environment_header_name") {
+		newConfig.EnvironmentHeaderName = childConfig.EnvironmentHeaderName
+	}
+	if childConfig.isSet("environment_host_label") {
+		newConfig.EnvironmentHostLabel = childConfig.EnvironmentHostLabel
+	}
+	if childConfig.isSet("stickiness_header") {
+		newConfig.StickinessHeader = childConfig.StickinessHeader
+	}
+	if childConfig.isSet("hash_headers") {
+		newConfig.HashHeaders = childConfig.HashHeaders
+	}
+	if childConfig.isSet("admin_token") {
+		newConfig.AdminToken = childConfig.AdminToken
+	}
+	if childConfig.isSet("admin_token_header_name") {
+		newConfig.AdminTokenHeaderName = childConfig.AdminTokenHeaderName
+	}
+	if childConfig.isSet("resolve_path") {
+		newConfig.ResolvePath = childConfig.ResolvePath
+	}
+	if childConfig.isSet("allow_shard_override_header") {
+		newConfig.AllowShardOverrideHeader = childConfig.AllowShardOverrideHeader
+	}
+	if childConfig.isSet("request_headers") {
+		newConfig.RequestHeaders = childConfig.RequestHeaders
+	}
+	if childConfig.isSet("shard_override_header_name") {
+		newConfig.ShardOverrideHeaderName = childConfig.ShardOverrideHeaderName
+	}
+	if childConfig.isSet("shard_hint_header_name") {
+		newConfig.ShardHintHeaderName = childConfig.ShardHintHeaderName
+	}
+	if childConfig.isSet("redis_timeout") {
 		newConfig.RedisTimeout = childConfig.RedisTimeout
 	}
-	if childConfig.S3Timeout != 0 {
+	if childConfig.isSet("s3_timeout") {
 		newConfig.S3Timeout = childConfig.S3Timeout
 	}
+	if childConfig.isSet("s3_index_cache") {
+		newConfig.S3IndexCache = childConfig.S3IndexCache
+	}
+	if childConfig.isSet("s3_max_retries") {
+		newConfig.S3MaxRetries = childConfig.S3MaxRetries
+	}
+	if childConfig.isSet("max_concurrent_s3_lookups") {
+		newConfig.MaxConcurrentS3Lookups = childConfig.MaxConcurrentS3Lookups
+	}
+	if childConfig.isSet("s3_lookup_queue_timeout") {
+		newConfig.S3LookupQueueTimeout = childConfig.S3LookupQueueTimeout
+	}
+	if childConfig.isSet("lookup_budget") {
+		newConfig.LookupBudget = childConfig.LookupBudget
+	}
+	if childConfig.isSet("s3_refresh_interval") {
+		newConfig.S3RefreshInterval = childConfig.S3RefreshInterval
+	}
+	if childConfig.isSet("s3_refresh_timeout") {
+		newConfig.S3RefreshTimeout = childConfig.S3RefreshTimeout
+	}
+	if childConfig.isSet("refresh_jitter") {
+		newConfig.RefreshJitter = childConfig.RefreshJitter
+	}
+	if childConfig.isSet("warm_from_redis") {
+		newConfig.WarmFromRedis = childConfig.WarmFromRedis
+	}
+	if childConfig.isSet("known_shards") {
+		newConfig.KnownShards = childConfig.KnownShards
+		newConfig.knownShards = childConfig.knownShards
+	}
+	if childConfig.isSet("max_unknown_shard_references") {
+		newConfig.MaxUnknownShardReferences = childConfig.MaxUnknownShardReferences
+	}
+	if childConfig.isSet("change_webhook_url") {
+		newConfig.ChangeWebhookURL = childConfig.ChangeWebhookURL
+	}
+	if childConfig.isSet("change_webhook_timeout") {
+		newConfig.ChangeWebhookTimeout = childConfig.ChangeWebhookTimeout
+	}
+	if childConfig.isSet("enable_redis_overrides") {
+		newConfig.EnableRedisOverrides = childConfig.EnableRedisOverrides
+	}
+	if childConfig.isSet("mapping_overlay_prefix") {
+		newConfig.MappingOverlayPrefix = childConfig.MappingOverlayPrefix
+	}
+	if childConfig.isSet("mapping_overlay_cache_ttl") {
+		newConfig.MappingOverlayCacheTTL = childConfig.MappingOverlayCacheTTL
+	}
+	if childConfig.isSet("unhealthy_shards_key") {
+		newConfig.UnhealthyShardsKey = childConfig.UnhealthyShardsKey
+	}
+	if childConfig.isSet("unhealthy_shards_refresh_interval") {
+		newConfig.UnhealthyShardsRefreshInterval = childConfig.UnhealthyShardsRefreshInterval
+	}
+	if childConfig.isSet("unhealthy_shard_policy") {
+		newConfig.UnhealthyShardPolicy = childConfig.UnhealthyShardPolicy
+	}
+	if childConfig.isSet("unhealthy_fallback_shard_id") {
+		newConfig.UnhealthyFallbackShardID = childConfig.UnhealthyFallbackShardID
+	}
+	if childConfig.isSet("drain_shards") {
+		newConfig.DrainShards = childConfig.DrainShards
+	}
+	if childConfig.isSet("drain_fallback_shard_id") {
+		newConfig.DrainFallbackShardID = childConfig.DrainFallbackShardID
+	}
+	if childConfig.isSet("failure_mode") {
+		newConfig.FailureMode = childConfig.FailureMode
+	}
+	if childConfig.isSet("breaker_failure_threshold") {
+		newConfig.BreakerFailureThreshold = childConfig.BreakerFailureThreshold
+	}
+	if childConfig.isSet("breaker_cooldown") {
+		newConfig.BreakerCooldown = childConfig.BreakerCooldown
+	}
+	if childConfig.isSet("dry_run") {
+		newConfig.DryRun = childConfig.DryRun
+	}
+	if childConfig.isSet("emit_timing_header") {
+		newConfig.EmitTimingHeader = childConfig.EmitTimingHeader
+	}
+	if childConfig.isSet("mapping_version_header") {
+		newConfig.MappingVersionHeader = childConfig.MappingVersionHeader
+	}
+	if childConfig.isSet("shard_in_trailers") {
+		newConfig.ShardInTrailers = childConfig.ShardInTrailers
+	}
+	if childConfig.isSet("emit_route_metadata") {
+		newConfig.EmitRouteMetadata = childConfig.EmitRouteMetadata
+	}
+	if childConfig.isSet("log_level") {
+		newConfig.LogLevel = childConfig.LogLevel
+		newConfig.minLogLevel = childConfig.minLogLevel
+	}
+	if childConfig.isSet("debug_sample_rate") {
+		newConfig.DebugSampleRate = childConfig.DebugSampleRate
+	}
+	if childConfig.isSet("metrics_addr") {
+		newConfig.MetricsAddr = childConfig.MetricsAddr
+	}
+	if childConfig.isSet("admin_socket_path") {
+		newConfig.AdminSocketPath = childConfig.AdminSocketPath
+	}
+	if childConfig.isSet("connection_cache_ttl") {
+		newConfig.ConnectionCacheTTL = childConfig.ConnectionCacheTTL
+	}
+	if childConfig.isSet("connection_cache_size") {
+		newConfig.ConnectionCacheSize = childConfig.ConnectionCacheSize
+	}
+
+	// Parse would have rejected the route config with these settings, so the
+	// route runs with the parent's
+	if err := checkSettingPairs(&newConfig); err != nil {
+		api.LogErrorf("Ignoring route config: %v", err)
+		fallback := parentConfig.unownedCopy()
+		return &fallback
+	}
+
+	// The route may resolve tenants differently, so it never shares the
+	// parent's entries, and may have made them depend on the request
+	newConfig.connectionCache = nil
+	if newConfig.ConnectionCacheTTL > 0 {
+		if err := connectionCacheIneligible(&newConfig); err != nil {
+			api.LogWarnf("Connection cache disabled for route: %v", err)
+		} else if cache, err := newConnectionCache(&newConfig); err == nil {
+			newConfig.connectionCache = cache
+		}
+	}
 
 	return &newConfig
 }
@@ -285,41 +2215,327 @@ func filterFactory(c any, callbacks api.FilterCallbackHandler) api.StreamFilter
 		panic("unexpected config type")
 	}
 
+	ensureMetricsServer(conf.MetricsAddr)
+
+	// Report the effective, possibly merged, configuration of this filter
+	if api.GetLogLevel() <= api.Debug {
+		api.LogDebugf("Shard router effective config: %s", conf.RedactedSummary())
+	}
+
 	// Initialize memory cache
-	memoryCache, err := lru.New[string, string](conf.MemoryCacheSize)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create memory cache: %v", err))
+	var memoryCache memoryCacheStore
+	var err error
+	if conf.EnableMemoryCache {
+		if conf.SharedMemoryCache {
+			memoryCache, err = sharedMemoryCache(conf)
+		} else {
+			memoryCache, err = newMemoryCache(conf)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("failed to create memory cache: %v", err))
+		}
 	}
 
-	// Initialize Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     conf.RedisAddr,
-		Password: conf.RedisPassword,
-		DB:       conf.RedisDB,
-	})
+	// Initialize Redis clients, lookups read from the next replica in turn
+	// Declared as interfaces and only assigned when enabled, nil otherwise
+	var redisClient, redisReader redis.Cmdable
+	var redisBreaker, redisReaderBreaker *circuitBreaker
+	if conf.EnableRedisCache {
+		redisClient = sharedRedisClient(conf, conf.RedisAddr)
+		redisBreaker = breakerFor(redisBreakerName(conf.RedisAddr), conf)
+		redisReader, redisReaderBreaker = redisClient, redisBreaker
+		if len(conf.RedisReplicaAddrs) > 0 {
+			addr := conf.RedisReplicaAddrs[nextReplica.Add(1)%uint64(len(conf.RedisReplicaAddrs))]
+			redisReader = sharedRedisClient(conf, addr)
+			redisReaderBreaker = breakerFor(redisBreakerName(addr), conf)
+		}
+	}
+	var writeBehind *redisWriteBehind
+	if conf.EnableRedisCache && conf.RedisWriteBehind {
+		writeBehind = ensureRedisWriteBehind(conf)
+	}
 
 	// Initialize S3 client
-	awsConfig := &aws.Config{
-		Region: aws.String(conf.S3Region),
+	var s3Client s3Getter
+	var s3Breaker *circuitBreaker
+	var s3Limiter *s3Limiter
+	if conf.usesS3() {
+		s3Client, err = sharedS3Client(conf)
+		if err != nil {
+			panic(err.Error())
+		}
+		s3Breaker = breakerFor(backendSourceID(conf, conf.s3Backend()), conf)
+		s3Limiter = s3LimiterFor(backendSourceID(conf, conf.s3Backend()), conf)
 	}
 
-	// Configure custom endpoint for Minio compatibility
-	if conf.S3Endpoint != "" {
-		awsConfig.Endpoint = aws.String(conf.S3Endpoint)
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	var unhealthyShards *unhealthyShardWatcher
+	if conf.EnableRedisCache && conf.UnhealthyShardsKey != "" {
+		unhealthyShards = ensureUnhealthyShardWatcher(conf)
 	}
 
-	sess, err := session.NewSession(awsConfig)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create AWS session: %v", err))
+	// Shared snapshot of the complete mapping, when refresh is enabled
+	var refresher *mappingRefresher
+	if conf.S3RefreshInterval > 0 {
+		refresher, err = ensureMappingRefresher(conf)
+		if err != nil {
+			panic(err.Error())
+		}
 	}
-	s3Client := s3.New(sess)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &ShardRouterFilter{
+		ctx:         ctx,
+		cancel:      cancel,
 		callbacks:   callbacks,
 		config:      conf,
 		memoryCache: memoryCache,
 		redisClient: redisClient,
+		redisReader: redisReader,
+		writeBehind: writeBehind,
 		s3Client:    s3Client,
+		refresher:   refresher,
+
+		redisBreaker:       redisBreaker,
+		redisReaderBreaker: redisReaderBreaker,
+		s3Breaker:          s3Breaker,
+		s3Limiter:          s3Limiter,
+		unhealthyShards:    unhealthyShards,
+	}
+}
+
+// Filters are created per stream, so replicas are rotated process-wide
+var nextReplica atomic.Uint64
+
+// Numbers configs in the order Parse sees them
+var parseSeq atomic.Uint64
+
+// builds a Redis client for addr from the connection and pool settings
+func newRedisClient(conf *PluginConfig, addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Network:      conf.RedisNetwork,
+		Addr:         addr,
+		Username:     conf.RedisUsername,
+		Password:     conf.RedisPassword,
+		DB:           conf.RedisDB,
+		PoolSize:     conf.RedisPoolSize,
+		MinIdleConns: conf.RedisMinIdleConns,
+		MaxRetries:   conf.RedisMaxRetries,
+		DialTimeout:  conf.RedisDialTimeout,
+	})
+}
+
+// builds the S3 client, using web identity or assumed-role credentials when configured
+func newS3Client(conf *PluginConfig) (*s3.S3, error) {
+	sess, err := newAWSSession(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s3Config := &aws.Config{}
+
+	// Configure custom endpoint for Minio compatibility
+	if conf.S3Endpoint != "" {
+		s3Config.Endpoint = aws.String(conf.S3Endpoint)
+	}
+	s3Config.S3ForcePathStyle = aws.Bool(conf.S3PathStyle)
+
+	// Otherwise the default credential chain is used
+	if conf.s3Credentials != nil {
+		s3Config.Credentials = conf.s3Credentials
+	}
+
+	return s3.New(sess, s3Config), nil
+}
+
+// creates web identity credentials from AWS_ROLE_ARN and
+// AWS_WEB_IDENTITY_TOKEN_FILE, as projected into EKS pods by IRSA, and
+// verifies them with the initial AssumeRoleWithWebIdentity call. Returns nil
+// when the environment doesn't configure web identity. The credentials are
+// shared by every config, only the first one verifies them.
+func webIdentityCredentials(conf *PluginConfig) (*credentials.Credentials, error) {
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return nil, nil
+	}
+
+	// The SDK generates a session name when AWS_ROLE_SESSION_NAME is unset
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	key := awsCredentialsKey{
+		roleARN:     roleARN,
+		tokenFile:   tokenFile,
+		sessionName: sessionName,
+		region:      conf.S3Region,
+		services:    fmt.Sprint(conf.S3ServiceEndpoints, conf.S3SigningRegion),
 	}
+	return sharedAWSCredentials(key, func() (*credentials.Credentials, error) {
+		return newWebIdentityCredentials(conf, roleARN, tokenFile, sessionName)
+	})
+}
+
+func newWebIdentityCredentials(conf *PluginConfig, roleARN, tokenFile, sessionName string) (*credentials.Credentials, error) {
+	sess, err := newAWSSession(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := stscreds.NewWebIdentityCredentials(sess, roleARN, sessionName, tokenFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.S3Timeout)
+	defer cancel()
+
+	if _, err := creds.GetWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to assume role %s with web identity token %s: %v", roleARN, tokenFile, err)
+	}
+
+	api.LogInfof("Using web identity credentials for role %s", roleARN)
+	return creds, nil
+}
+
+// creates assume-role credentials for S3RoleARN and verifies them by
+// performing the initial AssumeRole call. The role is assumed with base, or
+// the default credential chain when base is nil. Like web identity, the
+// credentials are shared by every config assuming the same role.
+func assumeS3Role(conf *PluginConfig, base *credentials.Credentials) (*credentials.Credentials, error) {
+	key := awsCredentialsKey{
+		roleARN:    conf.S3RoleARN,
+		externalID: conf.S3ExternalID,
+		region:     conf.S3Region,
+		services:   fmt.Sprint(conf.S3ServiceEndpoints, conf.S3SigningRegion),
+		base:       base,
+	}
+	return sharedAWSCredentials(key, func() (*credentials.Credentials, error) {
+		return newAssumedRoleCredentials(conf, base)
+	})
+}
+
+func newAssumedRoleCredentials(conf *PluginConfig, base *credentials.Credentials) (*credentials.Credentials, error) {
+	sess, err := newAWSSession(conf, base)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := stscreds.NewCredentials(sess, conf.S3RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if conf.S3ExternalID != "" {
+			p.ExternalID = aws.String(conf.S3ExternalID)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.S3Timeout)
+	defer cancel()
+
+	if _, err := creds.GetWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to assume role %s: %v", conf.S3RoleARN, err)
+	}
+
+	api.LogInfof("Assumed role %s for S3 access", conf.S3RoleARN)
+	return creds, nil
+}
+
+// creates a session in the configured region, using creds when given and
+// the default credential chain otherwise
+func newAWSSession(conf *PluginConfig, creds *credentials.Credentials) (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(conf.S3Region),
+	}
+	if creds != nil {
+		awsConfig.Credentials = creds
+	}
+	if len(conf.S3ServiceEndpoints) > 0 {
+		awsConfig.EndpointResolver = serviceEndpointResolver(conf)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return sess, nil
+}
+
+// reports whether buckets are path-style without s3_path_style: only with a
+// custom S3 endpoint, as before the option existed
+func defaultS3PathStyle(conf *PluginConfig) bool {
+	_, customS3 := conf.S3ServiceEndpoints[endpoints.S3ServiceID]
+	return conf.S3Endpoint != "" || customS3
+}
+
+// resolves the services in S3ServiceEndpoints to their configured URL and
+// everything else as the SDK would. STS is resolved here too, so assumed
+// roles can be fetched from the store's own token service.
+func serviceEndpointResolver(conf *PluginConfig) endpoints.Resolver {
+	signingRegion := conf.S3SigningRegion
+	if signingRegion == "" {
+		signingRegion = conf.S3Region
+	}
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if endpoint, ok := conf.S3ServiceEndpoints[service]; ok {
+			return endpoints.ResolvedEndpoint{
+				URL:           endpoint,
+				SigningRegion: signingRegion,
+				SigningMethod: "v4",
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
+
+// S3 error codes caused by the credentials rather than the object or network
+var s3CredentialErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"Forbidden":             true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+	"NoCredentialProviders": true,
+}
+
+// checks with HeadObject that every mapping object is readable, so credential
+// problems reject the config at boot instead of failing the first lookup.
+// Anything else, such as an object not being uploaded yet or S3 being
+// unreachable, is only logged since lookups may still succeed later.
+func verifyS3Access(conf *PluginConfig) error {
+	client, err := sharedS3Client(conf)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range s3MappingKeys(conf) {
+		if err := verifyS3Object(client, conf, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyS3Object(client *s3.S3, conf *PluginConfig, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.S3Timeout)
+	defer cancel()
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(conf.S3Bucket),
+		Key:    aws.String(key),
+	}
+	if conf.S3VersionID != "" {
+		input.VersionId = aws.String(conf.S3VersionID)
+	}
+	if conf.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(conf.S3SSECustomerAlgorithm)
+		input.SSECustomerKey = aws.String(conf.sseCustomerKey)
+		input.SSECustomerKeyMD5 = aws.String(conf.sseCustomerKeyMD5)
+	}
+	_, err := client.HeadObjectWithContext(ctx, input)
+	if err == nil {
+		api.LogInfof("Verified access to s3://%s/%s", conf.S3Bucket, key)
+		return nil
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && s3CredentialErrorCodes[awsErr.Code()] {
+		return fmt.Errorf("no access to s3://%s/%s: %v", conf.S3Bucket, key, err)
+	}
+
+	api.LogWarnf("Unable to verify access to s3://%s/%s: %v", conf.S3Bucket, key, err)
+	return nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeExtractionOverrides(t *testing.T) {
+	parent := parseTestConfig(t, map[string]interface{}{
+		"tenant_extraction_mode": "header",
+		"tenant_header_name":     "X-Org",
+		"tenant_path_segment":    2,
+		"tenant_query_param":     "org",
+		"tenant_cookie_name":     "org_id",
+	})
+
+	tests := []struct {
+		name  string
+		child map[string]interface{}
+		want  PluginConfig
+	}{
+		{
+			name:  "nothing set",
+			child: map[string]interface{}{},
+			want: PluginConfig{TenantExtractionMode: TenantExtractionHeader, TenantHeaderName: "X-Org",
+				TenantPathSegment: 2, TenantQueryParam: "org", TenantCookieName: "org_id"},
+		},
+		{
+			name:  "only tenant_header_name",
+			child: map[string]interface{}{"tenant_header_name": "X-Tenant"},
+			want: PluginConfig{TenantExtractionMode: TenantExtractionHeader, TenantHeaderName: "X-Tenant",
+				TenantPathSegment: 2, TenantQueryParam: "org", TenantCookieName: "org_id"},
+		},
+		{
+			name:  "only tenant_path_segment",
+			child: map[string]interface{}{"tenant_path_segment": 0},
+			want: PluginConfig{TenantExtractionMode: TenantExtractionHeader, TenantHeaderName: "X-Org",
+				TenantPathSegment: 0, TenantQueryParam: "org", TenantCookieName: "org_id"},
+		},
+		{
+			name:  "only tenant_query_param",
+			child: map[string]interface{}{"tenant_query_param": "tenant"},
+			want: PluginConfig{TenantExtractionMode: TenantExtractionHeader, TenantHeaderName: "X-Org",
+				TenantPathSegment: 2, TenantQueryParam: "tenant", TenantCookieName: "org_id"},
+		},
+		{
+			name:  "mode and its key",
+			child: map[string]interface{}{"tenant_extraction_mode": "path", "tenant_path_segment": 1},
+			want: PluginConfig{TenantExtractionMode: TenantExtractionPath, TenantHeaderName: "X-Org",
+				TenantPathSegment: 1, TenantQueryParam: "org", TenantCookieName: "org_id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			child := parseTestConfig(t, tt.child)
+			got := (&parser{}).Merge(parent, child).(*PluginConfig)
+
+			if got.TenantExtractionMode != tt.want.TenantExtractionMode {
+				t.Errorf("TenantExtractionMode = %q, want %q", got.TenantExtractionMode, tt.want.TenantExtractionMode)
+			}
+			if got.TenantHeaderName != tt.want.TenantHeaderName {
+				t.Errorf("TenantHeaderName = %q, want %q", got.TenantHeaderName, tt.want.TenantHeaderName)
+			}
+			if got.TenantPathSegment != tt.want.TenantPathSegment {
+				t.Errorf("TenantPathSegment = %d, want %d", got.TenantPathSegment, tt.want.TenantPathSegment)
+			}
+			if got.TenantQueryParam != tt.want.TenantQueryParam {
+				t.Errorf("TenantQueryParam = %q, want %q", got.TenantQueryParam, tt.want.TenantQueryParam)
+			}
+			if got.TenantCookieName != tt.want.TenantCookieName {
+				t.Errorf("TenantCookieName = %q, want %q", got.TenantCookieName, tt.want.TenantCookieName)
+			}
+			// Neither side is modified
+			if parent.TenantHeaderName != "X-Org" || parent.TenantExtractionMode != TenantExtractionHeader {
+				t.Errorf("Merge modified the parent: %+v", parent)
+			}
+		})
+	}
+}
+
+func TestMergeKeepsSetKeysForNextMerge(t *testing.T) {
+	listener := parseTestConfig(t, map[string]interface{}{"tenant_extraction_mode": "query"})
+	vhost := parseTestConfig(t, map[string]interface{}{"tenant_query_param": "org"})
+	route := parseTestConfig(t, map[string]interface{}{"tenant_header_name": "X-Org"})
+
+	merged := (&parser{}).Merge(listener, vhost)
+	got := (&parser{}).Merge(merged, route).(*PluginConfig)
+	if got.TenantExtractionMode != TenantExtractionQuery || got.TenantQueryParam != "org" || got.TenantHeaderName != "X-Org" {
+		t.Errorf("got mode %q, query param %q, header %q; want query, org, X-Org",
+			got.TenantExtractionMode, got.TenantQueryParam, got.TenantHeaderName)
+	}
+}
+
+// A route config may give one of a pair of settings and inherit the other,
+// so the pair is checked once merged
+func TestMergeChecksSettingPairs(t *testing.T) {
+	tests := []struct {
+		name    string
+		parent  map[string]interface{}
+		child   map[string]interface{}
+		applied func(*PluginConfig) bool
+		want    bool
+	}{
+		{
+			name:    "maintenance shard from the parent",
+			parent:  map[string]interface{}{"maintenance_shard_id": "holding"},
+			child:   map[string]interface{}{"maintenance_mode": true},
+			applied: func(c *PluginConfig) bool { return c.MaintenanceMode },
+			want:    true,
+		},
+		{
+			name:    "maintenance mode without a shard",
+			parent:  map[string]interface{}{},
+			child:   map[string]interface{}{"maintenance_mode": true},
+			applied: func(c *PluginConfig) bool { return c.MaintenanceMode },
+			want:    false,
+		},
+		{
+			name:    "override header with the parent's admin token",
+			parent:  map[string]interface{}{"admin_token": "secret"},
+			child:   map[string]interface{}{"allow_shard_override_header": true},
+			applied: func(c *PluginConfig) bool { return c.AllowShardOverrideHeader },
+			want:    true,
+		},
+		{
+			name:    "override header without an admin token",
+			parent:  map[string]interface{}{},
+			child:   map[string]interface{}{"allow_shard_override_header": true},
+			applied: func(c *PluginConfig) bool { return c.AllowShardOverrideHeader },
+			want:    false,
+		},
+		{
+			name:    "resolve path with the parent's admin token",
+			parent:  map[string]interface{}{"admin_token": "secret"},
+			child:   map[string]interface{}{"resolve_path": "/shard-router/resolve"},
+			applied: func(c *PluginConfig) bool { return c.ResolvePath != "" },
+			want:    true,
+		},
+		{
+			name:    "resolve path without an admin token",
+			parent:  map[string]interface{}{},
+			child:   map[string]interface{}{"resolve_path": "/shard-router/resolve"},
+			applied: func(c *PluginConfig) bool { return c.ResolvePath != "" },
+			want:    false,
+		},
+		{
+			name:    "trust value with the parent's header name",
+			parent:  map[string]interface{}{"trust_shard_header_name": "x-internal"},
+			child:   map[string]interface{}{"trust_shard_header_value": "true"},
+			applied: func(c *PluginConfig) bool { return c.TrustShardHeaderValue == "true" },
+			want:    true,
+		},
+		{
+			name:    "trust value without a header name",
+			parent:  map[string]interface{}{},
+			child:   map[string]interface{}{"trust_shard_header_value": "true"},
+			applied: func(c *PluginConfig) bool { return c.TrustShardHeaderValue == "true" },
+			want:    false,
+		},
+		{
+			name:    "redis username with the parent's password",
+			parent:  map[string]interface{}{"redis_password": "secret"},
+			child:   map[string]interface{}{"redis_username": "shard-router"},
+			applied: func(c *PluginConfig) bool { return c.RedisUsername != "" },
+			want:    true,
+		},
+		{
+			name:    "redis username without a password",
+			parent:  map[string]interface{}{},
+			child:   map[string]interface{}{"redis_username": "shard-router"},
+			applied: func(c *PluginConfig) bool { return c.RedisUsername != "" },
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := parseTestConfig(t, tt.parent)
+			child := parseTestConfig(t, tt.child)
+			got := (&parser{}).Merge(parent, child).(*PluginConfig)
+			if tt.applied(got) != tt.want {
+				t.Errorf("route setting applied = %v, want %v", !tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChecksSettingPairsOnFilterConfig(t *testing.T) {
+	tests := []struct {
+		settings map[string]interface{}
+		want     string
+	}{
+		{map[string]interface{}{"maintenance_mode": true}, "maintenance_mode requires maintenance_shard_id"},
+		{map[string]interface{}{"allow_shard_override_header": true}, "allow_shard_override_header requires admin_token"},
+		{map[string]interface{}{"resolve_path": "/shard-router/resolve"}, "resolve_path requires admin_token"},
+		{map[string]interface{}{"trust_shard_header_value": "true"}, "trust_shard_header_value requires trust_shard_header_name"},
+		{map[string]interface{}{"redis_username": "shard-router"}, "redis_username requires redis_password"},
+	}
+
+	for _, tt := range tests {
+		tt.settings["mapping_backend"] = "file"
+		tt.settings["mapping_file_path"] = "mapping.json"
+		tt.settings["enable_redis_cache"] = false
+		if _, err := parseTestSettingsWith(t, tt.settings, fakeConfigCallbacks{}); err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%v) = %v, want %q", tt.settings, err, tt.want)
+		}
+	}
+}
+
+func TestExpandEnvValues(t *testing.T) {
+	t.Setenv("SHARD_ROUTER_TEST_HOST", "redis.internal")
+	t.Setenv("SHARD_ROUTER_TEST_SHARD", "holding")
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"string", "${SHARD_ROUTER_TEST_HOST}:6379", "redis.internal:6379"},
+		{"unset variable", "${SHARD_ROUTER_TEST_UNSET}", "${SHARD_ROUTER_TEST_UNSET}"},
+		{"bare dollar", "$SHARD_ROUTER_TEST_HOST", "$SHARD_ROUTER_TEST_HOST"},
+		{"number", 6379.0, 6379.0},
+		{"list", []interface{}{"${SHARD_ROUTER_TEST_HOST}", "static"}, []interface{}{"redis.internal", "static"}},
+		{
+			name:  "map",
+			value: map[string]interface{}{"s3": "https://${SHARD_ROUTER_TEST_HOST}"},
+			want:  map[string]interface{}{"s3": "https://redis.internal"},
+		},
+		{
+			name:  "map in a map",
+			value: map[string]interface{}{"x-shard": map[string]interface{}{"default": "${SHARD_ROUTER_TEST_SHARD}"}},
+			want:  map[string]interface{}{"x-shard": map[string]interface{}{"default": "holding"}},
+		},
+		{
+			name:  "map keys are kept",
+			value: map[string]interface{}{"${SHARD_ROUTER_TEST_HOST}": "a"},
+			want:  map[string]interface{}{"${SHARD_ROUTER_TEST_HOST}": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expandEnvValues(map[string]interface{}{"key": tt.value})["key"]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandEnvValues(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// Envoy attribute holding the downstream connection's ID, unique per process
+const connectionIDProperty = "connection.id"
+
+// Answered from the connection cache rather than a lookup, reported as the tier
+const tierConnection = "connection"
+
+// A shard resolved for a connection and authority
+type connectionEntry struct {
+	tenantID    string
+	environment string
+	shard       string
+	candidates  []string
+	expiresAt   time.Time
+}
+
+// Remembers the last resolution per downstream connection and authority for
+// ConnectionCacheTTL, so the streams of an HTTP/2 connection skip extraction
+// and lookup. Envoy doesn't tell filters when a connection closes, entries
+// just expire or are evicted.
+type connectionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries *lru.Cache[string, connectionEntry]
+}
+
+func newConnectionCache(conf *PluginConfig) (*connectionCache, error) {
+	entries, err := lru.New[string, connectionEntry](conf.ConnectionCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &connectionCache{ttl: conf.ConnectionCacheTTL, entries: entries}, nil
+}
+
+// returns why the tenant of a request may depend on more than its connection
+// and authority, or nil when the connection cache can be used
+func connectionCacheIneligible(conf *PluginConfig) error {
+	switch {
+	case conf.TenantExtractionMode == TenantExtractionCIDR && conf.TenantXFFTrustedHops > 0:
+		return errors.New("tenant_xff_trusted_hops reads a per-request header")
+	case conf.TenantExtractionMode != TenantExtractionSubdomain && conf.TenantExtractionMode != TenantExtractionMTLS &&
+		conf.TenantExtractionMode != TenantExtractionCIDR:
+		return errors.New("the tenant must come from the host, the client certificate or the client address")
+	case conf.EnvironmentHeaderName != "":
+		return errors.New("environment_header_name reads a per-request header")
+	case conf.isSet("stickiness_header") && conf.StickinessHeader != "":
+		// Only when configured: the X-Request-ID default differs per stream
+		// anyway, so weighted picks just become per connection
+		return errors.New("stickiness_header reads a per-request header")
+	case len(conf.HashHeaders) > 0:
+		return errors.New("hash_headers reads per-request headers")
+	}
+	return nil
+}
+
+// returns the connection cache key of the request, false when Envoy doesn't
+// report the connection
+func (f *ShardRouterFilter) connectionKey(header api.RequestHeaderMap) (string, bool) {
+	if f.config.connectionCache == nil {
+		return "", false
+	}
+	id, err := f.callbacks.GetProperty(connectionIDProperty)
+	if err != nil || id == "" {
+		return "", false
+	}
+	authority, _ := header.Get(":authority")
+	return id + "/" + authority, true
+}
+
+// returns the connection's unexpired entry for key
+func (c *connectionCache) get(key string) (connectionEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries.Get(key)
+	if !ok {
+		return connectionEntry{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		c.entries.Remove(key)
+		return connectionEntry{}, false
+	}
+	return entry, true
+}
+
+// remembers entry for key until the TTL is up
+func (c *connectionCache) add(key string, entry connectionEntry) {
+	entry.expiresAt = time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Add(key, entry)
+}
+
+// routes the request as an earlier stream of its connection was, reporting
+// whether there was one
+func (f *ShardRouterFilter) routeFromConnection(key string) bool {
+	if f.config.inMaintenance() {
+		return false
+	}
+	entry, ok := f.config.connectionCache.get(key)
+	if !ok {
+		return false
+	}
+	f.tenantID, f.environment = entry.tenantID, entry.environment
+	f.lookupTier = tierConnection
+	f.setShard(entry.shard)
+	f.shardCandidates = entry.candidates
+	f.followShardHint(entry.tenantID, entry.shard, entry.candidates)
+	f.setRequestHeaders()
+	connectionCacheHits.Inc()
+	f.config.log().debug("routed from connection cache", "tenant", entry.tenantID, "shard", entry.shard)
+	return true
+}
+
+// remembers the request's resolution for the later streams of its
+// connection. Last known good and maintenance answers aren't remembered,
+// the next stream should try the tiers again.
+func (f *ShardRouterFilter) rememberForConnection() {
+	if f.connKey == "" || f.servedStale || f.lookupTier == tierMaintenance {
+		return
+	}
+	f.config.connectionCache.add(f.connKey, connectionEntry{
+		tenantID:    f.tenantID,
+		environment: f.environment,
+		shard:       f.currentShardID,
+		candidates:  f.shardCandidates,
+	})
+}
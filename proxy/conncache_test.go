@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestConnectionCacheStickinessHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "default", settings: map[string]interface{}{}},
+		{name: "explicitly empty", settings: map[string]interface{}{"stickiness_header": ""}},
+		{name: "configured", settings: map[string]interface{}{"stickiness_header": "X-User-ID"}, wantErr: true},
+		{name: "configured as the default", settings: map[string]interface{}{"stickiness_header": "X-Request-ID"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := map[string]interface{}{
+				"tenant_extraction_mode": "subdomain",
+				"connection_cache_ttl":   "2s",
+			}
+			for key, value := range tt.settings {
+				settings[key] = value
+			}
+			conf, err := parseTestSettings(t, settings)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Parse succeeded, want stickiness_header rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if conf.connectionCache == nil {
+				t.Error("connection cache not created")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "github.com/cespare/xxhash/v2"
+
+// reports whether the tenant's requests are among the DrainShards percentage
+// diverted from shardID. Tenants are hashed together with the shard, so
+// raising the percentage only ever adds tenants to the diverted set, and
+// draining two shards doesn't pick the same tenants of each.
+func drained(tenantKey, shardID string, percent int) bool {
+	return xxhash.Sum64String(shardID+"/"+tenantKey)%100 < uint64(percent)
+}
+
+// diverts a tenant of a draining shard: to another of its weighted shards,
+// picked by stickyKey, else to one of its replicas, picked likewise, else to
+// DrainFallbackShardID. Shards draining or unhealthy themselves are never
+// diverted to, and with nowhere to go the tenant stays where it is.
+func (f *ShardRouterFilter) drainShard(tenantKey, assignment, stickyKey string, selection shardSelection) shardSelection {
+	percent := f.config.DrainShards[selection.shard]
+	if percent == 0 || !drained(tenantKey, selection.shard, percent) {
+		return selection
+	}
+
+	usable := func(shardID string) bool {
+		return f.config.DrainShards[shardID] == 0 && !f.unhealthyShards.unhealthy(shardID)
+	}
+	target := ""
+	if parsed, err := parseAssignment(assignment); err == nil {
+		var weighted []WeightedShard
+		for _, shard := range parsed.WeightedShards {
+			if shard.Weight > 0 && usable(shard.ShardID) {
+				weighted = append(weighted, shard)
+			}
+		}
+		if shardID, err := pickStickyShard(weighted, stickyKey); err == nil {
+			target = shardID
+		} else {
+			var replicas []string
+			for _, replica := range parsed.ReplicaShardIDs {
+				if usable(replica) {
+					replicas = append(replicas, replica)
+				}
+			}
+			target = pickStickyReplica(replicas, stickyKey)
+		}
+	}
+	if target == "" && f.config.DrainFallbackShardID != "" && usable(f.config.DrainFallbackShardID) {
+		target = f.config.DrainFallbackShardID
+	}
+	if target == "" {
+		f.config.log().warn("draining shard has nowhere to divert tenant to", "shard", selection.shard, "tenant", tenantKey)
+		return selection
+	}
+
+	recordDrainedLookup(selection.shard)
+	f.config.log().debug("diverted tenant of draining shard", "shard", selection.shard, "tenant", tenantKey,
+		"target", target, "percent", percent)
+	selection.shard = target
+	return selection
+}
@@ -1,60 +1,335 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cespare/xxhash/v2"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
 	"github.com/redis/go-redis/v9"
 )
 
-// extracts tenant ID from the Host header subdomain
-func (f *ShardRouterFilter) extractTenantFromHost(host string) (string, error) {
-	parts := strings.Split(host, ".")
-	if len(parts) >= 2 {
-		// Remove port if present
-		tenant := strings.Split(parts[0], ":")[0]
-		if tenant != "" {
-			return tenant, nil
+// Returned when no tier knows the tenant, as opposed to a tier failing
+var errNoMapping = errors.New("no shard mapping found for tenant")
+
+// Returned when the backend is skipped to stay within LookupBudget
+var errLookupBudgetSpent = errors.New("lookup budget spent before the mapping backend")
+
+// Where EmitRouteMetadata publishes the shard. envoy.lb is the namespace the
+// router merges into a subset load balancer's metadata match.
+const (
+	routeMetadataNamespace = "envoy.lb"
+	routeMetadataKey       = "shard_id"
+)
+
+// Log markers, in the event field, for requests left without a shard
+const (
+	// The tenant couldn't be determined, usually a client issue
+	eventExtractionFailed = "extraction_failed"
+	// The tenant is known but no mapping has it, usually a data issue
+	eventMappingNotFound = "mapping_not_found"
+)
+
+// extracts tenant ID from the Host header subdomain, its first
+// SubdomainLabelCount labels
+func (f *ShardRouterFilter) extractTenantFromHost(authority string) (string, error) {
+	labels, err := hostLabels(authority)
+	if err != nil {
+		return "", err
+	}
+
+	// Under BaseDomain the labels left of it are all subdomain, otherwise
+	// at least one label past the tenant must be the domain
+	count := f.config.SubdomainLabelCount
+	if base := f.config.BaseDomain; base != "" {
+		baseLabels := strings.Count(base, ".") + 1
+		if len(labels) <= baseLabels || !strings.EqualFold(strings.Join(labels[len(labels)-baseLabels:], "."), base) {
+			return "", fmt.Errorf("host %s is not under base domain %s", strings.Join(labels, "."), base)
+		}
+		labels = labels[:len(labels)-baseLabels]
+	} else if len(labels) <= count {
+		return "", fmt.Errorf("unable to extract tenant from host: %s", authority)
+	}
+
+	if len(labels) < count {
+		return "", fmt.Errorf("host %s has fewer than %d tenant labels", authority, count)
+	}
+	return strings.Join(labels[:count], "."), nil
+}
+
+// extracts the tenant ID as configured by TenantExtractionMode
+func (f *ShardRouterFilter) extractTenantID(header api.RequestHeaderMap) (string, error) {
+	switch f.config.TenantExtractionMode {
+	case TenantExtractionHeader:
+		if !f.config.FallbackToSubdomain {
+			return f.extractTenantFromHeader(header)
+		}
+	case TenantExtractionSubdomain:
+		host, exists := header.Get(":authority")
+		if !exists {
+			return "", errors.New("host header not found")
+		}
+		return f.extractTenantFromHost(host)
+	case TenantExtractionCookie:
+		return f.extractTenantFromCookie(header)
+	case TenantExtractionPath:
+		return f.extractTenantFromPath(header)
+	case TenantExtractionQuery:
+		return f.extractTenantFromQuery(header)
+	case TenantExtractionMTLS:
+		return f.extractTenantFromCertificate(header)
+	case TenantExtractionCIDR:
+		return f.extractTenantFromAddress(header)
+	}
+
+	// Auto, or header with FallbackToSubdomain: try header first, then fall
+	// back to the Host subdomain
+	if tenantID, err := f.extractTenantFromHeader(header); err == nil {
+		return tenantID, nil
+	}
+	host, exists := header.Get(":authority")
+	if !exists {
+		return "", fmt.Errorf("neither tenant header %s nor Host header found", f.config.TenantHeaderName)
+	}
+	return f.extractTenantFromHost(host)
+}
+
+// extracts tenant ID from the configured tenant header
+func (f *ShardRouterFilter) extractTenantFromHeader(header api.RequestHeaderMap) (string, error) {
+	tenantID, exists := header.Get(f.config.TenantHeaderName)
+	if !exists || tenantID == "" {
+		return "", fmt.Errorf("tenant header %s not found", f.config.TenantHeaderName)
+	}
+	if debugLogging() {
+		api.LogDebugf("Extracted tenant ID from header %s: %s", f.config.TenantHeaderName, tenantID)
+	}
+	return tenantID, nil
+}
+
+// extracts tenant ID from the configured cookie
+func (f *ShardRouterFilter) extractTenantFromCookie(header api.RequestHeaderMap) (string, error) {
+	for _, cookies := range header.Values("cookie") {
+		for _, cookie := range strings.Split(cookies, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+			if name == f.config.TenantCookieName && value != "" {
+				if debugLogging() {
+					api.LogDebugf("Extracted tenant ID from cookie %s: %s", name, value)
+				}
+				return strings.Trim(value, `"`), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("tenant cookie %s not found", f.config.TenantCookieName)
+}
+
+// extracts tenant ID from the configured 0-based segment of the request path
+func (f *ShardRouterFilter) extractTenantFromPath(header api.RequestHeaderMap) (string, error) {
+	tenantID, err := pathSegment(header.Path(), f.config.TenantPathSegment)
+	if err != nil {
+		return "", err
+	}
+	if debugLogging() {
+		api.LogDebugf("Extracted tenant ID from path segment %d: %s", f.config.TenantPathSegment, tenantID)
+	}
+	return tenantID, nil
+}
+
+// extracts tenant ID from the configured query parameter
+func (f *ShardRouterFilter) extractTenantFromQuery(header api.RequestHeaderMap) (string, error) {
+	_, rawQuery, _ := strings.Cut(header.Path(), "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("invalid query string: %v", err)
+	}
+	tenantID := query.Get(f.config.TenantQueryParam)
+	if tenantID == "" {
+		return "", fmt.Errorf("tenant query parameter %s not found", f.config.TenantQueryParam)
+	}
+	if debugLogging() {
+		api.LogDebugf("Extracted tenant ID from query parameter %s: %s", f.config.TenantQueryParam, tenantID)
+	}
+	return tenantID, nil
+}
+
+// extracts the environment from the configured header, else from the
+// configured host label. Returns "" when neither is configured or present.
+func (f *ShardRouterFilter) extractEnvironment(header api.RequestHeaderMap) string {
+	if f.config.EnvironmentHeaderName != "" {
+		if env, exists := header.Get(f.config.EnvironmentHeaderName); exists && env != "" {
+			return env
+		}
+	}
+
+	if f.config.EnvironmentHostLabel > 0 {
+		if authority, exists := header.Get(":authority"); exists {
+			labels, err := hostLabels(authority)
+			if err != nil {
+				return ""
+			}
+			// The last two labels are the domain itself
+			if f.config.EnvironmentHostLabel < len(labels)-2 {
+				return labels[f.config.EnvironmentHostLabel]
+			}
 		}
 	}
-	return "", fmt.Errorf("unable to extract tenant from host: %s", host)
+
+	return ""
+}
+
+// normalizes a lookup key into the key used by the memory and Redis tiers.
+// The backend always matches on the raw key.
+func (c *PluginConfig) cacheKey(key string) string {
+	switch c.CacheKeyHash {
+	case CacheKeyHashSHA256:
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	case CacheKeyHashXXHash:
+		return strconv.FormatUint(xxhash.Sum64String(key), 16)
+	default:
+		return key
+	}
 }
 
-// checks the in-memory cache for tenant-shard mapping
-func (f *ShardRouterFilter) lookupInMemoryCache(tenantID string) (string, bool) {
+// checks the in-memory cache for tenant-shard mapping. With
+// StaleWhileRevalidate an expired entry is still returned, flagged stale,
+// until it is StaleMaxAge past its TTL; the caller must revalidate it. An
+// expired entry that isn't served is reported as expired, so the caller can
+// tell whether the tiers below remap the tenant.
+func (f *ShardRouterFilter) lookupInMemoryCache(tenantID string) (assignment string, found, stale bool, expired string) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
 	if f.memoryCache != nil {
-		shardID, found := f.memoryCache.Get(tenantID)
-		if found {
-			api.LogDebugf("Memory cache hit for tenant: %s -> shard: %s", tenantID, shardID)
-			return shardID, true
+		key := f.config.cacheKey(tenantID)
+		entry, found := f.memoryCache.Get(key)
+		switch {
+		case !found:
+		case !f.memoryEntryExpired(entry):
+			recordTierSuccess(tierMemory)
+			if debugLogging() {
+				api.LogDebugf("Memory cache hit for tenant: %s -> shard: %s", tenantID, entry.assignment)
+			}
+			return entry.assignment, true, false, ""
+		case f.config.StaleWhileRevalidate && time.Since(entry.cachedAt) <= f.memoryEntryTTL(entry)+f.config.StaleMaxAge:
+			recordTierSuccess(tierMemory)
+			api.LogDebugf("Stale memory cache hit for tenant: %s -> shard: %s", tenantID, entry.assignment)
+			return entry.assignment, true, true, ""
+		case f.config.ServeLastKnownGoodOnOutage:
+			// Kept as the last known good, lookupAssignment decides on it
+			expired = entry.assignment
+			api.LogDebugf("Memory cache entry for tenant %s from %s expired", tenantID, entry.source)
+		default:
+			f.memoryCache.Remove(key)
+			expired = entry.assignment
+			api.LogDebugf("Memory cache entry for tenant %s from %s expired", tenantID, entry.source)
 		}
 	}
 	api.LogDebugf("Memory cache miss for tenant: %s", tenantID)
-	return "", false
+	return "", false, false, expired
 }
 
-// checks the Redis cache for tenant-shard mapping
-func (f *ShardRouterFilter) lookupInRedisCache(tenantID string) (string, error) {
-	if f.redisClient == nil {
+// returns the tenant's memory entry however long ago it expired, without
+// counting it as a use
+func (f *ShardRouterFilter) lastKnownGood(tenantID string) (string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.memoryCache == nil {
+		return "", false
+	}
+	entry, found := f.memoryCache.Peek(f.config.cacheKey(tenantID))
+	return entry.assignment, found
+}
+
+// returns how long entry stays valid: its own TTL, or else the memory TTL of
+// the tier it came from. 0 means until it is evicted.
+func (f *ShardRouterFilter) memoryEntryTTL(entry memoryCacheEntry) time.Duration {
+	ttl := f.config.MemoryCacheTTLFromS3
+	if entry.source == tierRedis {
+		ttl = f.config.MemoryCacheTTLFromRedis
+	}
+	if entry.ttl > 0 {
+		ttl = entry.ttl
+	}
+	return ttl
+}
+
+// reports whether entry has outlived its TTL
+func (f *ShardRouterFilter) memoryEntryExpired(entry memoryCacheEntry) bool {
+	ttl := f.memoryEntryTTL(entry)
+	return ttl > 0 && time.Since(entry.cachedAt) > ttl
+}
+
+// drops the tenant's memory cache entry
+func (f *ShardRouterFilter) forgetInMemory(tenantID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.memoryCache != nil {
+		f.memoryCache.Remove(f.config.cacheKey(tenantID))
+	}
+}
+
+// checks the Redis cache for tenant-shard mapping, reading from a replica
+// when configured
+func (f *ShardRouterFilter) lookupInRedisCache(ctx context.Context, tenantID string) (string, error) {
+	if f.redisReader == nil {
 		return "", fmt.Errorf("redis client not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), f.config.RedisTimeout)
+	if err := f.redisReaderBreaker.allow(); err != nil {
+		return "", err
+	}
+
+	// Never written either, so it can only be a miss
+	cacheKey, ok := f.config.redisKey(tenantID)
+	if !ok {
+		return "", nil
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, f.config.RedisTimeout)
 	defer cancel()
 
-	key := f.config.RedisKeyPrefix + tenantID
-	result := f.redisClient.Get(ctx, key)
+	var result *redis.StringCmd
+	if f.config.RedisStorageMode == RedisStorageHash {
+		result = f.redisReader.HGet(callCtx, f.config.RedisHashKey, cacheKey)
+	} else {
+		key := f.config.RedisKeyPrefix + cacheKey
+		result = f.redisReader.Get(callCtx, key)
 
+		// Tenants not yet written under the new prefix are still under the old one
+		if result.Err() == redis.Nil && f.config.RedisFallbackKeyPrefix != "" {
+			result = f.redisReader.Get(callCtx, f.config.RedisFallbackKeyPrefix+cacheKey)
+			if result.Err() == nil {
+				api.LogDebugf("Redis hit for tenant %s under fallback prefix %s", tenantID, f.config.RedisFallbackKeyPrefix)
+			}
+		}
+	}
+
+	// A miss is a healthy answer as far as the breaker is concerned
+	if result.Err() == redis.Nil {
+		f.reportOutcome(ctx, f.redisReaderBreaker, nil)
+	} else {
+		f.reportOutcome(ctx, f.redisReaderBreaker, result.Err())
+	}
+
+	// A lagging replica may not have the key yet, which is just a miss
 	if result.Err() == redis.Nil {
+		recordTierSuccess(tierRedis)
 		api.LogDebugf("Redis cache miss for tenant: %s", tenantID)
 		return "", nil
 	} else if result.Err() != nil {
@@ -62,26 +337,66 @@ func (f *ShardRouterFilter) lookupInRedisCache(tenantID string) (string, error)
 		return "", result.Err()
 	}
 
-	shardID, err := result.Result()
+	shardID, err := decodeRedisValue(result.Val())
 	if err != nil {
+		api.LogWarnf("Redis lookup error for tenant %s: %v", tenantID, err)
 		return "", err
 	}
+	recordTierSuccess(tierRedis)
 
 	api.LogDebugf("Redis cache hit for tenant: %s -> shard: %s", tenantID, shardID)
 	return shardID, nil
 }
 
-// stores tenant-shard mapping in Redis
-func (f *ShardRouterFilter) cacheInRedis(tenantID, shardID string) error {
+// stores tenant-shard mapping in Redis. ctx is the lookup's, the write
+// itself outlives it.
+func (f *ShardRouterFilter) cacheInRedis(ctx context.Context, tenantID, shardID string, ttl time.Duration) error {
 	if f.redisClient == nil {
 		return fmt.Errorf("redis client not initialized")
 	}
+	redisKey, ok := f.config.redisKey(tenantID)
+	if !ok {
+		return nil
+	}
+
+	// A tenant's own TTL only applies to its own key, a hash expires as a
+	// whole. A zero TTL makes the entry persistent.
+	write := redisWrite{value: f.config.encodeRedisValue(shardID), ttl: f.config.RedisTTL}
+	if f.config.RedisNoExpiry {
+		write.ttl = 0
+	}
+	if ttl > 0 && f.config.RedisStorageMode != RedisStorageHash {
+		write.ttl = ttl
+	}
+	if f.config.RedisStorageMode == RedisStorageHash {
+		write.hashKey = f.config.RedisHashKey
+		write.key = redisKey
+	} else {
+		write.key = f.config.RedisKeyPrefix + redisKey
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), f.config.RedisTimeout)
+	// Leave the write to the background writer, the request doesn't wait for it
+	if f.writeBehind != nil {
+		if !f.writeBehind.enqueue(write) {
+			api.LogDebugf("Write-behind buffer full, dropped Redis write for tenant %s", tenantID)
+		}
+		return nil
+	}
+
+	if err := f.redisBreaker.allow(); err != nil {
+		return err
+	}
+
+	// Not tied to the stream: a result we already paid for is worth caching
+	// even if the client has gone away in the meantime
+	writeCtx, cancel := context.WithTimeout(context.Background(), f.config.RedisTimeout)
 	defer cancel()
 
-	key := f.config.RedisKeyPrefix + tenantID
-	err := f.redisClient.Set(ctx, key, shardID, f.config.RedisTTL).Err()
+	_, err := f.redisClient.Pipelined(writeCtx, func(pipe redis.Pipeliner) error {
+		write.apply(writeCtx, pipe)
+		return nil
+	})
+	f.reportOutcome(ctx, f.redisBreaker, err)
 	if err != nil {
 		api.LogWarnf("Failed to cache in Redis for tenant %s: %v", tenantID, err)
 		return err
@@ -91,166 +406,1027 @@ func (f *ShardRouterFilter) cacheInRedis(tenantID, shardID string) error {
 	return nil
 }
 
-// fetches the complete mapping from S3 and searches for the tenant
-func (f *ShardRouterFilter) lookupInS3(tenantID string) (string, error) {
+// looks the tenant up in the source of truth: the refreshed snapshot once
+// it has loaded, otherwise the configured backend directly
+func (f *ShardRouterFilter) lookupInBackend(ctx context.Context, tenantID string) (shardID string, ttl time.Duration, tier string, err error) {
+	// Serve from the refreshed snapshot once it has loaded
+	if f.refresher != nil {
+		start := time.Now()
+		if shardID, ttl, tier, loaded := f.refresher.lookup(tenantID); loaded {
+			if shardID != "" {
+				api.LogDebugf("Snapshot hit for tenant: %s -> shard: %s", tenantID, shardID)
+			} else {
+				api.LogDebugf("Snapshot miss for tenant: %s", tenantID)
+			}
+			recordTierCall(tier, start)
+			return shardID, ttl, tier, nil
+		}
+	}
+
+	// Better to apply FailureMode now than to start a call the budget cuts short
+	if f.budgetNearlySpent(ctx) {
+		return "", 0, backendTier(f.config.MappingBackend), errLookupBudgetSpent
+	}
+
+	// A miss is an answer, only failures move on to the next backend
+	for i, backend := range f.config.MappingBackends {
+		tier = backendTier(backend)
+		start := time.Now()
+		shardID, ttl, err = f.lookupInMappingBackend(ctx, backend, tenantID)
+		recordTierCall(tier, start)
+		if err == nil || ctx.Err() != nil || i == len(f.config.MappingBackends)-1 {
+			break
+		}
+		recordTierResult(tier, tierErrorResult(err))
+		f.config.log().warn("mapping backend failed, trying the next one", "tenant", tenantID, "tier", tier,
+			"next", f.config.MappingBackends[i+1], "err", err)
+	}
+	return shardID, ttl, tier, err
+}
+
+// reports whether less than a fifth of LookupBudget is left before ctx's
+// deadline. Lookups without a deadline, like revalidations, always have time.
+func (f *ShardRouterFilter) budgetNearlySpent(ctx context.Context) bool {
+	if f.config.LookupBudget <= 0 {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < f.config.LookupBudget/5
+}
+
+// looks the tenant up in one of the MappingBackends
+func (f *ShardRouterFilter) lookupInMappingBackend(ctx context.Context, backend, tenantID string) (string, time.Duration, error) {
+	switch backend {
+	case MappingBackendFile:
+		return f.lookupInFile(tenantID)
+	case MappingBackendS3ObjectPerTenant:
+		return f.lookupInS3TenantObject(ctx, tenantID)
+	}
+	return f.lookupInS3(ctx, tenantID)
+}
+
+// fetches the mapping objects from S3 and searches for the tenant. Objects
+// are searched last to first, so the first match is the one that wins. Only
+// once no object has an exact entry are their pattern rules tried, again
+// later objects first.
+func (f *ShardRouterFilter) lookupInS3(ctx context.Context, tenantID string) (string, time.Duration, error) {
 	if f.s3Client == nil {
-		return "", fmt.Errorf("s3 client not initialized")
+		return "", 0, fmt.Errorf("s3 client not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), f.config.S3Timeout)
+	callCtx, cancel := context.WithTimeout(ctx, f.config.S3Timeout)
 	defer cancel()
 
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(f.config.S3Bucket),
-		Key:    aws.String(f.config.S3Key),
+	// Taken before asking the breaker, so a probe it lets through is
+	// never abandoned waiting for a slot
+	if err := f.s3Limiter.acquire(callCtx); err != nil {
+		return "", 0, err
+	}
+	defer f.s3Limiter.release()
+
+	if err := f.s3Breaker.allow(); err != nil {
+		return "", 0, err
+	}
+
+	var patterns []patternRule
+	objects := s3MappingKeys(f.config)
+	for i := len(objects) - 1; i >= 0; i-- {
+		shardID, ttl, rules, err := f.lookupInS3Object(callCtx, objects[i], tenantID)
+		f.reportOutcome(ctx, f.s3Breaker, err)
+		if err != nil {
+			return "", 0, err
+		}
+		if shardID != "" {
+			recordTierSuccess(tierS3)
+			api.LogDebugf("S3 lookup hit for tenant: %s -> shard: %s (%s)", tenantID, shardID, objects[i])
+			return shardID, ttl, nil
+		}
+		patterns = append(patterns, rules...)
 	}
+	recordTierSuccess(tierS3)
 
-	result, err := f.s3Client.GetObjectWithContext(ctx, input)
+	if entry, ok := matchPatterns(patterns, tenantID); ok {
+		api.LogDebugf("S3 pattern hit for tenant: %s -> shard: %s", tenantID, entry.assignment)
+		return entry.assignment, entry.ttl, nil
+	}
+
+	api.LogDebugf("S3 lookup miss for tenant: %s", tenantID)
+	return "", 0, nil
+}
+
+// searches a single mapping object for the tenant
+func (f *ShardRouterFilter) lookupInS3Object(ctx context.Context, key, tenantID string) (string, time.Duration, []patternRule, error) {
+	if f.config.S3IndexCache {
+		shardID, ttl, patterns, err := f.lookupInS3Index(ctx, key, tenantID)
+		if err != nil {
+			api.LogWarnf("Failed to look up mapping %s in S3: %v", key, err)
+		}
+		return shardID, ttl, patterns, err
+	}
+
+	result, err := fetchMappingObjectWithRetry(ctx, f.s3Client, f.config, key, "")
 	if err != nil {
-		api.LogWarnf("Failed to fetch mapping from S3: %v", err)
-		return "", err
+		api.LogWarnf("Failed to fetch mapping %s from S3: %v", key, err)
+		return "", 0, nil, err
 	}
 	defer result.Body.Close()
 
-	body, err := io.ReadAll(result.Body)
+	// Stream the mappings and stop at the first match. The body is read from
+	// the network as it is decoded, so errors here count against S3 as well.
+	shardID, ttl, patterns, err := findAssignment(result.Body, f.config, tenantID)
 	if err != nil {
-		api.LogWarnf("Failed to read S3 object body: %v", err)
-		return "", err
+		api.LogWarnf("Failed to parse mapping %s from S3: %v", key, err)
+		return "", 0, nil, err
 	}
+	return shardID, ttl, patterns, nil
+}
 
-	var mappingData MappingData
-	if err := json.Unmarshal(body, &mappingData); err != nil {
-		api.LogWarnf("Failed to parse mapping data from S3: %v", err)
-		return "", err
+// Per-tenant objects hold a single assignment, anything bigger is not one
+const maxTenantObjectBytes = 64 << 10
+
+// fetches the tenant's own object for the object-per-tenant backend. The
+// object holds either the bare shard ID or a JSON mapping entry, e.g. one
+// with weighted_shards. A missing object is a miss.
+func (f *ShardRouterFilter) lookupInS3TenantObject(ctx context.Context, tenantID string) (string, time.Duration, error) {
+	if f.s3Client == nil {
+		return "", 0, fmt.Errorf("s3 client not initialized")
+	}
+
+	key, ok := tenantObjectKey(f.config.S3KeyTemplate, tenantID)
+	if !ok {
+		api.LogDebugf("S3 lookup miss for tenant: %s (not a valid object key)", tenantID)
+		return "", 0, nil
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, f.config.S3Timeout)
+	defer cancel()
+
+	// Taken before asking the breaker, so a probe it lets through is
+	// never abandoned waiting for a slot
+	if err := f.s3Limiter.acquire(callCtx); err != nil {
+		return "", 0, err
+	}
+	defer f.s3Limiter.release()
+
+	if err := f.s3Breaker.allow(); err != nil {
+		return "", 0, err
 	}
 
-	// Search for the tenant in the mappings
-	for _, mapping := range mappingData.Mappings {
-		if mapping.TenantID == tenantID {
-			api.LogDebugf("S3 lookup hit for tenant: %s -> shard: %s", tenantID, mapping.ShardID)
-			return mapping.ShardID, nil
+	result, err := fetchMappingObjectWithRetry(callCtx, f.s3Client, f.config, key, "")
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		f.reportOutcome(ctx, f.s3Breaker, nil)
+		recordTierSuccess(tierS3)
+		api.LogDebugf("S3 lookup miss for tenant: %s (no object %s)", tenantID, key)
+		return "", 0, nil
+	}
+	if err != nil {
+		f.reportOutcome(ctx, f.s3Breaker, err)
+		api.LogWarnf("Failed to fetch mapping %s from S3: %v", key, err)
+		return "", 0, err
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(result.Body, maxTenantObjectBytes+1))
+	f.reportOutcome(ctx, f.s3Breaker, err)
+	if err != nil {
+		api.LogWarnf("Failed to read mapping %s from S3: %v", key, err)
+		return "", 0, err
+	}
+	recordTierSuccess(tierS3)
+
+	assignment, ttl, err := parseTenantObject(data)
+	if err != nil {
+		api.LogWarnf("Invalid mapping %s in S3: %v", key, err)
+		return "", 0, err
+	}
+	api.LogDebugf("S3 lookup hit for tenant: %s -> shard: %s (%s)", tenantID, assignment, key)
+	return assignment, ttl, nil
+}
+
+// returns the object key of a tenant for the object-per-tenant backend. The
+// tenant is escaped so it can't add path segments, and keys with a "." or
+// ".." segment are refused: the SDK cleans request paths, which would take
+// such a key outside the template's prefix.
+func tenantObjectKey(template, tenantID string) (string, bool) {
+	key := strings.ReplaceAll(template, "{tenant}", url.PathEscape(tenantID))
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
 		}
 	}
+	return key, true
+}
 
-	api.LogDebugf("S3 lookup miss for tenant: %s", tenantID)
-	return "", nil
+// decodes a per-tenant object into an assignment and its own TTL, if any
+func parseTenantObject(data []byte) (string, time.Duration, error) {
+	if len(data) > maxTenantObjectBytes {
+		return "", 0, fmt.Errorf("object exceeds %d bytes", maxTenantObjectBytes)
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return "", 0, errors.New("object is empty")
+	}
+	if data[0] != '{' {
+		return string(data), 0, nil
+	}
+
+	var mapping TenantShardMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return "", 0, err
+	}
+	if mapping.assignment() == "" {
+		return "", 0, errors.New("object has no shard_id or weighted_shards")
+	}
+	return mapping.assignment(), mapping.ttl(), nil
 }
 
-// cacheInMemory stores tenant-shard mapping in memory cache
-func (f *ShardRouterFilter) cacheInMemory(tenantID, shardID string) {
+// reads the locally mounted mapping file and searches for the tenant
+func (f *ShardRouterFilter) lookupInFile(tenantID string) (string, time.Duration, error) {
+	file, err := openMappingFile(f.config, f.config.MappingFilePath)
+	if err != nil {
+		api.LogWarnf("Failed to open mapping file: %v", err)
+		return "", 0, err
+	}
+	defer file.Close()
+
+	shardID, ttl, patterns, err := findAssignment(file, f.config, tenantID)
+	if err != nil {
+		api.LogWarnf("Failed to parse mapping file %s: %v", f.config.MappingFilePath, err)
+		return "", 0, err
+	}
+	recordTierSuccess(tierFile)
+
+	if shardID != "" {
+		api.LogDebugf("File lookup hit for tenant: %s -> shard: %s", tenantID, shardID)
+		return shardID, ttl, nil
+	}
+	if entry, ok := matchPatterns(patterns, tenantID); ok {
+		api.LogDebugf("File pattern hit for tenant: %s -> shard: %s", tenantID, entry.assignment)
+		return entry.assignment, entry.ttl, nil
+	}
+
+	api.LogDebugf("File lookup miss for tenant: %s", tenantID)
+	return "", 0, nil
+}
+
+// cacheInMemory stores tenant-shard mapping in memory cache, recording the
+// tier it was found in
+func (f *ShardRouterFilter) cacheInMemory(tenantID, shardID, source string, ttl time.Duration) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	if f.memoryCache != nil {
-		f.memoryCache.Add(tenantID, shardID)
-		api.LogDebugf("Cached in memory: tenant %s -> shard %s", tenantID, shardID)
+		key := f.config.cacheKey(tenantID)
+		f.memoryCache.Add(key, memoryCacheEntry{assignment: internAssignment(shardID), source: source, cachedAt: time.Now(), ttl: ttl})
+		api.LogDebugf("Cached in memory: tenant %s -> shard %s (from %s)", tenantID, shardID, source)
+	}
+}
+
+// Represents the audit event emitted when a tenant's resolved shard changes
+type shardChangeEvent struct {
+	Event     string    `json:"event"`
+	TenantID  string    `json:"tenant_id"`
+	OldShard  string    `json:"old_shard"`
+	NewShard  string    `json:"new_shard"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// emits a JSON audit line for a remap observed by this proxy: a memory entry,
+// expired or served stale, replaced by a different assignment. Only a memory
+// cache that outlives the stream, with SharedMemoryCache, has earlier
+// entries to compare against.
+func logShardChange(tenantID, oldShard, newShard string) {
+	event, err := json.Marshal(shardChangeEvent{
+		Event:     "tenant_shard_changed",
+		TenantID:  tenantID,
+		OldShard:  oldShard,
+		NewShard:  newShard,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		api.LogWarnf("Failed to encode shard change event for tenant %s: %v", tenantID, err)
+		return
 	}
+	api.LogInfo(string(event))
+}
+
+// Lookup resolves the shard for tenantID through the override key and every
+// tier, as a request without an environment or stickiness header would, and
+// reports the tier that answered. It needs no Envoy request, so the same
+// logic as the request path is usable from tests and the admin and warm
+// paths. Canceling ctx abandons the lookup without counting against any
+// breaker.
+func (f *ShardRouterFilter) Lookup(ctx context.Context, tenantID string) (shardID string, tier string, err error) {
+	selection, tier, err := f.orchestratedLookup(ctx, tenantID, "", "")
+	return selection.shard, tier, err
 }
 
-// performs the complete lookup strategy with fallback
-func (f *ShardRouterFilter) orchestratedLookup(tenantID string) (string, error) {
+// performs the complete lookup strategy with fallback and picks the shard
+// for this request from the tenant's assignment, reporting the tier that
+// answered. Aliases are resolved to their canonical tenant first, so every
+// tier only ever sees canonical IDs. An empty stickyKey uses the lookup key.
+// Each dependency call is bounded by its own timeout within ctx, and the
+// whole lookup by LookupBudget.
+func (f *ShardRouterFilter) orchestratedLookup(ctx context.Context, tenantID, environment, stickyKey string) (shardSelection, string, error) {
+	trace := lookupTraceFrom(ctx)
+	if f.config.inMaintenance() {
+		f.config.log().debug("maintenance mode, routing to the holding shard", "tenant", tenantID, "shard", f.config.MaintenanceShardID)
+		trace.note(tierMaintenance, f.config.MaintenanceShardID)
+		return shardSelection{shard: f.config.MaintenanceShardID}, tierMaintenance, nil
+	}
+
+	if f.refresher != nil {
+		if canonical := f.refresher.canonicalTenant(tenantID); canonical != tenantID {
+			f.config.log().debug("resolved tenant alias", "alias", tenantID, "tenant", canonical)
+			trace.note("alias", canonical)
+			tenantID = canonical
+		}
+	}
+
+	key := compoundKey(tenantID, environment)
+
+	// A fresh memory entry answers without any I/O, and without the timer
+	if f.config.LookupBudget > 0 && !f.memoryCanAnswer(key) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.config.LookupBudget)
+		defer cancel()
+	}
+	if stickyKey == "" {
+		stickyKey = key
+	}
+
+	// An ops override outranks every tier, including the memory cache
+	if f.config.EnableRedisOverrides {
+		start := time.Now()
+		if assignment := f.lookupRedisOverride(ctx, key); assignment != "" {
+			selection, err := selectShard(assignment, stickyKey)
+			if err == nil {
+				trace.tier(tierOverride, resultHit, start)
+				recordOverrideHit(selection.shard)
+				return selection, tierOverride, nil
+			}
+			trace.tier(tierOverride, resultError, start)
+			f.config.log().warn("ignoring invalid Redis override", "tenant", key, "err", err)
+		} else {
+			trace.tier(tierOverride, resultMiss, start)
+		}
+	}
+
+	// Just-changed tenants win over the tiers, which may lag the change by
+	// up to a cache TTL or refresh interval
+	var assignment, tier string
+	var err error
+	if f.config.MappingOverlayPrefix != "" {
+		start := time.Now()
+		if assignment = f.lookupOverlay(ctx, key); assignment != "" {
+			tier = tierOverlay
+			trace.tier(tierOverlay, resultHit, start)
+			recordLookup(tier, start)
+		} else {
+			trace.tier(tierOverlay, resultMiss, start)
+		}
+	}
+	if assignment == "" {
+		var expired string
+		assignment, tier, expired, err = f.lookupAssignment(ctx, key)
+		if err != nil {
+			return shardSelection{}, tier, err
+		}
+		// The tiers below replaced what the memory cache last had
+		if expired != "" && expired != assignment {
+			logShardChange(key, expired, assignment)
+		}
+	}
+	selection, err := selectShard(assignment, stickyKey)
+	if err != nil {
+		return shardSelection{}, tier, err
+	}
+	trace.note("selected", selection.shard)
+	selected := selection.shard
+	selection, err = f.avoidUnhealthyShard(assignment, stickyKey, selection)
+	if err != nil {
+		return selection, tier, err
+	}
+	if selection.shard != selected {
+		trace.note("unhealthy", selection.shard)
+		selected = selection.shard
+	}
+	selection = f.drainShard(key, assignment, stickyKey, selection)
+	if selection.shard != selected {
+		trace.note("drained", selection.shard)
+	}
+	return selection, tier, nil
+}
+
+// returns the assignment pinned by <prefix>override:<tenant> in Redis, or ""
+// when there is none. Overrides are best effort: if Redis is unavailable the
+// normal mapping is used.
+func (f *ShardRouterFilter) lookupRedisOverride(ctx context.Context, tenantID string) string {
+	if f.redisReader == nil {
+		return ""
+	}
+	if err := f.redisReaderBreaker.allow(); err != nil {
+		return ""
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, f.config.RedisTimeout)
+	defer cancel()
+
+	redisKey, ok := f.config.redisKey(tenantID)
+	if !ok {
+		return ""
+	}
+	key := f.config.RedisKeyPrefix + "override:" + redisKey
+	assignment, err := f.redisReader.Get(callCtx, key).Result()
+	if err == redis.Nil {
+		f.reportOutcome(ctx, f.redisReaderBreaker, nil)
+		return ""
+	}
+	f.reportOutcome(ctx, f.redisReaderBreaker, err)
+	if err == nil {
+		assignment, err = decodeRedisValue(assignment)
+	}
+	if err != nil {
+		api.LogWarnf("Redis override lookup failed for tenant %s: %v", tenantID, err)
+		return ""
+	}
+
+	api.LogInfof("Redis override pins tenant %s to %s", tenantID, assignment)
+	return assignment
+}
+
+// resolves the tenant's cached assignment across the tiers, which is either a
+// plain shard ID or an encoded weighted split, and the tier it came from.
+// Also reports the expired memory entry the answer came in place of, "" when
+// there was none.
+func (f *ShardRouterFilter) lookupAssignment(ctx context.Context, tenantID string) (assignment, tier, expired string, err error) {
+	start := time.Now()
+
 	// Tier 1: Memory cache lookup
-	if shardID, found := f.lookupInMemoryCache(tenantID); found {
-		return shardID, nil
+	if f.config.EnableMemoryCache {
+		shardID, found, stale, previous := f.lookupInMemoryCache(tenantID)
+		recordTierCall(tierMemory, start)
+		if found {
+			result := resultHit
+			if stale {
+				result = resultStale
+				f.revalidate(tenantID, shardID)
+			}
+			recordTierResult(tierMemory, result)
+			lookupTraceFrom(ctx).tier(tierMemory, result, start)
+			recordLookup(tierMemory, start)
+			return shardID, tierMemory, "", nil
+		}
+		expired = previous
+		recordTierResult(tierMemory, resultMiss)
+		lookupTraceFrom(ctx).tier(tierMemory, resultMiss, start)
 	}
 
+	shardID, tier, redisResult, err := f.lookupBehindMemory(ctx, tenantID)
+	f.redisResult = redisResult
+
+	// Every tier below failed, an old answer beats none. A tenant that is
+	// known to be unmapped isn't an outage.
+	if err != nil && !errors.Is(err, errNoMapping) && f.config.ServeLastKnownGoodOnOutage {
+		if assignment, found := f.lastKnownGood(tenantID); found {
+			f.servedStale = true
+			recordTierResult(tierMemory, resultLastKnownGood)
+			lookupTraceFrom(ctx).note(tierMemory, resultLastKnownGood)
+			recordLookup(tierMemory, start)
+			f.config.log().warn("serving last known good assignment through an outage", "tenant", tenantID, "err", err)
+			return assignment, tierMemory, "", nil
+		}
+	}
+
+	recordLookup(tier, start)
+	return shardID, tier, expired, err
+}
+
+// resolves the tenant's assignment from Redis, then the mapping backend,
+// caching what it finds in the tiers above. Also reports the Redis result,
+// "" without the Redis tier.
+func (f *ShardRouterFilter) lookupBehindMemory(ctx context.Context, tenantID string) (shardID, tier, redisResult string, err error) {
 	// Tier 2: Redis cache lookup
-	shardID, err := f.lookupInRedisCache(tenantID)
-	if err != nil {
-		api.LogWarnf("Redis lookup failed for tenant %s: %v", tenantID, err)
-	} else if shardID != "" {
-		// Cache in memory for faster future lookups
-		f.cacheInMemory(tenantID, shardID)
-		return shardID, nil
+	if f.config.EnableRedisCache {
+		start := time.Now()
+		shardID, err := f.lookupInRedisCache(ctx, tenantID)
+		recordTierCall(tierRedis, start)
+		if err != nil {
+			redisResult = tierErrorResult(err)
+			f.config.log().warn("tier lookup failed", "tenant", tenantID, "tier", tierRedis, "err", err)
+		} else if shardID != "" {
+			redisResult = resultHit
+		} else {
+			redisResult = resultMiss
+		}
+		recordTierResult(tierRedis, redisResult)
+		lookupTraceFrom(ctx).tier(tierRedis, redisResult, start)
+
+		if redisResult == resultHit {
+			// Cache in memory for faster future lookups
+			f.cacheInMemory(tenantID, shardID, tierRedis, 0)
+			return shardID, tierRedis, redisResult, nil
+		}
+		// Whether Redis is healthy and just doesn't know the tenant, or broken
+		recordRedisFallthrough(redisResult)
 	}
 
-	// Tier 3: S3 lookup (source of truth)
-	shardID, err = f.lookupInS3(tenantID)
+	// Tier 3: S3 or file lookup (source of truth)
+	start := time.Now()
+	trace := lookupTraceFrom(ctx)
+	shardID, ttl, tier, err := f.lookupInBackend(ctx, tenantID)
 	if err != nil {
-		api.LogWarnf("S3 lookup failed for tenant %s: %v", tenantID, err)
-		return "", err
+		recordTierResult(tier, tierErrorResult(err))
+		trace.tier(tier, tierErrorResult(err), start)
+		f.config.log().warn("tier lookup failed", "tenant", tenantID, "tier", tier, "err", err)
+		return "", tierNone, redisResult, err
 	}
 
 	if shardID != "" {
-		// Cache in both Redis and memory
-		if err := f.cacheInRedis(tenantID, shardID); err != nil {
-			api.LogWarnf("Failed to cache in Redis: %v", err)
+		recordTierResult(tier, resultHit)
+		trace.tier(tier, resultHit, start)
+		// Cache in the enabled tiers
+		if f.config.EnableRedisCache {
+			if err := f.cacheInRedis(ctx, tenantID, shardID, ttl); err != nil {
+				f.config.log().warn("failed to cache in Redis", "tenant", tenantID, "err", err)
+			}
 		}
-		f.cacheInMemory(tenantID, shardID)
-		return shardID, nil
+		f.cacheInMemory(tenantID, shardID, tier, ttl)
+		return shardID, tier, redisResult, nil
 	}
 
 	// No mapping found
-	return "", fmt.Errorf("no shard mapping found for tenant: %s", tenantID)
+	recordTierResult(tier, resultMiss)
+	trace.tier(tier, resultMiss, start)
+	mappingNotFound.Inc()
+	return "", tierNone, redisResult, fmt.Errorf("%w: %s", errNoMapping, tenantID)
+}
+
+// metric result label for a failed tier lookup
+func tierErrorResult(err error) string {
+	var openErr *breakerOpenError
+	if errors.As(err, &openErr) {
+		return resultBreakerOpen
+	}
+	var saturatedErr *s3SaturatedError
+	if errors.As(err, &saturatedErr) {
+		return resultSaturated
+	}
+	if errors.Is(err, errLookupBudgetSpent) {
+		return resultSkipped
+	}
+	return resultError
+}
+
+// reports the outcome of a dependency call to its breaker. Calls aborted
+// because ctx, the lookup's, was canceled (usually the stream went away) say
+// nothing about the dependency's health.
+func (f *ShardRouterFilter) reportOutcome(ctx context.Context, b *circuitBreaker, err error) {
+	switch {
+	case err == nil:
+		b.success()
+	case ctx.Err() != nil:
+		b.abandon()
+	default:
+		b.failure()
+	}
 }
 
 // main entry point for processing requests
 func (f *ShardRouterFilter) DecodeHeaders(header api.RequestHeaderMap, endStream bool) api.StatusType {
-	if existingShardID, exists := header.Get("x-shard-id"); exists {
-		api.LogDebugf("x-shard-id header already present: %s", existingShardID)
+	if f.isResolveRequest(header.Path()) {
+		return f.serveResolve(header)
+	}
+
+	// Health checks and the like carry no tenant, leave them alone
+	if f.skipPath(header.Path()) {
+		f.stripRequestHeaders(header)
 		return api.Continue
 	}
 
-	// Extract tenant ID from request - try header first, then Host
-	var tenantID string
-	var err error
+	// The hop that set x-shard-id set the RequestHeaders too
+	if existingShardID, exists := header.Get("x-shard-id"); exists {
+		if f.trustsShardHeader(header) {
+			f.config.log().debug("x-shard-id already present", "shard", existingShardID)
+			return api.Continue
+		}
+		// Not from a trusted hop, so it must not reach the upstream either
+		header.Del("x-shard-id")
+		f.config.log().debug("ignoring untrusted x-shard-id", "shard", existingShardID)
+	}
 
-	// First, try to extract tenant from header
-	if headerTenantID, exists := header.Get(f.config.TenantHeaderName); exists && headerTenantID != "" {
-		tenantID = headerTenantID
-		api.LogDebugf("Extracted tenant ID from header %s: %s", f.config.TenantHeaderName, tenantID)
-	} else {
-		// Fallback to extracting tenant from Host header
-		if host, exists := header.Get(":authority"); exists {
-			tenantID, err = f.extractTenantFromHost(host)
-			if err != nil {
-				api.LogWarnf("Failed to extract tenant from host %s: %v", host, err)
+	if len(f.config.RequestHeaders) > 0 {
+		f.stripRequestHeaders(header)
+		f.requestHeader = header
+	}
+
+	// Pin the request to a shard for testing, skipping the lookup entirely
+	if f.config.AllowShardOverrideHeader {
+		overrideShardID, exists := header.Get(f.config.ShardOverrideHeaderName)
+		authorized := f.hasAdminToken(header)
+		header.Del(f.config.ShardOverrideHeaderName)
+		header.Del(f.config.AdminTokenHeaderName)
+
+		if exists && overrideShardID != "" {
+			if authorized {
+				f.setShard(overrideShardID)
+				f.setRequestHeaders()
+				f.config.log().info("shard overridden", "header", f.config.ShardOverrideHeaderName, "shard", overrideShardID)
 				return api.Continue
 			}
-			api.LogDebugf("Extracted tenant ID from host: %s", tenantID)
-		} else {
-			api.LogWarnf("Neither tenant header %s nor Host header found", f.config.TenantHeaderName)
+			f.config.log().warn("ignoring shard override without a valid admin token", "header", f.config.ShardOverrideHeaderName)
+		}
+	}
+
+	// Read first, streams routed by the connection cache are checked too
+	if f.config.ShardHintHeaderName != "" {
+		f.shardHint, _ = header.Get(f.config.ShardHintHeaderName)
+	}
+
+	// A previous stream of the connection already found the shard
+	if key, ok := f.connectionKey(header); ok {
+		if f.routeFromConnection(key) {
 			return api.Continue
 		}
+		f.connKey = key
 	}
 
-	if tenantID == "" {
-		api.LogWarnf("Unable to determine tenant ID")
-		return api.Continue
+	// Tenants split by environment are cached and matched as "tenant:environment"
+	environment := f.extractEnvironment(header)
+	if environment != "" {
+		f.config.log().debug("extracted environment", "environment", environment)
 	}
 
-	api.LogDebugf("Extracted tenant ID: %s", tenantID)
+	// Weighted assignments stick to the configured headers, or the lookup key without them
+	stickyKey := f.stickyKeyOf(header)
 
-	// Perform orchestrated lookup for shard ID
-	shardID, err := f.orchestratedLookup(tenantID)
+	// The tenant is in the body, hold the request until DecodeData has it all
+	if f.config.TenantExtractionMode == TenantExtractionBody {
+		contentType, _ := header.Get("content-type")
+		if endStream || !f.bodyContentTypeAllowed(contentType) {
+			extractionFailures.Inc()
+			f.config.log().debug("request has no body to extract the tenant from", "event", eventExtractionFailed, "content_type", contentType)
+			f.routeAnonymous()
+			return api.Continue
+		}
+		f.awaitingBody = true
+		f.environment, f.stickyKey = environment, stickyKey
+		return api.StopAndBuffer
+	}
+
+	tenantID, err := f.extractTenantID(header)
 	if err != nil {
-		api.LogWarnf("Failed to lookup shard for tenant %s: %v", tenantID, err)
+		extractionFailures.Inc()
+		if !f.routeAnonymous() {
+			f.config.log().warn("unable to determine tenant", "event", eventExtractionFailed, "err", err)
+		}
 		return api.Continue
 	}
+	tenantID, valid := f.normalizeTenantID(tenantID)
+	if !valid {
+		return f.rejectTenant(tenantID)
+	}
 
-	// Store shard ID for response headers
-	f.currentShardID = shardID
-	api.LogDebugf("Found shard ID: %s for tenant: %s", shardID, tenantID)
+	if log := f.config.log(); log.enabled(api.Debug) {
+		log.debug("extracted tenant", "tenant", tenantID)
+	}
+	return f.startLookup(tenantID, environment, stickyKey)
+}
+
+// returns the key hashed to pick among weighted shards: the HashHeaders
+// values joined by NUL, so no two distinct combinations collide, or else
+// StickinessHeader. Empty when none of them are present.
+func (f *ShardRouterFilter) stickyKeyOf(header api.RequestHeaderMap) string {
+	if len(f.config.HashHeaders) == 0 {
+		key, _ := header.Get(f.config.StickinessHeader)
+		return key
+	}
+
+	var b strings.Builder
+	present := false
+	for i, name := range f.config.HashHeaders {
+		if i > 0 {
+			b.WriteByte(0)
+		}
+		if value, ok := header.Get(name); ok {
+			b.WriteString(value)
+			present = true
+		}
+	}
+	if !present {
+		return ""
+	}
+	return b.String()
+}
+
+// reports whether an inbound x-shard-id was set by a trusted hop, as vouched
+// for by TrustShardHeaderName. Without it every inbound x-shard-id is trusted.
+func (f *ShardRouterFilter) trustsShardHeader(header api.RequestHeaderMap) bool {
+	if f.config.TrustShardHeaderName == "" {
+		return true
+	}
+	value, exists := header.Get(f.config.TrustShardHeaderName)
+	if !exists {
+		return false
+	}
+	return f.config.TrustShardHeaderValue == "" || value == f.config.TrustShardHeaderValue
+}
+
+// applies TenantIDLowercase and reports whether the tenant matches
+// TenantIDPattern, so garbage from scanners never becomes a cache key
+func (f *ShardRouterFilter) normalizeTenantID(tenantID string) (string, bool) {
+	if f.config.TenantIDLowercase {
+		tenantID = strings.ToLower(tenantID)
+	}
+	if f.config.tenantIDPattern != nil && !f.config.tenantIDPattern.MatchString(tenantID) {
+		return tenantID, false
+	}
+	return tenantID, true
+}
 
+// handles a tenant rejected by normalizeTenantID like a request without one,
+// unless FailureMode is closed, which rejects it with 400
+func (f *ShardRouterFilter) rejectTenant(tenantID string) api.StatusType {
+	invalidTenants.Inc()
+	f.config.log().warn("rejected tenant not matching tenant_id_pattern", "tenant", tenantID)
+
+	if f.config.FailureMode == FailureModeClosed && !f.config.DryRun {
+		f.callbacks.DecoderFilterCallbacks().SendLocalReply(400, "invalid tenant\n", nil, 0, "shard_router_invalid_tenant")
+		return api.LocalReply
+	}
+	f.routeAnonymous()
 	return api.Continue
 }
 
-// DecodeData handles request body processing
+// assigns AnonymousShardID to a request without a tenant, reporting whether
+// one is configured. Lookup failures for a known tenant never get here.
+func (f *ShardRouterFilter) routeAnonymous() bool {
+	if f.config.inMaintenance() {
+		f.setShard(f.config.MaintenanceShardID)
+		f.setRequestHeaders()
+		f.config.log().debug("maintenance mode, routing request without a tenant to the holding shard", "shard", f.config.MaintenanceShardID)
+		return true
+	}
+	if f.config.AnonymousShardID == "" {
+		return false
+	}
+	f.setShard(f.config.AnonymousShardID)
+	f.setRequestHeaders()
+	f.config.log().debug("no tenant in request, routing to anonymous shard", "shard", f.config.AnonymousShardID)
+	return true
+}
+
+// runs the lookup in the background and resumes decoding once it is done
+func (f *ShardRouterFilter) startLookup(tenantID, environment, stickyKey string) api.StatusType {
+	f.tenantID, f.environment = tenantID, environment
+
+	// Nothing can block, resolve on the worker thread
+	if f.memoryCanAnswer(f.lookupKey(tenantID, environment)) {
+		if !f.finishLookup(f.resolveShard(tenantID, environment, stickyKey)) {
+			return api.LocalReply
+		}
+		return api.Continue
+	}
+
+	// The lookup may block on Redis or S3, so run it off the Envoy worker
+	// thread. This also lets OnDestroy cancel it if the client goes away.
+	go func() {
+		decoder := f.callbacks.DecoderFilterCallbacks()
+		defer decoder.RecoverPanic()
+
+		err := f.resolveShard(tenantID, environment, stickyKey)
+
+		// The stream was destroyed while the lookup was in flight
+		if f.ctx.Err() != nil {
+			return
+		}
+		if f.finishLookup(err) {
+			decoder.Continue(api.Continue)
+		}
+	}()
+
+	return api.Running
+}
+
+// applies the failure mode to a finished lookup, replying 503 when it
+// rejects the request and setting the request headers otherwise. Reports
+// whether the request goes on.
+func (f *ShardRouterFilter) finishLookup(err error) bool {
+	// A dry run never rejects requests, whatever the failure mode
+	if err != nil && f.config.FailureMode == FailureModeClosed && !f.config.DryRun && !errors.Is(err, errNoMapping) {
+		f.sendUnavailable(f.callbacks.DecoderFilterCallbacks(), err)
+		return false
+	}
+	f.setRequestHeaders()
+	return true
+}
+
+// returns the key orchestratedLookup looks the tenant up by, after aliases
+func (f *ShardRouterFilter) lookupKey(tenantID, environment string) string {
+	if f.refresher != nil {
+		tenantID = f.refresher.canonicalTenant(tenantID)
+	}
+	return compoundKey(tenantID, environment)
+}
+
+// reports whether orchestratedLookup can answer key without I/O: it is in
+// maintenance, or a fresh memory entry answers before any tier that may block
+func (f *ShardRouterFilter) memoryCanAnswer(key string) bool {
+	if f.config.inMaintenance() {
+		return true
+	}
+	if f.memoryCache == nil || f.config.EnableRedisOverrides || f.config.MappingOverlayPrefix != "" {
+		return false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	entry, found := f.memoryCache.Peek(f.config.cacheKey(key))
+	return found && !f.memoryEntryExpired(entry)
+}
+
+// performs the orchestrated lookup and stores the shard for this request
+func (f *ShardRouterFilter) resolveShard(tenantID, environment, stickyKey string) error {
+	ctx := f.ctx
+	var trace *lookupTrace
+	if f.config.sampleLookup() {
+		trace = &lookupTrace{}
+		ctx = withLookupTrace(ctx, trace)
+	}
+
+	start := time.Now()
+	selection, tier, err := f.orchestratedLookup(ctx, tenantID, environment, stickyKey)
+	f.lookupElapsed, f.lookupTier = time.Since(start), tier
+	trace.write(tenantID, environment, selection, tier, f.lookupElapsed, err)
+	if err != nil {
+		if f.ctx.Err() != nil {
+			f.config.log().debug("lookup canceled, stream destroyed", "tenant", tenantID)
+		} else if errors.Is(err, errNoMapping) {
+			f.config.log().warn("no shard mapping for tenant", "event", eventMappingNotFound, "tenant", tenantID,
+				"environment", environment, "redis", f.redisResult, "latency", f.lookupElapsed)
+		} else {
+			f.config.log().warn("lookup failed", "tenant", tenantID, "environment", environment,
+				"redis", f.redisResult, "latency", f.lookupElapsed, "err", err)
+		}
+		return err
+	}
+
+	f.setShard(selection.shard)
+	f.shardCandidates = selection.candidates()
+	f.rememberForConnection()
+	f.followShardHint(tenantID, selection.shard, f.shardCandidates)
+	if log := f.config.log(); log.enabled(api.Debug) {
+		log.debug("lookup resolved", "tenant", tenantID, "environment", environment,
+			"shard", selection.shard, "tier", tier, "redis", f.redisResult, "latency", f.lookupElapsed)
+	}
+	return nil
+}
+
+// stores the shard for the response headers and, with EmitRouteMetadata,
+// publishes it as dynamic metadata. The route cache is cleared so routes
+// matching on the metadata are selected again once decoding continues.
+func (f *ShardRouterFilter) setShard(shardID string) {
+	f.currentShardID = shardID
+	if !f.config.EmitRouteMetadata || f.config.DryRun {
+		return
+	}
+	f.callbacks.StreamInfo().DynamicMetadata().Set(routeMetadataNamespace, routeMetadataKey, shardID)
+	f.callbacks.ClearRouteCache()
+}
+
+// rejects the request with 503 because the shard couldn't be resolved. When
+// a breaker is open, Retry-After tells clients how long it stays open.
+func (f *ShardRouterFilter) sendUnavailable(decoder api.DecoderFilterCallbacks, err error) {
+	headers := map[string][]string{}
+
+	var openErr *breakerOpenError
+	if errors.As(err, &openErr) {
+		seconds := max(int(math.Ceil(openErr.retryAfter.Seconds())), 1)
+		headers["retry-after"] = []string{strconv.Itoa(seconds)}
+	}
+
+	decoder.SendLocalReply(503, "shard lookup unavailable\n", headers, 0, "shard_router_lookup_unavailable")
+}
+
+// reports whether path matches one of the configured SkipPaths, ignoring the query
+func (f *ShardRouterFilter) skipPath(path string) bool {
+	if len(f.config.SkipPaths) == 0 {
+		return false
+	}
+	path, _, _ = strings.Cut(path, "?")
+	for _, skip := range f.config.SkipPaths {
+		if prefix, ok := strings.CutSuffix(skip, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the admin token header against the configured admin token
+func (f *ShardRouterFilter) hasAdminToken(header api.RequestHeaderMap) bool {
+	if f.config.AdminToken == "" {
+		return false
+	}
+	token, exists := header.Get(f.config.AdminTokenHeaderName)
+	return exists && subtle.ConstantTimeCompare([]byte(token), []byte(f.config.AdminToken)) == 1
+}
+
+// DecodeData handles request body processing, buffering the body when the
+// tenant is extracted from it
 func (f *ShardRouterFilter) DecodeData(buffer api.BufferInstance, endStream bool) api.StatusType {
-	return api.Continue
+	if !f.awaitingBody {
+		return api.Continue
+	}
+
+	if buffer.Len() > f.config.MaxBodyBytes {
+		f.awaitingBody = false
+		extractionFailures.Inc()
+		f.config.log().warn("request body too large to extract the tenant from", "event", eventExtractionFailed, "max_body_bytes", f.config.MaxBodyBytes)
+		f.routeAnonymous()
+		return api.Continue
+	}
+	if !endStream {
+		return api.StopAndBuffer
+	}
+	f.awaitingBody = false
+
+	tenantID, err := lookupJSONPath(buffer.Bytes(), f.config.tenantBodyPath)
+	if err != nil || tenantID == "" {
+		extractionFailures.Inc()
+		if !f.routeAnonymous() {
+			f.config.log().warn("unable to determine tenant from body", "event", eventExtractionFailed, "path", f.config.TenantBodyJSONPath, "err", err)
+		}
+		return api.Continue
+	}
+
+	tenantID, valid := f.normalizeTenantID(tenantID)
+	if !valid {
+		return f.rejectTenant(tenantID)
+	}
+
+	api.LogDebugf("Extracted tenant ID from body: %s", tenantID)
+	return f.startLookup(tenantID, f.environment, f.stickyKey)
 }
 
 // DecodeTrailers handles request trailers
 func (f *ShardRouterFilter) DecodeTrailers(trailers api.RequestTrailerMap) api.StatusType {
+	// The body ended with trailers instead of endStream, which body
+	// extraction doesn't support
+	if f.awaitingBody {
+		f.awaitingBody = false
+		extractionFailures.Inc()
+		f.config.log().warn("request with trailers, not extracting the tenant from its body", "event", eventExtractionFailed)
+		f.routeAnonymous()
+	}
 	return api.Continue
 }
 
 // EncodeHeaders handles response headers
 func (f *ShardRouterFilter) EncodeHeaders(header api.ResponseHeaderMap, endStream bool) api.StatusType {
-	// Add x-shard-id header if we found a shard for this request
-	if f.currentShardID != "" {
+	// Only report what routing would have done, without touching the response
+	if f.config.DryRun {
+		if f.currentShardID != "" {
+			recordDryRunShard(f.currentShardID)
+			api.LogInfof("Dry run: request would be routed to shard %s", f.currentShardID)
+		}
+		return api.Continue
+	}
+
+	// Add x-shard-id header if we found a shard for this request. With
+	// ShardInTrailers it waits for EncodeTrailers, unless the response ends
+	// here: a gRPC trailers-only response carries its trailers as headers.
+	if f.currentShardID != "" && (!f.config.ShardInTrailers || endStream) {
 		header.Set("x-shard-id", f.currentShardID)
 		api.LogDebugf("Added x-shard-id response header: %s", f.currentShardID)
+		if len(f.shardCandidates) > 0 {
+			header.Set("x-shard-candidates", strings.Join(f.shardCandidates, ","))
+		}
+		if f.servedStale {
+			header.Set("x-shard-stale", "true")
+		}
+	}
+
+	// Which generation of the mapping is loaded, for following rollouts
+	if f.config.MappingVersionHeader != "" && f.refresher != nil {
+		if version := f.refresher.version(); version != "" {
+			header.Set(f.config.MappingVersionHeader, version)
+		}
+	}
+
+	// Debugging aid only, tells clients about our tiers and their latency
+	if f.config.EmitTimingHeader && f.lookupTier != "" {
+		ms := float64(f.lookupElapsed) / float64(time.Millisecond)
+		header.Set("x-shard-lookup-ms", strconv.FormatFloat(ms, 'f', 3, 64))
+		header.Set("x-shard-lookup-tier", f.lookupTier)
+		if f.redisResult != "" {
+			header.Set("x-shard-lookup-redis", f.redisResult)
+		}
 	}
 	return api.Continue
 }
@@ -262,6 +1438,16 @@ func (f *ShardRouterFilter) EncodeData(buffer api.BufferInstance, endStream bool
 
 // EncodeTrailers handles response trailers
 func (f *ShardRouterFilter) EncodeTrailers(trailers api.ResponseTrailerMap) api.StatusType {
+	if f.config.ShardInTrailers && !f.config.DryRun && f.currentShardID != "" {
+		trailers.Set("x-shard-id", f.currentShardID)
+		api.LogDebugf("Added x-shard-id response trailer: %s", f.currentShardID)
+		if len(f.shardCandidates) > 0 {
+			trailers.Set("x-shard-candidates", strings.Join(f.shardCandidates, ","))
+		}
+		if f.servedStale {
+			trailers.Set("x-shard-stale", "true")
+		}
+	}
 	return api.Continue
 }
 
@@ -285,10 +1471,9 @@ func (f *ShardRouterFilter) OnLogDownstreamPeriodic(reqHeader api.RequestHeaderM
 
 // OnDestroy is called when the filter is being destroyed
 func (f *ShardRouterFilter) OnDestroy(reason api.DestroyReason) {
-	// Cleanup resources
-	if f.redisClient != nil {
-		f.redisClient.Close()
-	}
+	// Abort lookups still in flight for this stream. The clients are shared
+	// with other streams and outlive this filter.
+	f.cancel()
 
 	api.LogDebugf("ShardRouterFilter destroyed, reason: %v", reason)
 }
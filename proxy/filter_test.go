@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTenantObjectKey(t *testing.T) {
+	tests := []struct {
+		template, tenant string
+		want             string
+		ok               bool
+	}{
+		{"mappings/{tenant}", "acme", "mappings/acme", true},
+		{"mappings/{tenant}.json", "acme", "mappings/acme.json", true},
+		{"mappings/{tenant}", "a/b", "mappings/a%2Fb", true},
+		{"mappings/{tenant}", "...", "mappings/...", true},
+		{"mappings/{tenant}", "..", "", false},
+		{"mappings/{tenant}", ".", "", false},
+		{"mappings/{tenant}/shard", "..", "", false},
+		{"mappings/.{tenant}", ".", "", false},
+		{"mappings/{tenant}", "../other", "mappings/..%2Fother", true},
+	}
+	for _, tt := range tests {
+		got, ok := tenantObjectKey(tt.template, tt.tenant)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("tenantObjectKey(%q, %q) = %q, %v; want %q, %v", tt.template, tt.tenant, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// A request's headers, keyed by lowercase name
+type fakeHeaderMap struct {
+	api.RequestHeaderMap
+	values map[string]string
+}
+
+// compares names without lowercasing them, so a lookup costs no allocation
+func (h *fakeHeaderMap) Get(name string) (string, bool) {
+	for key, value := range h.values {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (h *fakeHeaderMap) Values(name string) []string {
+	if value, ok := h.Get(name); ok {
+		return []string{value}
+	}
+	return nil
+}
+
+func (h *fakeHeaderMap) Set(name, value string) { h.values[strings.ToLower(name)] = value }
+func (h *fakeHeaderMap) Del(name string)        { delete(h.values, strings.ToLower(name)) }
+func (h *fakeHeaderMap) Path() string           { return h.values[":path"] }
+func (h *fakeHeaderMap) Host() string           { return h.values[":authority"] }
+
+// Envoy's side of the stream, reporting each time decoding continues
+type fakeCallbacks struct {
+	api.FilterCallbackHandler
+	decoder fakeDecoder
+}
+
+type fakeDecoder struct {
+	api.DecoderFilterCallbacks
+	continued chan api.StatusType
+}
+
+func (c *fakeCallbacks) DecoderFilterCallbacks() api.DecoderFilterCallbacks { return &c.decoder }
+func (d *fakeDecoder) Continue(status api.StatusType)                       { d.continued <- status }
+func (d *fakeDecoder) RecoverPanic()                                        {}
+
+// Redis holding values, by key. Writes are dropped.
+type fakeRedis struct {
+	redis.Cmdable
+	values map[string]string
+}
+
+func (r *fakeRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	if value, ok := r.values[key]; ok {
+		return redis.NewStringResult(value, nil)
+	}
+	return redis.NewStringResult("", redis.Nil)
+}
+
+func (r *fakeRedis) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	return nil, nil
+}
+
+// S3 serving the same mapping document for every key
+type fakeS3 struct {
+	document string
+}
+
+func (s *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(s.document))}, nil
+}
+
+const benchMappingDocument = `{"mappings": [{"tenant_id": "other", "shard_id": "shard-2"}, {"tenant_id": "acme", "shard_id": "shard-1"}]}`
+
+// builds a filter for the tier a lookup of acme is answered from: memory,
+// redis or, when both miss, the S3 mapping
+func newBenchFilter(tb testing.TB, answeredBy string) *ShardRouterFilter {
+	tb.Helper()
+	conf := parseTestConfig(tb, map[string]interface{}{
+		"tenant_extraction_mode": "header",
+		"tenant_header_name":     "X-Tenant-ID",
+		"s3_bucket":              "mappings",
+		"s3_key":                 "tenants.json",
+		"redis_addr":             "localhost:6379",
+	})
+	memoryCache, err := newMemoryCache(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	redisValues := map[string]string{}
+	if answeredBy == tierRedis {
+		key, _ := conf.redisKey("acme")
+		redisValues[conf.RedisKeyPrefix+key] = conf.encodeRedisValue("shard-1")
+	}
+	fakeRedis := &fakeRedis{values: redisValues}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	f := &ShardRouterFilter{
+		ctx:         ctx,
+		cancel:      cancel,
+		callbacks:   &fakeCallbacks{decoder: fakeDecoder{continued: make(chan api.StatusType, 1)}},
+		config:      conf,
+		memoryCache: memoryCache,
+		redisClient: fakeRedis,
+		redisReader: fakeRedis,
+		s3Client:    &fakeS3{document: benchMappingDocument},
+	}
+	if answeredBy == tierMemory {
+		f.cacheInMemory("acme", "shard-1", tierS3, 0)
+	}
+	return f
+}
+
+// keeps every lookup from being cached in memory, so each one is answered
+// by the same tier
+func (f *ShardRouterFilter) forgetLookups() {
+	f.memoryCache.Remove(f.config.cacheKey("acme"))
+}
+
+var benchLookupTiers = []string{tierMemory, tierRedis, tierS3}
+
+func BenchmarkOrchestratedLookup(b *testing.B) {
+	for _, answeredBy := range benchLookupTiers {
+		b.Run(answeredBy, func(b *testing.B) {
+			f := newBenchFilter(b, answeredBy)
+			b.ReportAllocs()
+			for range b.N {
+				selection, tier, err := f.orchestratedLookup(f.ctx, "acme", "", "")
+				if err != nil || selection.shard != "shard-1" || tier != answeredBy {
+					b.Fatalf("got %q from %q, %v; want shard-1 from %q", selection.shard, tier, err, answeredBy)
+				}
+				if answeredBy != tierMemory {
+					f.forgetLookups()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeHeaders(b *testing.B) {
+	for _, answeredBy := range benchLookupTiers {
+		b.Run(answeredBy, func(b *testing.B) {
+			f := newBenchFilter(b, answeredBy)
+			header := &fakeHeaderMap{values: map[string]string{":path": "/orders", "x-tenant-id": "acme"}}
+			continued := f.callbacks.(*fakeCallbacks).decoder.continued
+			b.ReportAllocs()
+			for range b.N {
+				status := f.DecodeHeaders(header, true)
+				if status == api.Running {
+					status = <-continued
+				}
+				if status != api.Continue || f.currentShardID != "shard-1" {
+					b.Fatalf("got status %v, shard %q; want to continue to shard-1", status, f.currentShardID)
+				}
+				if answeredBy != tierMemory {
+					f.forgetLookups()
+				}
+			}
+		})
+	}
+}
+
+// A fresh memory entry is resolved on the worker thread, it must not cost
+// an allocation per request
+func TestMemoryHitAllocations(t *testing.T) {
+	f := newBenchFilter(t, tierMemory)
+	if allocs := testing.AllocsPerRun(100, func() {
+		f.orchestratedLookup(f.ctx, "acme", "", "")
+	}); allocs != 0 {
+		t.Errorf("orchestratedLookup allocated %v times per memory hit, want 0", allocs)
+	}
+
+	header := &fakeHeaderMap{values: map[string]string{":path": "/orders", "x-tenant-id": "acme"}}
+	if allocs := testing.AllocsPerRun(100, func() {
+		f.DecodeHeaders(header, true)
+	}); allocs != 0 {
+		t.Errorf("DecodeHeaders allocated %v times per memory hit, want 0", allocs)
+	}
+}
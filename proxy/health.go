@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// Returned when the resolved shard is unhealthy and UnhealthyShardPolicy
+// found nowhere else to send the request
+type unhealthyShardError struct {
+	shard string
+}
+
+func (e *unhealthyShardError) Error() string {
+	return fmt.Sprintf("shard %s is unhealthy", e.shard)
+}
+
+// Polls the Redis set of unhealthy shards. Watchers are process-wide, one per
+// Redis primary and key, and filters only read the last set polled.
+type unhealthyShardWatcher struct {
+	key      string
+	client   redis.Cmdable
+	interval time.Duration
+	timeout  time.Duration
+	shards   atomic.Pointer[map[string]struct{}]
+
+	// Closed to stop run, which closes done once it has returned
+	done     chan struct{}
+	stopping chan struct{}
+}
+
+var unhealthyWatchers sync.Map // "addr/key" -> *unhealthyShardWatcher
+
+// returns the watcher for the configured set, starting it on first use
+func ensureUnhealthyShardWatcher(conf *PluginConfig) *unhealthyShardWatcher {
+	id := conf.RedisAddr + "/" + conf.UnhealthyShardsKey
+	if w, ok := unhealthyWatchers.Load(id); ok {
+		return w.(*unhealthyShardWatcher)
+	}
+
+	w := &unhealthyShardWatcher{
+		key:      conf.UnhealthyShardsKey,
+		interval: conf.UnhealthyShardsRefreshInterval,
+		timeout:  conf.RedisTimeout,
+
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+	if existing, loaded := unhealthyWatchers.LoadOrStore(id, w); loaded {
+		return existing.(*unhealthyShardWatcher)
+	}
+
+	w.client = sharedRedisClient(conf, conf.RedisAddr)
+	go w.run()
+	return w
+}
+
+// polls the set every interval until stopped
+func (w *unhealthyShardWatcher) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		select {
+		case <-ticker.C:
+		case <-w.stopping:
+			return
+		}
+	}
+}
+
+// reads the set, keeping the previous one if Redis fails
+func (w *unhealthyShardWatcher) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	members, err := w.client.SMembers(ctx, w.key).Result()
+	if err != nil {
+		api.LogWarnf("Failed to read unhealthy shards from %s, keeping the last set: %v", w.key, err)
+		return
+	}
+
+	shards := make(map[string]struct{}, len(members))
+	for _, shard := range members {
+		shards[shard] = struct{}{}
+	}
+	if previous := w.shards.Swap(&shards); previous == nil || !sameShards(*previous, shards) {
+		api.LogInfof("Unhealthy shards: [%s]", strings.Join(members, ", "))
+	}
+}
+
+// reports whether two shard sets hold the same shards
+func sameShards(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for shard := range a {
+		if _, ok := b[shard]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// reports whether shardID was in the set when it was last read. Nothing is
+// unhealthy until the first read succeeds, or without a watcher.
+func (w *unhealthyShardWatcher) unhealthy(shardID string) bool {
+	if w == nil {
+		return false
+	}
+	shards := w.shards.Load()
+	if shards == nil {
+		return false
+	}
+	_, ok := (*shards)[shardID]
+	return ok
+}
+
+// stops polling and waits for run to return
+func (w *unhealthyShardWatcher) stop() {
+	close(w.stopping)
+	<-w.done
+	api.LogDebugf("Stopped unhealthy shard watcher for %s", w.key)
+}
+
+// applies UnhealthyShardPolicy when the shard selected from assignment is
+// unhealthy, returning the selection to use instead. Unhealthy weighted
+// shards and replicas are dropped from every selection.
+func (f *ShardRouterFilter) avoidUnhealthyShard(assignment, stickyKey string, selection shardSelection) (shardSelection, error) {
+	if f.unhealthyShards == nil {
+		return selection, nil
+	}
+	selection.weighted = f.healthyShards(selection.weighted)
+	selection.replicas = f.healthyShards(selection.replicas)
+	shardID := selection.shard
+	if !f.unhealthyShards.unhealthy(shardID) {
+		return selection, nil
+	}
+
+	switch f.config.UnhealthyShardPolicy {
+	case UnhealthyShardPolicyAlternate:
+		if alternate := f.healthyAlternate(assignment, stickyKey); alternate != "" {
+			recordUnhealthyShard(shardID, UnhealthyShardPolicyAlternate)
+			f.config.log().info("shard unhealthy, routing to an alternate", "shard", shardID, "alternate", alternate)
+			selection.shard = alternate
+			return selection, nil
+		}
+	case UnhealthyShardPolicyFallback:
+		if !f.unhealthyShards.unhealthy(f.config.UnhealthyFallbackShardID) {
+			recordUnhealthyShard(shardID, UnhealthyShardPolicyFallback)
+			f.config.log().info("shard unhealthy, routing to the fallback shard", "shard", shardID, "fallback", f.config.UnhealthyFallbackShardID)
+			return shardSelection{shard: f.config.UnhealthyFallbackShardID}, nil
+		}
+	}
+
+	recordUnhealthyShard(shardID, UnhealthyShardPolicyFail)
+	return shardSelection{}, &unhealthyShardError{shard: shardID}
+}
+
+// picks another shard of the assignment: one of its healthy weighted shards
+// by stickyKey, as selectShard does among all of them, else one of its
+// healthy replicas, also by stickyKey. Returns "" when there is none.
+func (f *ShardRouterFilter) healthyAlternate(assignment, stickyKey string) string {
+	parsed, err := parseAssignment(assignment)
+	if err != nil {
+		return ""
+	}
+
+	var healthy []WeightedShard
+	for _, shard := range parsed.WeightedShards {
+		if shard.Weight > 0 && !f.unhealthyShards.unhealthy(shard.ShardID) {
+			healthy = append(healthy, shard)
+		}
+	}
+	if shardID, err := pickStickyShard(healthy, stickyKey); err == nil {
+		return shardID
+	}
+
+	return pickStickyReplica(f.healthyShards(parsed.ReplicaShardIDs), stickyKey)
+}
+
+// returns the shards not in the unhealthy set
+func (f *ShardRouterFilter) healthyShards(shards []string) []string {
+	var healthy []string
+	for _, shard := range shards {
+		if !f.unhealthyShards.unhealthy(shard) {
+			healthy = append(healthy, shard)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,35 @@
+package main
+
+import "slices"
+
+// shard_hints_total results
+const (
+	hintMatch     = "match"     // the hint is the resolved shard
+	hintCandidate = "candidate" // the hint is another candidate and was followed
+	hintMismatch  = "mismatch"  // the hint isn't a usable candidate and was ignored
+)
+
+// compares the client's shard hint with the resolved shard and its
+// candidates, whether just looked up or remembered for the connection. A
+// hint naming another candidate is followed unless that shard is draining.
+// Anything else is counted and logged as stale, and the resolved shard kept.
+// The connection cache only ever remembers the resolved shard, so hints
+// never outlive their stream.
+func (f *ShardRouterFilter) followShardHint(tenantID, shard string, candidates []string) {
+	hint := f.shardHint
+	switch {
+	case hint == "", f.lookupTier == tierMaintenance:
+		// Maintenance routes past the mapping the hint is checked against
+		return
+	case hint == shard:
+		recordShardHint(hintMatch)
+	case slices.Contains(candidates, hint) && f.config.DrainShards[hint] == 0:
+		recordShardHint(hintCandidate)
+		f.config.log().debug("following shard hint", "tenant", tenantID, "hint", hint, "shard", shard)
+		f.setShard(hint)
+	default:
+		recordShardHint(hintMismatch)
+		f.config.log().info("ignoring shard hint that isn't a candidate", "tenant", tenantID, "hint", hint,
+			"shard", shard, "tier", f.lookupTier)
+	}
+}
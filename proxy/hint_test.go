@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSelectionCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		assignment string
+		want       []string // the picked shard is checked separately
+	}{
+		{name: "single shard", assignment: "shard-a"},
+		{name: "replicas", assignment: `{"shard_id": "shard-a", "replica_shard_ids": ["shard-b", "shard-a"]}`, want: []string{"shard-a", "shard-b"}},
+		{
+			name:       "weighted",
+			assignment: `[{"shard_id": "shard-a", "weight": 1}, {"shard_id": "shard-b", "weight": 1}, {"shard_id": "shard-z", "weight": 0}]`,
+			want:       []string{"shard-a", "shard-b"},
+		},
+		{
+			name:       "weighted with replicas",
+			assignment: `{"weighted_shards": [{"shard_id": "shard-a", "weight": 1}, {"shard_id": "shard-b", "weight": 1}], "replica_shard_ids": ["shard-c"]}`,
+			want:       []string{"shard-a", "shard-b", "shard-c"},
+		},
+		{name: "one weighted shard", assignment: `[{"shard_id": "shard-a", "weight": 1}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := selectShard(tt.assignment, "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := selection.candidates()
+			if len(got) > 0 && got[0] != selection.shard {
+				t.Errorf("candidates %v don't start with the picked shard %s", got, selection.shard)
+			}
+			sorted := slices.Clone(got)
+			slices.Sort(sorted)
+			if !slices.Equal(sorted, tt.want) {
+				t.Errorf("got candidates %v, want %v in any order after the picked shard", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardHintOnConnectionCacheStream(t *testing.T) {
+	conf := parseTestConfig(t, map[string]interface{}{
+		"tenant_extraction_mode": "subdomain",
+		"connection_cache_ttl":   "1m",
+		"shard_hint_header_name": "X-Shard-Hint",
+	})
+	const key = "7/acme.example.com"
+	conf.connectionCache.add(key, connectionEntry{tenantID: "acme", shard: "shard-a", candidates: []string{"shard-a", "shard-b"}})
+
+	for _, tt := range []struct{ hint, want string }{
+		{"", "shard-a"},
+		{"shard-b", "shard-b"},
+		{"shard-x", "shard-a"},
+	} {
+		f := &ShardRouterFilter{config: conf, shardHint: tt.hint}
+		if !f.routeFromConnection(key) {
+			t.Fatal("not routed from the connection cache")
+		}
+		if f.currentShardID != tt.want {
+			t.Errorf("hint %q: routed to %s, want %s", tt.hint, f.currentShardID, tt.want)
+		}
+	}
+
+	// Following a hint doesn't change what the connection remembers
+	if entry, _ := conf.connectionCache.get(key); entry.shard != "shard-a" {
+		t.Errorf("connection remembers %s, want shard-a", entry.shard)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Half-life of the recent hit ratios in nanoseconds, set by the last
+// filter-level config parsed
+var hitRatioHalfLife atomic.Int64
+
+// Hit ratio over recent lookups, each weighted by 2^(-age/half-life). Unlike
+// a plain moving average it needs no start value, so the first lookups
+// aren't pulled towards one.
+type decayingRatio struct {
+	mu      sync.Mutex
+	hits    float64 // decayed weight of hits
+	total   float64 // decayed weight of all lookups
+	updated time.Time
+}
+
+func (r *decayingRatio) observe(hit bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.updated.IsZero() {
+		if halfLife := hitRatioHalfLife.Load(); halfLife > 0 {
+			decay := math.Exp2(-float64(now.Sub(r.updated)) / float64(halfLife))
+			r.hits, r.total = r.hits*decay, r.total*decay
+		}
+	}
+	r.updated = now
+	r.total++
+	if hit {
+		r.hits++
+	}
+}
+
+// the ratio, 0 before the first lookup. Decay scales hits and total alike,
+// so the ratio only moves with new lookups.
+func (r *decayingRatio) value() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.total == 0 {
+		return 0
+	}
+	return r.hits / r.total
+}
+
+var (
+	// Recent share of orchestrated lookups answered by the memory or Redis cache
+	recentCacheHits decayingRatio
+
+	// Recent share of each tier's lookups it answered
+	recentTierHits = map[string]*decayingRatio{
+		tierMemory: {},
+		tierRedis:  {},
+		tierS3:     {},
+		tierFile:   {},
+	}
+)
+
+// sets the half-life of the recent hit ratios
+func setHitRatioHalfLife(halfLife time.Duration) {
+	hitRatioHalfLife.Store(int64(halfLife))
+}
+
+// records a tier result in the tier's recent hit ratio. Served stale and
+// last known good entries count as hits, errors and skips as misses.
+func recordRecentTierResult(tier, result string) {
+	ratio, ok := recentTierHits[tier]
+	if !ok {
+		return
+	}
+	ratio.observe(result == resultHit || result == resultStale || result == resultLastKnownGood)
+}
+
+// the recent hit ratio gauges, overall and one per tier
+func recentHitRatioCollectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recent_cache_hit_ratio",
+			Help:      "Fraction of recent lookups answered by the memory or Redis cache, decaying with hit_ratio_half_life.",
+		}, recentCacheHits.value),
+	}
+	for tier, ratio := range recentTierHits {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "recent_tier_hit_ratio",
+			Help:        "Fraction of the tier's recent lookups it answered, decaying with hit_ratio_half_life.",
+			ConstLabels: prometheus.Labels{"tier": tier},
+		}, ratio.value))
+	}
+	return collectors
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+
+// Distinct assignments interned before new ones are left as they are. Most
+// tenants share a handful of shards, so this only caps a pathological
+// mapping where nearly every tenant has its own weighted split.
+const maxInternedAssignments = 4096
+
+// Canonical copies of assignment strings, so the snapshot and memory caches
+// of millions of tenants share one backing string per distinct shard
+// instead of one per tenant. Process-wide, and never shrinks.
+var (
+	internedMu          sync.RWMutex
+	internedAssignments = make(map[string]string)
+)
+
+// returns the canonical copy of assignment, adding it to the pool if there
+// is room
+func internAssignment(assignment string) string {
+	internedMu.RLock()
+	canonical, ok := internedAssignments[assignment]
+	internedMu.RUnlock()
+	if ok {
+		return canonical
+	}
+
+	internedMu.Lock()
+	defer internedMu.Unlock()
+	if canonical, ok := internedAssignments[assignment]; ok {
+		return canonical
+	}
+	if len(internedAssignments) >= maxInternedAssignments {
+		return assignment
+	}
+	internedAssignments[assignment] = assignment
+	return assignment
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// loads tenants spread over weighted pairs of shards, as a mapping refresh
+// does, and reports the heap the loaded map keeps alive
+func BenchmarkInternAssignment(b *testing.B) {
+	for _, tenants := range []int{10000, 100000} {
+		for _, shards := range []int{4, 64} {
+			for _, intern := range []bool{false, true} {
+				b.Run(fmt.Sprintf("tenants=%d/shards=%d/intern=%v", tenants, shards, intern), func(b *testing.B) {
+					b.Cleanup(func() { clear(internedAssignments) })
+
+					mappings := make([]TenantShardMapping, tenants)
+					for i := range mappings {
+						mappings[i] = TenantShardMapping{WeightedShards: []WeightedShard{
+							{ShardID: "shard-" + strconv.Itoa(i%shards), Weight: 50},
+							{ShardID: "shard-" + strconv.Itoa((i+1)%shards), Weight: 50},
+						}}
+					}
+
+					var heapInUse uint64
+					for range b.N {
+						b.StopTimer()
+						clear(internedAssignments)
+						before := heapAfterGC()
+						b.StartTimer()
+
+						loaded := make(map[string]string, tenants)
+						for i, mapping := range mappings {
+							assignment := mapping.assignment()
+							if intern {
+								assignment = internAssignment(assignment)
+							}
+							loaded["tenant-"+strconv.Itoa(i)] = assignment
+						}
+
+						b.StopTimer()
+						heapInUse = heapAfterGC() - before
+						runtime.KeepAlive(loaded)
+						b.StartTimer()
+					}
+					b.ReportMetric(float64(heapInUse), "heap-bytes")
+					b.ReportMetric(float64(heapInUse)/float64(tenants), "heap-bytes/tenant")
+				})
+			}
+		}
+	}
+}
+
+// returns the heap in use once everything unreachable is collected
+func heapAfterGC() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Unknown shards named in the log line of a load, the count covers the rest
+const maxUnknownShardsLogged = 10
+
+// Returned by refresh when a load references more unknown shards than
+// MaxUnknownShardReferences allows
+type unknownShardsError struct {
+	references int
+	limit      int
+}
+
+func (e *unknownShardsError) Error() string {
+	return fmt.Sprintf("%d mappings reference shards missing from known_shards, more than the %d allowed", e.references, e.limit)
+}
+
+// counts the mappings and patterns whose assignment references a shard
+// outside KnownShards, logging which shards those are. A mapping naming
+// several unknown shards counts once.
+func checkKnownShards(conf *PluginConfig, mapping string, shards map[string]string, patterns []patternRule) int {
+	unknown := make(map[string]int) // shard -> mappings referencing it
+	references := 0
+	check := func(assignment string) {
+		parsed, err := parseAssignment(assignment)
+		if err != nil {
+			return
+		}
+		referenced := parsed.ReplicaShardIDs
+		if parsed.ShardID != "" {
+			referenced = append(referenced, parsed.ShardID)
+		}
+		for _, shard := range parsed.WeightedShards {
+			referenced = append(referenced, shard.ShardID)
+		}
+
+		found := false
+		for _, shardID := range referenced {
+			if _, ok := conf.knownShards[shardID]; !ok {
+				unknown[shardID]++
+				found = true
+			}
+		}
+		if found {
+			references++
+		}
+	}
+	for _, assignment := range shards {
+		check(assignment)
+	}
+	for _, rule := range patterns {
+		check(rule.entry.assignment)
+	}
+
+	recordInvalidShardReferences(mapping, references)
+	if references == 0 {
+		return 0
+	}
+
+	names := make([]string, 0, len(unknown))
+	for shardID := range unknown {
+		names = append(names, shardID)
+	}
+	sort.Strings(names)
+	listed := make([]string, 0, min(len(names), maxUnknownShardsLogged))
+	for _, shardID := range names[:min(len(names), maxUnknownShardsLogged)] {
+		listed = append(listed, fmt.Sprintf("%s (%d)", shardID, unknown[shardID]))
+	}
+	more := ""
+	if len(names) > maxUnknownShardsLogged {
+		more = fmt.Sprintf(" and %d more", len(names)-maxUnknownShardsLogged)
+	}
+	api.LogWarnf("%d mappings in %s reference shards missing from known_shards: %s%s",
+		references, mapping, strings.Join(listed, ", "), more)
+	return references
+}
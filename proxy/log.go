@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Accepted log_level values
+var logLevels = map[string]api.LogType{
+	"trace":    api.Trace,
+	"debug":    api.Debug,
+	"info":     api.Info,
+	"warn":     api.Warn,
+	"error":    api.Error,
+	"critical": api.Critical,
+}
+
+// Writes structured messages to the Envoy log as a message followed by
+// logfmt key=value fields, e.g.
+//
+//	lookup resolved tenant=acme shard=shard-2 tier=redis latency=1.2ms
+//
+// Messages below the configured level are dropped before they are formatted,
+// on top of Envoy's own level for the golang logger.
+type logger struct {
+	level api.LogType
+}
+
+// returns the logger honoring this config's log_level
+func (c *PluginConfig) log() logger {
+	return logger{level: c.minLogLevel}
+}
+
+func (l logger) debug(msg string, kv ...any) { l.emit(api.Debug, msg, kv) }
+func (l logger) info(msg string, kv ...any)  { l.emit(api.Info, msg, kv) }
+func (l logger) warn(msg string, kv ...any)  { l.emit(api.Warn, msg, kv) }
+func (l logger) error(msg string, kv ...any) { l.emit(api.Error, msg, kv) }
+
+// reports whether messages at level would be written
+func (l logger) enabled(level api.LogType) bool {
+	return level >= l.level && level >= api.GetLogLevel()
+}
+
+// reports whether Envoy writes debug messages. Call sites on the request
+// path check first, so their arguments aren't boxed for nothing.
+func debugLogging() bool {
+	return api.GetLogLevel() <= api.Debug
+}
+
+func (l logger) emit(level api.LogType, msg string, kv []any) {
+	if !l.enabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			b.WriteString(logValue(kv[i+1]))
+		} else {
+			b.WriteString(`""`)
+		}
+	}
+
+	switch level {
+	case api.Debug:
+		api.LogDebug(b.String())
+	case api.Info:
+		api.LogInfo(b.String())
+	case api.Warn:
+		api.LogWarn(b.String())
+	default:
+		api.LogError(b.String())
+	}
+}
+
+// formats a field value, quoting it when it would break the key=value layout
+func logValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Duration:
+		s = v.String()
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, needsQuoting) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func needsQuoting(r rune) bool {
+	return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+}
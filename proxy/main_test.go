@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	xds "github.com/cncf/xds/go/xds/type/v3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Stands in for Envoy's logger, which only exists inside Envoy
+type testLogger struct{}
+
+func (testLogger) Log(api.LogType, string) {}
+func (testLogger) LogLevel() api.LogType   { return api.Error }
+
+func TestMain(m *testing.M) {
+	api.SetCommonCAPI(testLogger{})
+	os.Exit(m.Run())
+}
+
+// parses settings as a per-route config would be, so nothing process-wide
+// is started and no S3 or STS calls are made
+func parseTestConfig(tb testing.TB, settings map[string]interface{}) *PluginConfig {
+	tb.Helper()
+	conf, err := parseTestSettings(tb, settings)
+	if err != nil {
+		tb.Fatalf("Parse(%v) failed: %v", settings, err)
+	}
+	return conf
+}
+
+// like parseTestConfig, returning Parse's error for tests that expect one
+func parseTestSettings(tb testing.TB, settings map[string]interface{}) (*PluginConfig, error) {
+	tb.Helper()
+	return parseTestSettingsWith(tb, settings, nil)
+}
+
+// Stands in for Envoy's config callbacks, which mark a filter-level config
+type fakeConfigCallbacks struct {
+	api.ConfigCallbackHandler
+}
+
+// parses settings as the filter-level config, which takes part in the
+// shared state and is destroyed when the test ends
+func parseTestFilterConfig(tb testing.TB, settings map[string]interface{}) *PluginConfig {
+	tb.Helper()
+	conf, err := parseTestSettingsWith(tb, settings, fakeConfigCallbacks{})
+	if err != nil {
+		tb.Fatalf("Parse(%v) failed: %v", settings, err)
+	}
+	tb.Cleanup(conf.Destroy)
+	return conf
+}
+
+func parseTestSettingsWith(tb testing.TB, settings map[string]interface{}, callbacks api.ConfigCallbackHandler) (*PluginConfig, error) {
+	tb.Helper()
+	value, err := structpb.NewStruct(settings)
+	if err != nil {
+		tb.Fatalf("invalid settings: %v", err)
+	}
+	config, err := anypb.New(&xds.TypedStruct{Value: value})
+	if err != nil {
+		tb.Fatalf("failed to wrap settings: %v", err)
+	}
+	parsed, err := (&parser{}).Parse(config, callbacks)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.(*PluginConfig), nil
+}
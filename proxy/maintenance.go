@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Answered by maintenance mode rather than a lookup, reported as the tier
+const tierMaintenance = "maintenance"
+
+// States of the process-wide maintenance switch flipped from the admin socket
+const (
+	maintenanceFromConfig int32 = iota // every config follows its MaintenanceMode
+	maintenanceForcedOn                // configs with a MaintenanceShardID are in maintenance
+	maintenanceForcedOff               // no config is in maintenance
+)
+
+var (
+	maintenanceSwitch atomic.Int32
+
+	// Filter-level configs with a MaintenanceShardID, and those of them with
+	// MaintenanceMode set, for the maintenance_mode gauge
+	maintenanceCapable atomic.Int64
+	maintenanceEnabled atomic.Int64
+)
+
+// reports whether every request is to go to MaintenanceShardID. A config
+// without a holding shard is never in maintenance.
+func (c *PluginConfig) inMaintenance() bool {
+	if c.MaintenanceShardID == "" {
+		return false
+	}
+	switch maintenanceSwitch.Load() {
+	case maintenanceForcedOn:
+		return true
+	case maintenanceForcedOff:
+		return false
+	}
+	return c.MaintenanceMode
+}
+
+// value of the maintenance_mode gauge: 1 while any filter-level config
+// routes to its holding shard
+func maintenanceActive() float64 {
+	active := false
+	switch maintenanceSwitch.Load() {
+	case maintenanceForcedOn:
+		active = maintenanceCapable.Load() > 0
+	case maintenanceFromConfig:
+		active = maintenanceEnabled.Load() > 0
+	}
+	if active {
+		return 1
+	}
+	return 0
+}
+
+// flips the maintenance switch, logging the change
+func setMaintenanceSwitch(state int32) {
+	if maintenanceSwitch.Swap(state) == state {
+		return
+	}
+	switch state {
+	case maintenanceForcedOn:
+		api.LogWarnf("Maintenance mode forced on: all traffic goes to the holding shards")
+	case maintenanceForcedOff:
+		api.LogWarnf("Maintenance mode forced off: traffic is routed by the mappings")
+	default:
+		api.LogWarnf("Maintenance mode back to maintenance_mode in the config")
+	}
+}
+
+// registers a filter-level config for the maintenance_mode gauge
+func acquireMaintenance(conf *PluginConfig) {
+	maintenanceCapable.Add(1)
+	if conf.MaintenanceMode {
+		maintenanceEnabled.Add(1)
+		conf.log().warn("maintenance mode on, routing all traffic to the holding shard", "shard", conf.MaintenanceShardID)
+	}
+}
+
+// drops a config registered by acquireMaintenance
+func releaseMaintenance(conf *PluginConfig) {
+	maintenanceCapable.Add(-1)
+	if conf.MaintenanceMode {
+		maintenanceEnabled.Add(-1)
+	}
+}
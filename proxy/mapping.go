@@ -0,0 +1,946 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/hashicorp/golang-lru/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Collects the document-level fields of a MappingData besides its entries
+type mappingMeta struct {
+	version  string
+	aliases  map[string]string // added to, skipped when nil
+	patterns []patternRule
+}
+
+// decodes a MappingData document in the configured S3Format, calling visit
+// for each entry until it returns false. When meta is non-nil the document's
+// version, alias table and pattern rules are collected into it, otherwise
+// they are skipped. NDJSON documents have none of them.
+func decodeMappings(r io.Reader, conf *PluginConfig, visit func(TenantShardMapping) bool, meta *mappingMeta) error {
+	switch conf.S3Format {
+	case MappingFormatYAML:
+		return decodeYAMLMappings(r, visit, meta)
+	case MappingFormatNDJSON:
+		return decodeNDJSONMappings(r, conf.NDJSONMaxLineBytes, visit)
+	}
+	return decodeJSONMappings(r, visit, meta)
+}
+
+// streams the "mappings" array of a JSON document. The document is never held
+// in memory as a whole, so lookups can stop as soon as the tenant is found.
+func decodeJSONMappings(r io.Reader, visit func(TenantShardMapping) bool, meta *mappingMeta) error {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v in mapping data", tok)
+		}
+
+		if key == "aliases" && meta != nil && meta.aliases != nil {
+			var table map[string]string
+			if err := dec.Decode(&table); err != nil {
+				return err
+			}
+			for alias, canonical := range table {
+				meta.aliases[alias] = canonical
+			}
+			continue
+		}
+		if key == "version" && meta != nil {
+			if err := dec.Decode(&meta.version); err != nil {
+				return fmt.Errorf("invalid mapping version: %v", err)
+			}
+			continue
+		}
+		if key == "patterns" && meta != nil {
+			var patterns []PatternShardMapping
+			if err := dec.Decode(&patterns); err != nil {
+				return err
+			}
+			rules, err := compilePatterns(patterns)
+			if err != nil {
+				return err
+			}
+			meta.patterns = rules
+			continue
+		}
+
+		if key != "mappings" {
+			// Skip fields we don't know about
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var mapping TenantShardMapping
+			if err := dec.Decode(&mapping); err != nil {
+				return err
+			}
+			if !visit(mapping) {
+				return nil
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// YAML cannot be decoded incrementally, so the document is decoded whole
+func decodeYAMLMappings(r io.Reader, visit func(TenantShardMapping) bool, meta *mappingMeta) error {
+	var mappingData MappingData
+	if err := yaml.NewDecoder(r).Decode(&mappingData); err != nil {
+		return err
+	}
+	if meta != nil {
+		meta.version = mappingData.Version
+		if meta.aliases != nil {
+			for alias, canonical := range mappingData.Aliases {
+				meta.aliases[alias] = canonical
+			}
+		}
+		rules, err := compilePatterns(mappingData.Patterns)
+		if err != nil {
+			return err
+		}
+		meta.patterns = rules
+	}
+	for _, mapping := range mappingData.Mappings {
+		if !visit(mapping) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("unexpected token %v in mapping data, expected %v", tok, want)
+	}
+	return nil
+}
+
+// Separates tenant and environment in compound lookup keys
+const compoundKeySeparator = ":"
+
+// builds the key tenants are cached and matched under, "tenant" or
+// "tenant:environment" when an environment is given
+func compoundKey(tenantID, environment string) string {
+	if environment == "" {
+		return tenantID
+	}
+	return tenantID + compoundKeySeparator + environment
+}
+
+// the lookup key this entry answers
+func (m TenantShardMapping) key() string {
+	return compoundKey(m.TenantID, m.Environment)
+}
+
+// returns the entry's own cache TTL, 0 when it uses the configured ones
+func (m TenantShardMapping) ttl() time.Duration {
+	return time.Duration(max(m.TTLSeconds, 0)) * time.Second
+}
+
+// encodes the mapping into the value stored in the caches: the plain shard ID,
+// or the JSON weight list when the tenant is split across shards. Migrating
+// tenants are cached with their window, a closed one leaves to_shard.
+func (m TenantShardMapping) assignment() string {
+	if window := m.migration(); window != nil {
+		encoded, err := json.Marshal(shardAssignment{ReplicaShardIDs: m.ReplicaShardIDs, Migration: window})
+		if err == nil {
+			return string(encoded)
+		}
+	}
+	if m.ToShard != "" {
+		m.ShardID, m.WeightedShards = m.ToShard, nil
+	}
+	if len(m.ReplicaShardIDs) > 0 {
+		encoded, err := json.Marshal(shardAssignment{ShardID: m.ShardID, WeightedShards: m.WeightedShards, ReplicaShardIDs: m.ReplicaShardIDs})
+		if err == nil {
+			return string(encoded)
+		}
+	}
+	if len(m.WeightedShards) == 0 {
+		return m.ShardID
+	}
+	encoded, err := json.Marshal(m.WeightedShards)
+	if err != nil {
+		return m.ShardID
+	}
+	return string(encoded)
+}
+
+// An assignment with replicas, cached as its JSON object encoding
+type shardAssignment struct {
+	ShardID         string          `json:"shard_id,omitempty"`
+	WeightedShards  []WeightedShard `json:"weighted_shards,omitempty"`
+	ReplicaShardIDs []string        `json:"replica_shard_ids,omitempty"`
+
+	// Resolved away by parseAssignment, callers never see it
+	Migration *migrationWindow `json:"migration,omitempty"`
+}
+
+// The shard picked for a request, along with the tenant's replicas
+type shardSelection struct {
+	shard    string
+	weighted []string // the positive-weight shards picked among, shard included
+	replicas []string
+}
+
+// returns the shards that may serve the tenant, the picked one first, then
+// the other weighted shards and the replicas. Nil when the picked shard is
+// the only one.
+func (s shardSelection) candidates() []string {
+	if len(s.weighted) <= 1 && len(s.replicas) == 0 {
+		return nil
+	}
+	candidates := []string{s.shard}
+	for _, shard := range slices.Concat(s.weighted, s.replicas) {
+		if !slices.Contains(candidates, shard) {
+			candidates = append(candidates, shard)
+		}
+	}
+	return candidates
+}
+
+// decodes a cached assignment: a plain shard, a JSON array of weighted shards
+// or a JSON shardAssignment object. Shard IDs never start with '[' or '{'.
+// A migration window is resolved against the current time.
+func parseAssignment(assignment string) (shardAssignment, error) {
+	if !strings.HasPrefix(assignment, "{") && !strings.HasPrefix(assignment, "[") {
+		return shardAssignment{ShardID: assignment}, nil
+	}
+
+	var parsed shardAssignment
+	switch {
+	case strings.HasPrefix(assignment, "{"):
+		if err := json.Unmarshal([]byte(assignment), &parsed); err != nil {
+			return parsed, fmt.Errorf("invalid shard assignment: %v", err)
+		}
+		if parsed.Migration != nil {
+			return parsed.Migration.resolve(parsed.ReplicaShardIDs, time.Now())
+		}
+	case strings.HasPrefix(assignment, "["):
+		if err := json.Unmarshal([]byte(assignment), &parsed.WeightedShards); err != nil {
+			return parsed, fmt.Errorf("invalid weighted shard assignment: %v", err)
+		}
+	}
+	return parsed, nil
+}
+
+// resolves a cached assignment into the shard for this request. Weighted
+// assignments are resolved by hashing stickyKey, so the same key keeps
+// landing on the same shard for as long as the weights don't change.
+func selectShard(assignment, stickyKey string) (shardSelection, error) {
+	parsed, err := parseAssignment(assignment)
+	if err != nil {
+		return shardSelection{}, err
+	}
+	if len(parsed.WeightedShards) == 0 {
+		return shardSelection{shard: parsed.ShardID, replicas: parsed.ReplicaShardIDs}, nil
+	}
+
+	shardID, err := pickStickyShard(parsed.WeightedShards, stickyKey)
+	if err != nil {
+		return shardSelection{}, err
+	}
+	var weighted []string
+	for _, shard := range parsed.WeightedShards {
+		if shard.Weight > 0 {
+			weighted = append(weighted, shard.ShardID)
+		}
+	}
+	return shardSelection{shard: shardID, weighted: weighted, replicas: parsed.ReplicaShardIDs}, nil
+}
+
+// picks one of the weighted shards by hashing stickyKey
+func pickStickyShard(shards []WeightedShard, stickyKey string) (string, error) {
+	total := 0
+	for _, shard := range shards {
+		if shard.Weight > 0 {
+			total += shard.Weight
+		}
+	}
+	if total == 0 {
+		return "", fmt.Errorf("weighted shard assignment has no positive weights")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(stickyKey))
+	return pickWeightedShard(shards, int(h.Sum64()%uint64(total))), nil
+}
+
+// picks one of replicas by hashing stickyKey, as if they were equally
+// weighted shards, so hash_headers spreads the users of a diverted tenant
+// over its replicas. Returns "" without replicas.
+func pickStickyReplica(replicas []string, stickyKey string) string {
+	switch len(replicas) {
+	case 0:
+		return ""
+	case 1:
+		return replicas[0]
+	}
+	h := fnv.New64a()
+	h.Write([]byte(stickyKey))
+	return replicas[h.Sum64()%uint64(len(replicas))]
+}
+
+// returns the shard whose cumulative weight range contains roll, 0 <= roll < total weight
+func pickWeightedShard(shards []WeightedShard, roll int) string {
+	for _, shard := range shards {
+		if shard.Weight <= 0 {
+			continue
+		}
+		if roll < shard.Weight {
+			return shard.ShardID
+		}
+		roll -= shard.Weight
+	}
+	return ""
+}
+
+// the mapping documents making up backend's mapping, in merge order: the S3
+// keys, or the file path for the file backend
+func mappingObjects(conf *PluginConfig, backend string) []string {
+	if backend == MappingBackendFile {
+		return []string{conf.MappingFilePath}
+	}
+	return s3MappingKeys(conf)
+}
+
+// the mapping objects of the s3 backend, in merge order
+func s3MappingKeys(conf *PluginConfig) []string {
+	if len(conf.S3Keys) > 0 {
+		return conf.S3Keys
+	}
+	return []string{conf.S3Key}
+}
+
+// identifies the configured mapping by its primary backend, see backendSourceID
+func mappingSourceID(conf *PluginConfig) string {
+	return backendSourceID(conf, conf.MappingBackend)
+}
+
+// identifies the mapping read by one of the MappingBackends,
+// "s3:bucket/key[,key...]" (with "?versionId=id" when pinned),
+// "s3:bucket/template" or "file:path"
+func backendSourceID(conf *PluginConfig, backend string) string {
+	if backend == MappingBackendFile {
+		return "file:" + conf.MappingFilePath
+	}
+	if backend == MappingBackendS3ObjectPerTenant {
+		return "s3:" + conf.S3Bucket + "/" + conf.S3KeyTemplate
+	}
+	id := "s3:" + conf.S3Bucket + "/" + strings.Join(s3MappingKeys(conf), ",")
+	if conf.S3VersionID != "" {
+		id += "?versionId=" + conf.S3VersionID
+	}
+	return id
+}
+
+// The part of the S3 API that lookups and refreshes use, so a fake can stand
+// in for S3
+type s3Getter interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+// fetches a mapping object, the caller must close the body. With an etag the
+// fetch is conditional, failing with NotModified while the object is unchanged.
+func fetchMappingObject(ctx context.Context, client s3Getter, conf *PluginConfig, key, etag string, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(conf.S3Bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	if conf.S3VersionID != "" {
+		input.VersionId = aws.String(conf.S3VersionID)
+	}
+	if conf.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(conf.S3SSECustomerAlgorithm)
+		input.SSECustomerKey = aws.String(conf.sseCustomerKey)
+		input.SSECustomerKeyMD5 = aws.String(conf.sseCustomerKeyMD5)
+	}
+
+	result, err := client.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if result.Body, err = limitMapping(result.Body, aws.Int64Value(result.ContentLength), conf, key); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// opens a mapping file, the caller must close it
+func openMappingFile(conf *PluginConfig, path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return limitMapping(file, info.Size(), conf, path)
+}
+
+// Returned when a mapping object or file is larger than MaxMappingBytes
+var errMappingTooLarge = errors.New("mapping exceeds max_mapping_bytes")
+
+// guards a mapping body against MaxMappingBytes. A declared size over the
+// limit fails right away and closes body. Otherwise reads fail as soon as
+// they cross the limit, in case the size was missing or wrong.
+func limitMapping(body io.ReadCloser, size int64, conf *PluginConfig, object string) (io.ReadCloser, error) {
+	if conf.MaxMappingBytes <= 0 {
+		return body, nil
+	}
+	if size > conf.MaxMappingBytes {
+		body.Close()
+		recordMappingTooLarge(conf, object, size)
+		return nil, fmt.Errorf("%w: %s is %d bytes", errMappingTooLarge, object, size)
+	}
+	return &limitedMapping{ReadCloser: body, conf: conf, object: object, remaining: conf.MaxMappingBytes}, nil
+}
+
+// Fails reads with errMappingTooLarge once more than remaining bytes are read
+type limitedMapping struct {
+	io.ReadCloser
+	conf      *PluginConfig
+	object    string
+	remaining int64
+}
+
+func (l *limitedMapping) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("%w: %s", errMappingTooLarge, l.object)
+	}
+	// One byte past the limit is enough to tell that it was crossed
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		recordMappingTooLarge(l.conf, l.object, l.conf.MaxMappingBytes-l.remaining)
+		return 0, fmt.Errorf("%w: %s", errMappingTooLarge, l.object)
+	}
+	return n, err
+}
+
+// opens one of backend's mappingObjects, the caller must close it
+func openMapping(ctx context.Context, s3Client s3Getter, conf *PluginConfig, backend, object string) (io.ReadCloser, error) {
+	if backend == MappingBackendFile {
+		return openMappingFile(conf, object)
+	}
+	if s3Client == nil {
+		return nil, fmt.Errorf("s3 client not initialized")
+	}
+	result, err := fetchMappingObject(ctx, s3Client, conf, object, "")
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+// opens a mapping object for a refresh. Each object gets S3RefreshTimeout
+// for the fetch and for reading its body, so the budget doesn't shrink with
+// the number of objects.
+func openRefreshMapping(s3Client s3Getter, conf *PluginConfig, backend, object string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.S3RefreshTimeout)
+	body, err := openMapping(ctx, s3Client, conf, backend, object)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnClose{ReadCloser: body, cancel: cancel}, nil
+}
+
+// releases the context a body is read under once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// streams a mapping document looking for the lookup key, returning its
+// assignment or "" when the key has no exact entry. Without one the whole
+// document has been read, and its pattern rules are returned to fall back on.
+func findAssignment(r io.Reader, conf *PluginConfig, key string) (string, time.Duration, []patternRule, error) {
+	var assignment string
+	var ttl time.Duration
+	meta := &mappingMeta{}
+	err := decodeMappings(r, conf, func(mapping TenantShardMapping) bool {
+		if mapping.key() == key {
+			assignment, ttl = mapping.assignment(), mapping.ttl()
+			return false
+		}
+		return true
+	}, meta)
+	return assignment, ttl, meta.patterns, err
+}
+
+// reports whether backend is one of the MappingBackends
+func (c *PluginConfig) hasBackend(backend string) bool {
+	return slices.Contains(c.MappingBackends, backend)
+}
+
+// the S3 backend among the MappingBackends, "" when there is none
+func (c *PluginConfig) s3Backend() string {
+	for _, backend := range c.MappingBackends {
+		if backend == MappingBackendS3 || backend == MappingBackendS3ObjectPerTenant {
+			return backend
+		}
+	}
+	return ""
+}
+
+// reports whether any of the mapping backends is one of the S3 backends
+func (c *PluginConfig) usesS3() bool {
+	return c.s3Backend() != ""
+}
+
+// metrics and log label of a source-of-truth backend
+func backendTier(backend string) string {
+	if backend == MappingBackendFile {
+		return tierFile
+	}
+	return tierS3
+}
+
+// How many pattern matches a snapshot remembers
+const patternMatchCacheSize = 10000
+
+// Represents a fully loaded mapping, swapped atomically on refresh
+type mappingSnapshot struct {
+	shards   map[string]string        // lookup key -> assignment
+	ttls     map[string]time.Duration // lookup key -> TTL, for tenants with their own
+	aliases  map[string]string        // alias -> canonical tenant
+	version  string                   // MappingData.Version, of the last object that has one
+	hash     string                   // SHA-256 of the mapping objects as loaded
+	patterns []patternRule            // later objects' rules first
+
+	// Pattern matches already resolved, by lookup key. Bounded, since a
+	// catch-all rule matches every key scanners make up and an unchanged
+	// mapping keeps its snapshot across refreshes. Nil without patterns.
+	matched  *lru.Cache[string, indexEntry]
+	loadedAt time.Time
+
+	// Set when seeded from Redis, which only holds a subset of tenants. Its
+	// keys are cache keys, normalized with cache_key_hash.
+	partial bool
+
+	// The mapping backend it was loaded from, the primary one unless the
+	// refresh fell back along MappingBackends
+	backend string
+}
+
+// Periodically loads the complete mapping from the backend so tier 3 lookups
+// are answered from memory instead of reading the mapping per request.
+// Refreshers are process-wide and shared by every filter reading the same
+// mapping, and run with the settings of the newest config among them.
+type mappingRefresher struct {
+	settings     atomic.Pointer[refresherSettings]
+	snapshot     atomic.Pointer[mappingSnapshot]
+	stopping     chan struct{} // closed to end the refresh loop
+	reconfigured chan struct{} // signaled when the refresh interval changes
+
+	// Held for the duration of a refresh, so a slow load is never doubled up
+	// by the next tick or a manual trigger
+	refreshing sync.Mutex
+}
+
+// The config a refresher loads with, and its S3 client
+type refresherSettings struct {
+	conf     *PluginConfig
+	s3Client s3Getter
+}
+
+var refreshers sync.Map // mappingSourceID -> *mappingRefresher
+
+// returns the refresher for the configured mapping, starting it on first use.
+// An existing refresher takes on conf's settings if conf is newer than the
+// config it has them from.
+func ensureMappingRefresher(conf *PluginConfig) (*mappingRefresher, error) {
+	id := mappingSourceID(conf)
+	if r, ok := refreshers.Load(id); ok {
+		return r.(*mappingRefresher), r.(*mappingRefresher).adopt(conf)
+	}
+
+	settings, err := newRefresherSettings(conf)
+	if err != nil {
+		return nil, err
+	}
+	r := &mappingRefresher{stopping: make(chan struct{}), reconfigured: make(chan struct{}, 1)}
+	r.settings.Store(settings)
+	if existing, loaded := refreshers.LoadOrStore(id, r); loaded {
+		return existing.(*mappingRefresher), existing.(*mappingRefresher).adopt(conf)
+	}
+
+	watchSighup()
+	go r.run()
+	return r, nil
+}
+
+func newRefresherSettings(conf *PluginConfig) (*refresherSettings, error) {
+	settings := &refresherSettings{conf: conf}
+	if conf.hasBackend(MappingBackendS3) {
+		s3Client, err := sharedS3Client(conf)
+		if err != nil {
+			return nil, err
+		}
+		settings.s3Client = s3Client
+	}
+	return settings, nil
+}
+
+// returns the config to load with and its S3 client
+func (r *mappingRefresher) current() (*PluginConfig, s3Getter) {
+	settings := r.settings.Load()
+	return settings.conf, settings.s3Client
+}
+
+// switches to conf unless the refresher already runs with a config parsed
+// after it. A changed interval takes effect from the next tick.
+func (r *mappingRefresher) adopt(conf *PluginConfig) error {
+	for {
+		previous := r.settings.Load()
+		if conf.parseSeq <= previous.conf.parseSeq {
+			return nil
+		}
+		settings, err := newRefresherSettings(conf)
+		if err != nil {
+			return err
+		}
+		if !r.settings.CompareAndSwap(previous, settings) {
+			continue
+		}
+		if conf.S3RefreshInterval != previous.conf.S3RefreshInterval {
+			select {
+			case r.reconfigured <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}
+}
+
+func (r *mappingRefresher) run() {
+	conf, _ := r.current()
+
+	// The startup load always runs immediately
+	if conf.WarmFromRedis {
+		r.warmFromRedis()
+	}
+	r.tryRefresh()
+
+	// Replicas started together would otherwise refresh in lockstep, so
+	// offset the periodic loop by a random fraction of the interval
+	conf, _ = r.current()
+	if conf.RefreshJitter {
+		select {
+		case <-time.After(rand.N(conf.S3RefreshInterval)):
+		case <-r.stopping:
+			return
+		}
+	}
+
+	conf, _ = r.current()
+	ticker := time.NewTicker(conf.S3RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.tryRefresh()
+		case <-r.reconfigured:
+			conf, _ := r.current()
+			ticker.Reset(conf.S3RefreshInterval)
+			api.LogInfof("Refreshing mapping %s every %v", mappingSourceID(conf), conf.S3RefreshInterval)
+		case <-r.stopping:
+			conf, _ := r.current()
+			api.LogDebugf("Stopped mapping refresh for %s", mappingSourceID(conf))
+			return
+		}
+	}
+}
+
+// ends the refresh loop, a refresh already in progress is left to finish
+func (r *mappingRefresher) stop() {
+	close(r.stopping)
+}
+
+// Returned by tryRefresh when another refresh is still running
+var errRefreshInProgress = errors.New("refresh already in progress")
+
+// runs a refresh unless one is already in progress. Every refresh, periodic
+// or manually triggered, must go through here.
+func (r *mappingRefresher) tryRefresh() error {
+	if !r.refreshing.TryLock() {
+		conf, _ := r.current()
+		api.LogInfof("Skipping refresh of %s, the previous one is still in progress", mappingSourceID(conf))
+		return errRefreshInProgress
+	}
+	defer r.refreshing.Unlock()
+
+	return r.refresh()
+}
+
+// loads the complete mapping and swaps it in, keeping the previous snapshot on
+// failure. A primary backend that keeps failing would leave the snapshot stale
+// for good, so a failed load moves on to the next of the MappingBackends,
+// passing over s3-object-per-tenant, which has no whole mapping to load. Use
+// tryRefresh instead.
+func (r *mappingRefresher) refresh() error {
+	conf, s3Client := r.current()
+	var err error
+	for _, backend := range conf.MappingBackends {
+		if backend == MappingBackendS3ObjectPerTenant {
+			continue
+		}
+		if err != nil {
+			api.LogWarnf("Refreshing mapping %s from %s instead", mappingSourceID(conf), backendTier(backend))
+		}
+		if err = r.refreshFrom(conf, s3Client, backend); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// loads backend's mapping into the snapshot. Multiple objects are merged in
+// order, later objects overriding earlier ones for tenants that appear in
+// several.
+func (r *mappingRefresher) refreshFrom(conf *PluginConfig, s3Client s3Getter, backend string) error {
+	start := time.Now()
+	tier := backendTier(backend)
+	shards := make(map[string]string)
+	ttls := make(map[string]time.Duration)
+	aliases := make(map[string]string)
+	version := ""
+	var patterns []patternRule
+	origin := make(map[string]string) // lookup key -> object it was loaded from
+	collisions := 0
+
+	// A file has no ETag to ask about, so an unchanged one is told by its
+	// content before paying for a parse
+	if backend == MappingBackendFile {
+		if previous := r.snapshot.Load(); previous != nil && !previous.partial && previous.backend == backend {
+			if hash, err := hashMapping(conf, s3Client, backend); err == nil && hash == previous.hash {
+				recordTierSuccess(tier)
+				api.LogDebugf("Mapping from %s unchanged, generation %s", tier, mappingGeneration(hash))
+				return nil
+			}
+		}
+	}
+
+	hasher := sha256.New()
+	for _, object := range mappingObjects(conf, backend) {
+		body, err := openRefreshMapping(s3Client, conf, backend, object)
+		if err != nil {
+			api.LogWarnf("Failed to fetch mapping %s from %s for refresh: %v", object, tier, err)
+			return err
+		}
+
+		meta := &mappingMeta{aliases: aliases}
+		err = decodeMappings(io.TeeReader(body, hasher), conf, func(mapping TenantShardMapping) bool {
+			key := mapping.key()
+			if previous, exists := origin[key]; exists && previous != object {
+				collisions++
+				api.LogDebugf("Tenant %s is mapped in both %s and %s, using %s", key, previous, object, object)
+			}
+			shards[key] = internAssignment(mapping.assignment())
+			if ttl := mapping.ttl(); ttl > 0 {
+				ttls[key] = ttl
+			} else {
+				delete(ttls, key)
+			}
+			origin[key] = object
+			return true
+		}, meta)
+		if err == nil {
+			// Anything the decoder left unread still counts towards the hash
+			_, err = io.Copy(hasher, body)
+		}
+		body.Close()
+		if err != nil {
+			api.LogWarnf("Failed to parse mapping %s from %s for refresh: %v", object, tier, err)
+			return err
+		}
+		if meta.version != "" {
+			version = meta.version
+		}
+		patterns = append(meta.patterns, patterns...)
+	}
+	if collisions > 0 {
+		api.LogWarnf("%d tenants are mapped in more than one mapping object, later objects win", collisions)
+	}
+
+	// Typos in shard IDs would otherwise only show as failed routing
+	if len(conf.knownShards) > 0 {
+		references := checkKnownShards(conf, mappingSourceID(conf), shards, patterns)
+		if limit := conf.MaxUnknownShardReferences; limit >= 0 && references > limit {
+			err := &unknownShardsError{references: references, limit: limit}
+			api.LogErrorf("Rejected mapping from %s, keeping the previous one: %v", tier, err)
+			return err
+		}
+	}
+
+	loaded := &mappingSnapshot{shards: shards, ttls: ttls, aliases: aliases, version: version,
+		hash: hex.EncodeToString(hasher.Sum(nil)), patterns: patterns, loadedAt: time.Now(), backend: backend}
+	if len(patterns) > 0 {
+		loaded.matched, _ = lru.New[string, indexEntry](patternMatchCacheSize)
+	}
+	previous := r.snapshot.Swap(loaded)
+	if conf.ChangeWebhookURL != "" && mappingChanged(previous, loaded) {
+		notifyMappingChange(conf, previous, loaded)
+	}
+	recordMappingVersion(mappingSourceID(conf), version)
+	recordMappingGeneration(mappingSourceID(conf), mappingGeneration(loaded.hash))
+	recordTierSuccess(tier)
+	recordMappingLoad(mappingSourceID(conf), len(shards), start)
+	endWarmup()
+	api.LogInfof("Refreshed mapping from %s: %d tenants, %d aliases, %d patterns, version %q, generation %s in %v",
+		tier, len(shards), len(aliases), len(patterns), version, mappingGeneration(loaded.hash), time.Since(start))
+	return nil
+}
+
+// hashes the mapping objects as refresh does, without parsing them
+func hashMapping(conf *PluginConfig, s3Client s3Getter, backend string) (string, error) {
+	hasher := sha256.New()
+	for _, object := range mappingObjects(conf, backend) {
+		body, err := openRefreshMapping(s3Client, conf, backend, object)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hasher, body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// short, stable identifier of a mapping's content, from its hash
+func mappingGeneration(hash string) string {
+	return hash[:12]
+}
+
+// returns the version of the current snapshot, "" when it has none or no
+// snapshot has loaded
+func (r *mappingRefresher) version() string {
+	if snap := r.snapshot.Load(); snap != nil {
+		return snap.version
+	}
+	return ""
+}
+
+// resolves tenantID through the snapshot's alias table, returning it
+// unchanged when it isn't an alias or no snapshot has loaded
+func (r *mappingRefresher) canonicalTenant(tenantID string) string {
+	snap := r.snapshot.Load()
+	if snap == nil {
+		return tenantID
+	}
+	if canonical, ok := snap.aliases[tenantID]; ok && canonical != "" {
+		return canonical
+	}
+	return tenantID
+}
+
+// looks up tenantID in the current snapshot. loaded is false until the first
+// refresh has succeeded, and for misses in a partial snapshot, since neither
+// can tell that the tenant has no mapping. ttl is the tenant's own TTL, if
+// it has one, and tier that of the backend the snapshot was loaded from.
+func (r *mappingRefresher) lookup(tenantID string) (shardID string, ttl time.Duration, tier string, loaded bool) {
+	snap := r.snapshot.Load()
+	if snap == nil {
+		return "", 0, "", false
+	}
+	tier = backendTier(snap.backend)
+	key := tenantID
+	if snap.partial {
+		// Seeded from Redis, keyed as Redis keys them
+		conf, _ := r.current()
+		redisKey, ok := conf.redisKey(tenantID)
+		if !ok {
+			return "", 0, "", false
+		}
+		key = redisKey
+	}
+	shardID = snap.shards[key]
+	if shardID == "" && snap.partial {
+		return "", 0, "", false
+	}
+	if shardID == "" && len(snap.patterns) > 0 {
+		entry, _ := snap.matchPattern(key)
+		return entry.assignment, entry.ttl, tier, true
+	}
+	return shardID, snap.ttls[key], tier, true
+}
+
+// matches key against the pattern rules, remembering the most recent
+// patternMatchCacheSize matches so busy tenants are only matched once per
+// snapshot
+func (snap *mappingSnapshot) matchPattern(key string) (indexEntry, bool) {
+	if snap.matched == nil {
+		return matchPatterns(snap.patterns, key)
+	}
+	if entry, ok := snap.matched.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := matchPatterns(snap.patterns, key)
+	if ok {
+		snap.matched.Add(key, entry)
+	}
+	return entry, ok
+}
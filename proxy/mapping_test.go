@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+func TestPickWeightedShard(t *testing.T) {
+	shards := []WeightedShard{
+		{ShardID: "shard-a", Weight: 2},
+		{ShardID: "shard-off", Weight: 0},
+		{ShardID: "shard-b", Weight: 1},
+		{ShardID: "shard-neg", Weight: -5},
+	}
+	tests := []struct {
+		roll int
+		want string
+	}{
+		{0, "shard-a"},
+		{1, "shard-a"},
+		{2, "shard-b"},
+		{3, ""},
+	}
+	for _, tt := range tests {
+		if got := pickWeightedShard(shards, tt.roll); got != tt.want {
+			t.Errorf("pickWeightedShard(roll %d) = %q, want %q", tt.roll, got, tt.want)
+		}
+	}
+}
+
+func TestSelectShard(t *testing.T) {
+	tests := []struct {
+		name       string
+		assignment string
+		want       []string // any of these
+		wantErr    bool
+	}{
+		{name: "plain shard", assignment: "shard-a", want: []string{"shard-a"}},
+		{name: "single weight", assignment: `[{"shard_id": "shard-b", "weight": 1}]`, want: []string{"shard-b"}},
+		{name: "zero weights skipped", assignment: `[{"shard_id": "shard-a", "weight": 0}, {"shard_id": "shard-b", "weight": 3}]`, want: []string{"shard-b"}},
+		{name: "split", assignment: `[{"shard_id": "shard-a", "weight": 1}, {"shard_id": "shard-b", "weight": 1}]`, want: []string{"shard-a", "shard-b"}},
+		{name: "no positive weight", assignment: `[{"shard_id": "shard-a", "weight": 0}]`, wantErr: true},
+		{name: "malformed", assignment: `[{"shard_id": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := selectShard(tt.assignment, "user-1")
+			got := selection.shard
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if got == want {
+					return
+				}
+			}
+			t.Errorf("got %q, want one of %v", got, tt.want)
+		})
+	}
+}
+
+func TestAssignmentRoundTrip(t *testing.T) {
+	mapping := TenantShardMapping{TenantID: "acme", WeightedShards: []WeightedShard{
+		{ShardID: "shard-a", Weight: 90},
+		{ShardID: "shard-b", Weight: 10},
+	}}
+	counts := map[string]int{}
+	for i := range 1000 {
+		key := fmt.Sprintf("user-%d", i)
+		selection, err := selectShard(mapping.assignment(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := selectShard(mapping.assignment(), key); again.shard != selection.shard {
+			t.Fatalf("%s picked %s, then %s", key, selection.shard, again.shard)
+		}
+		counts[selection.shard]++
+	}
+	if counts["shard-a"] < 800 || counts["shard-b"] < 50 || counts["shard-a"]+counts["shard-b"] != 1000 {
+		t.Errorf("1000 keys at 90/10 gave %v", counts)
+	}
+	if got := (TenantShardMapping{ShardID: "shard-a"}).assignment(); got != "shard-a" {
+		t.Errorf("unweighted assignment = %q, want shard-a", got)
+	}
+}
+
+func TestMatchPatternCacheIsBounded(t *testing.T) {
+	matched, _ := lru.New[string, indexEntry](patternMatchCacheSize)
+	snap := &mappingSnapshot{
+		patterns: []patternRule{
+			{pattern: "demo-*", entry: indexEntry{assignment: "sandbox"}},
+			{pattern: "*", entry: indexEntry{assignment: "shard-1"}},
+		},
+		matched: matched,
+	}
+
+	for i := range patternMatchCacheSize + 100 {
+		key := fmt.Sprintf("scanner-%d", i)
+		if entry, ok := snap.matchPattern(key); !ok || entry.assignment != "shard-1" {
+			t.Fatalf("%s: got %q, %v, want shard-1 from the catch-all", key, entry.assignment, ok)
+		}
+	}
+	if n := snap.matched.Len(); n != patternMatchCacheSize {
+		t.Errorf("remembered %d matches, want %d", n, patternMatchCacheSize)
+	}
+
+	// Evicted keys are matched again rather than missed
+	if entry, ok := snap.matchPattern("scanner-0"); !ok || entry.assignment != "shard-1" {
+		t.Errorf("evicted key: got %q, %v, want shard-1", entry.assignment, ok)
+	}
+	if entry, ok := snap.matchPattern("demo-acme"); !ok || entry.assignment != "sandbox" {
+		t.Errorf("demo-acme: got %q, %v, want sandbox", entry.assignment, ok)
+	}
+}
+
+func TestPickStickyReplica(t *testing.T) {
+	if got := pickStickyReplica(nil, "user-1"); got != "" {
+		t.Errorf("no replicas: got %q, want none", got)
+	}
+	if got := pickStickyReplica([]string{"shard-b"}, "user-1"); got != "shard-b" {
+		t.Errorf("one replica: got %q, want shard-b", got)
+	}
+
+	replicas := []string{"shard-b", "shard-c", "shard-d"}
+	picked := map[string]bool{}
+	for i := range 100 {
+		key := fmt.Sprintf("user-%d", i)
+		shard := pickStickyReplica(replicas, key)
+		if again := pickStickyReplica(replicas, key); again != shard {
+			t.Fatalf("%s: picked %q, then %q", key, shard, again)
+		}
+		picked[shard] = true
+	}
+	if len(picked) != len(replicas) {
+		t.Errorf("100 keys were spread over %v, want all of %v", picked, replicas)
+	}
+}
+
+// Serves every mapping object after a delay, or fails once the context ends
+type slowS3 struct {
+	delay time.Duration
+}
+
+func (s *slowS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	document := fmt.Sprintf(`{"mappings": [{"tenant_id": %q, "shard_id": "shard-1"}]}`, aws.StringValue(input.Key))
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(document))}, nil
+}
+
+func TestRefreshTimeoutIsPerObject(t *testing.T) {
+	conf := parseTestConfig(t, map[string]interface{}{
+		"s3_bucket":           "mappings",
+		"s3_keys":             []interface{}{"a.json", "b.json", "c.json"},
+		"s3_refresh_interval": "1h",
+		"s3_refresh_timeout":  "200ms",
+	})
+
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+	}{
+		// Together the objects take longer than the timeout
+		{"each object within the timeout", 100 * time.Millisecond, false},
+		{"an object over the timeout", 400 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &mappingRefresher{stopping: make(chan struct{}), reconfigured: make(chan struct{}, 1)}
+			r.settings.Store(&refresherSettings{conf: conf, s3Client: &slowS3{delay: tt.delay}})
+
+			err := r.refresh()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("refresh succeeded, want a timeout")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh failed: %v", err)
+			}
+			if snap := r.snapshot.Load(); snap == nil || len(snap.shards) != 3 {
+				t.Errorf("snapshot = %+v, want all 3 tenants", snap)
+			}
+		})
+	}
+}
+
+// Fails every fetch as an S3 outage would
+type brokenS3 struct{}
+
+func (brokenS3) GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error) {
+	return nil, errors.New("ServiceUnavailable")
+}
+
+func TestRefreshFallsBackAlongBackends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	if err := os.WriteFile(path, []byte(`{"mappings": [{"tenant_id": "acme", "shard_id": "shard-file"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := parseTestConfig(t, map[string]interface{}{
+		"mapping_backends":    []interface{}{"s3", "file"},
+		"s3_bucket":           "mappings",
+		"s3_key":              "tenants.json",
+		"mapping_file_path":   path,
+		"s3_refresh_interval": "1h",
+	})
+
+	tests := []struct {
+		name      string
+		s3Client  s3Getter
+		filePath  string
+		wantShard string
+		wantTier  string
+		wantErr   bool
+	}{
+		{"primary loads", &fakeS3{document: `{"mappings": [{"tenant_id": "acme", "shard_id": "shard-s3"}]}`}, path, "shard-s3", tierS3, false},
+		{"primary fails", brokenS3{}, path, "shard-file", tierFile, false},
+		{"every backend fails", brokenS3{}, filepath.Join(t.TempDir(), "missing.json"), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := *conf
+			conf.MappingFilePath = tt.filePath
+			r := &mappingRefresher{stopping: make(chan struct{}), reconfigured: make(chan struct{}, 1)}
+			r.settings.Store(&refresherSettings{conf: &conf, s3Client: tt.s3Client})
+
+			err := r.refresh()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("refresh succeeded, want an error")
+				}
+				if _, _, _, loaded := r.lookup("acme"); loaded {
+					t.Error("a snapshot loaded although every backend failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh failed: %v", err)
+			}
+			shard, _, tier, loaded := r.lookup("acme")
+			if !loaded || shard != tt.wantShard || tier != tt.wantTier {
+				t.Errorf("lookup(acme) = %q from %q (loaded %v), want %q from %q", shard, tier, loaded, tt.wantShard, tt.wantTier)
+			}
+		})
+	}
+}
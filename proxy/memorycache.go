@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// The memory tier's storage, implemented by golang-lru's cache and lfuCache
+type memoryCacheStore interface {
+	Get(key string) (memoryCacheEntry, bool)
+	Peek(key string) (memoryCacheEntry, bool)
+	Add(key string, value memoryCacheEntry) (evicted bool)
+	Remove(key string) (present bool)
+}
+
+// builds the memory cache for the configured eviction policy
+func newMemoryCache(conf *PluginConfig) (memoryCacheStore, error) {
+	if conf.MemoryCacheEviction == MemoryCacheEvictionLFU {
+		return newLFUCache(conf.MemoryCacheSize)
+	}
+	return lru.New[string, memoryCacheEntry](conf.MemoryCacheSize)
+}
+
+// Settings that make two memory caches interchangeable. Caches are never
+// resized: a route merging a different size or policy gets a cache of its
+// own, and routes that only differ otherwise share it.
+type memoryCacheKey struct {
+	mapping  string
+	size     int
+	eviction string
+}
+
+var memoryCaches sync.Map // memoryCacheKey -> memoryCacheStore
+
+// returns the process-wide memory cache for the config's mapping, size and
+// eviction policy, creating it on first use
+func sharedMemoryCache(conf *PluginConfig) (memoryCacheStore, error) {
+	key := memoryCacheKey{mapping: mappingSourceID(conf), size: conf.MemoryCacheSize, eviction: conf.MemoryCacheEviction}
+	if cache, ok := memoryCaches.Load(key); ok {
+		return cache.(memoryCacheStore), nil
+	}
+	cache, err := newMemoryCache(conf)
+	if err != nil {
+		return nil, err
+	}
+	if existing, loaded := memoryCaches.LoadOrStore(key, cache); loaded {
+		return existing.(memoryCacheStore), nil
+	}
+	api.LogInfof("Created shared memory cache for %s: %d entries, %s eviction", key.mapping, key.size, key.eviction)
+	return cache, nil
+}
+
+// Represents a fixed-size cache evicting the least frequently used entry,
+// the least recently used one among entries with the same count. Hot
+// tenants survive bursts of new tenants, each of which starts at count 1.
+// All operations are O(1) and safe for concurrent use.
+type lfuCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element // -> *lfuItem
+	freqs map[int]*list.List       // use count -> items, most recent first
+	min   int                      // lowest use count present
+}
+
+type lfuItem struct {
+	key   string
+	value memoryCacheEntry
+	count int
+}
+
+func newLFUCache(size int) (*lfuCache, error) {
+	if size <= 0 {
+		return nil, errors.New("must provide a positive size")
+	}
+	return &lfuCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		freqs: make(map[int]*list.List),
+	}, nil
+}
+
+func (c *lfuCache) Get(key string) (memoryCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return memoryCacheEntry{}, false
+	}
+	elem = c.touch(elem)
+	return elem.Value.(*lfuItem).value, true
+}
+
+// returns the entry without counting a use
+func (c *lfuCache) Peek(key string) (memoryCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		return elem.Value.(*lfuItem).value, true
+	}
+	return memoryCacheEntry{}, false
+}
+
+// adds or updates an entry, counting a use, and reports whether another entry
+// was evicted to make room
+func (c *lfuCache) Add(key string, value memoryCacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem = c.touch(elem)
+		elem.Value.(*lfuItem).value = value
+		return false
+	}
+
+	evicted := false
+	if len(c.items) >= c.size {
+		c.evict()
+		evicted = true
+	}
+
+	c.items[key] = c.bucket(1).PushFront(&lfuItem{key: key, value: value, count: 1})
+	c.min = 1
+	return evicted
+}
+
+func (c *lfuCache) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.unlink(elem)
+	delete(c.items, key)
+	return true
+}
+
+// moves an item to the next use count, returning its new list element.
+// Must be called with c.mu held.
+func (c *lfuCache) touch(elem *list.Element) *list.Element {
+	item := elem.Value.(*lfuItem)
+	c.unlink(elem)
+	if c.freqs[c.min] == nil && c.min == item.count {
+		c.min++
+	}
+	item.count++
+	elem = c.bucket(item.count).PushFront(item)
+	c.items[item.key] = elem
+	return elem
+}
+
+// evicts the least recently used of the least frequently used items.
+// Must be called with c.mu held.
+func (c *lfuCache) evict() {
+	bucket := c.freqs[c.min]
+	if bucket == nil {
+		// Remove took the last item with the lowest count, find the next one
+		c.min = 0
+		for count, b := range c.freqs {
+			if c.min == 0 || count < c.min {
+				c.min, bucket = count, b
+			}
+		}
+		if bucket == nil {
+			return
+		}
+	}
+	elem := bucket.Back()
+	c.unlink(elem)
+	delete(c.items, elem.Value.(*lfuItem).key)
+}
+
+// removes an element from its count's list, dropping the list when empty.
+// Must be called with c.mu held.
+func (c *lfuCache) unlink(elem *list.Element) {
+	count := elem.Value.(*lfuItem).count
+	bucket := c.freqs[count]
+	bucket.Remove(elem)
+	if bucket.Len() == 0 {
+		delete(c.freqs, count)
+	}
+}
+
+// returns the list for a use count, creating it when needed.
+// Must be called with c.mu held.
+func (c *lfuCache) bucket(count int) *list.List {
+	bucket, ok := c.freqs[count]
+	if !ok {
+		bucket = list.New()
+		c.freqs[count] = bucket
+	}
+	return bucket
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLFUCacheEviction(t *testing.T) {
+	// Each op is "g key" (get), "p key" (peek), "a key" (add) or "r key"
+	// (remove) against a cache of size 2
+	tests := []struct {
+		name string
+		ops  []string
+		want []string // keys present afterwards
+		gone []string // keys evicted
+	}{
+		{
+			name: "least frequently used goes first",
+			ops:  []string{"a hot", "a cold", "g hot", "a new"},
+			want: []string{"hot", "new"},
+			gone: []string{"cold"},
+		},
+		{
+			name: "least recently used breaks a tie",
+			ops:  []string{"a old", "a recent", "a new"},
+			want: []string{"recent", "new"},
+			gone: []string{"old"},
+		},
+		{
+			name: "a burst of new keys keeps the hot key",
+			ops:  []string{"a hot", "g hot", "g hot", "a t1", "a t2", "a t3", "a t4"},
+			want: []string{"hot", "t4"},
+			gone: []string{"t1", "t2", "t3"},
+		},
+		{
+			name: "re-adding counts a use",
+			ops:  []string{"a one", "a two", "a one", "a three"},
+			want: []string{"one", "three"},
+			gone: []string{"two"},
+		},
+		{
+			name: "peek doesn't count a use",
+			ops:  []string{"a one", "a two", "p one", "a three"},
+			want: []string{"two", "three"},
+			gone: []string{"one"},
+		},
+		{
+			name: "eviction after removing the last lowest-count key",
+			ops:  []string{"a one", "g one", "a two", "g two", "g two", "a three", "r three", "a four", "a five"},
+			want: []string{"two", "five"},
+			gone: []string{"one", "three", "four"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newLFUCache(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range tt.ops {
+				verb, key, _ := strings.Cut(op, " ")
+				switch verb {
+				case "g":
+					c.Get(key)
+				case "p":
+					c.Peek(key)
+				case "a":
+					c.Add(key, memoryCacheEntry{assignment: "shard-" + key})
+				case "r":
+					c.Remove(key)
+				}
+			}
+			for _, key := range tt.want {
+				if entry, ok := c.Peek(key); !ok || entry.assignment != "shard-"+key {
+					t.Errorf("%s = %+v, %v; want it cached", key, entry, ok)
+				}
+			}
+			for _, key := range tt.gone {
+				if _, ok := c.Peek(key); ok {
+					t.Errorf("%s is still cached", key)
+				}
+			}
+		})
+	}
+}
+
+func TestLFUCacheAddReportsEviction(t *testing.T) {
+	c, err := newLFUCache(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Add("one", memoryCacheEntry{}) {
+		t.Error("first add reported an eviction")
+	}
+	if c.Add("one", memoryCacheEntry{assignment: "updated"}) {
+		t.Error("updating a key reported an eviction")
+	}
+	if !c.Add("two", memoryCacheEntry{}) {
+		t.Error("adding past the size didn't report an eviction")
+	}
+	if c.Remove("one") || !c.Remove("two") {
+		t.Error("Remove reported the wrong presence")
+	}
+	if _, err := newLFUCache(0); err == nil {
+		t.Error("newLFUCache(0) succeeded")
+	}
+}
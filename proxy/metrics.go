@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Lookup tiers, used as metric labels
+const (
+	tierMemory = "memory"
+	tierRedis  = "redis"
+	tierS3     = "s3"
+	tierFile   = "file"
+	tierNone   = "none"
+
+	// Answered by an ops override key in Redis rather than a tier
+	tierOverride = "override"
+)
+
+// Per-tier lookup results, used as metric labels
+const (
+	resultHit   = "hit"
+	resultMiss  = "miss"
+	resultError = "error"
+
+	// The tier was skipped because its circuit breaker is open
+	resultBreakerOpen = "breaker_open"
+	// The tier was skipped because max_concurrent_s3_lookups were in flight
+	resultSaturated = "saturated"
+	// An expired memory entry was served while it is revalidated
+	resultStale = "stale"
+	// The tier was skipped because too little of lookup_budget was left
+	resultSkipped = "skipped"
+	// An expired memory entry was served because every tier behind it failed
+	resultLastKnownGood = "last_known_good"
+)
+
+// Reasons a write-behind write was dropped, used as metric labels
+const (
+	dropBufferFull  = "buffer_full"
+	dropBreakerOpen = "breaker_open"
+	dropError       = "error"
+)
+
+const metricsNamespace = "shard_router"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	tierLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tier_lookups_total",
+		Help:      "Lookups attempted against each tier, by result.",
+	}, []string{"tier", "result"})
+
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookup_duration_seconds",
+		Help:      "End-to-end shard lookup latency, by the tier that answered.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"tier"})
+
+	tierCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tier_call_duration_seconds",
+		Help:      "Latency of each call into a tier, whatever its result.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"tier"})
+
+	// tierCallDuration children resolved in init, so timing a tier call on
+	// the request path doesn't allocate
+	tierCallObservers = map[string]prometheus.Observer{}
+
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "breaker_state",
+		Help:      "Circuit breaker state per dependency: 0 closed, 1 half-open, 2 open.",
+	}, []string{"breaker"})
+
+	tierLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tier_last_success_timestamp_seconds",
+		Help:      "Unix time a tier last answered successfully, a hit or a definitive miss.",
+	}, []string{"tier"})
+
+	mappingEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_entries",
+		Help:      "Tenant entries in the last successfully loaded mapping.",
+	}, []string{"mapping"})
+
+	mappingLoadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_load_duration_seconds",
+		Help:      "Time taken by successful complete mapping loads.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"mapping"})
+
+	mappingVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_version_info",
+		Help:      "Always 1, labeled with the version of the loaded mapping.",
+	}, []string{"mapping", "version"})
+
+	invalidShardReferences = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "invalid_shard_references",
+		Help:      "Mappings in the last load referencing shards missing from known_shards, rejected loads included.",
+	}, []string{"mapping"})
+
+	mappingGenerationInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_generation_info",
+		Help:      "Always 1, labeled with the content generation of the loaded mapping.",
+	}, []string{"mapping", "generation"})
+
+	s3LookupsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_lookups_in_flight",
+		Help:      "Lookups currently holding a max_concurrent_s3_lookups slot, by mapping.",
+	}, []string{"mapping"})
+
+	mappingTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_too_large_total",
+		Help:      "Mapping loads and lookups aborted because the mapping exceeded max_mapping_bytes.",
+	}, []string{"mapping"})
+
+	dryRunShards = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_routed_total",
+		Help:      "Requests a dry-run filter would have routed, by shard.",
+	}, []string{"shard"})
+
+	redisFallthrough = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_fallthrough_total",
+		Help:      "Lookups passed on from Redis to the mapping backend, by Redis result: miss, error or breaker_open.",
+	}, []string{"result"})
+
+	extractionFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "extraction_failed_total",
+		Help:      "Requests whose tenant couldn't be determined.",
+	})
+
+	mappingNotFound = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_not_found_total",
+		Help:      "Lookups for a tenant that no tier has a mapping for.",
+	})
+
+	invalidTenants = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invalid_tenants_total",
+		Help:      "Extracted tenant IDs rejected by tenant_id_pattern.",
+	})
+
+	overrideHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "override_hits_total",
+		Help:      "Lookups answered by a Redis override key, by shard.",
+	}, []string{"shard"})
+
+	unhealthyShardHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unhealthy_shard_hits_total",
+		Help:      "Lookups that resolved an unhealthy shard, by shard and the policy applied.",
+	}, []string{"shard", "policy"})
+
+	connectionCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connection_cache_hits_total",
+		Help:      "Requests routed as an earlier stream of their connection was, without a lookup.",
+	})
+
+	shardHints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_hints_total",
+		Help:      "Requests carrying a shard hint, by how it compared with the resolved shard.",
+	}, []string{"result"})
+
+	drainedLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drained_lookups_total",
+		Help:      "Lookups diverted away from a shard in drain_shards, by the draining shard.",
+	}, []string{"shard"})
+
+	writeBehindDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_write_behind_dropped_total",
+		Help:      "Redis write-backs dropped by the write-behind worker, by reason.",
+	}, []string{"reason"})
+
+	// Counters backing the hit ratio gauge
+	lookupsServed    atomic.Uint64
+	lookupsFromCache atomic.Uint64
+
+	// End of the warmup grace period in unix nanoseconds, 0 before one
+	// starts. Lookups before then aren't counted in the hit ratio.
+	warmupEndsAt atomic.Int64
+	warmupBegun  atomic.Bool
+)
+
+func init() {
+	for _, tier := range []string{tierMemory, tierRedis, tierS3, tierFile} {
+		tierCallObservers[tier] = tierCallDuration.WithLabelValues(tier)
+	}
+
+	metricsRegistry.MustRegister(
+		tierLookupsTotal,
+		lookupDuration,
+		tierCallDuration,
+		breakerStateGauge,
+		tierLastSuccess,
+		writeBehindDropped,
+		dryRunShards,
+		overrideHits,
+		unhealthyShardHits,
+		drainedLookups,
+		shardHints,
+		connectionCacheHits,
+		extractionFailures,
+		mappingNotFound,
+		invalidTenants,
+		redisFallthrough,
+		mappingEntries,
+		mappingLoadDuration,
+		mappingVersion,
+		mappingGenerationInfo,
+		invalidShardReferences,
+		s3LookupsInFlight,
+		mappingTooLarge,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_hit_ratio",
+			Help:      "Fraction of lookups answered by the memory or Redis cache since startup.",
+		}, cacheHitRatio),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "maintenance_mode",
+			Help:      "1 while maintenance mode sends all traffic to a holding shard.",
+		}, maintenanceActive),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "warming",
+			Help:      "1 during the warmup grace period, when lookups are left out of cache_hit_ratio.",
+		}, func() float64 {
+			if warming() {
+				return 1
+			}
+			return 0
+		}),
+	)
+	metricsRegistry.MustRegister(recentHitRatioCollectors()...)
+}
+
+// records the result of a single tier lookup
+func recordTierResult(tier, result string) {
+	tierLookupsTotal.WithLabelValues(tier, result).Inc()
+	if !warming() {
+		recordRecentTierResult(tier, result)
+	}
+}
+
+// records how long a single call into tier took
+func recordTierCall(tier string, start time.Time) {
+	tierCallObservers[tier].Observe(time.Since(start).Seconds())
+}
+
+// records that tier just answered without error. Only the tier itself
+// counts: answers from the refresh snapshot don't prove S3 or the file is
+// readable, a successful refresh does.
+func recordTierSuccess(tier string) {
+	tierLastSuccess.WithLabelValues(tier).SetToCurrentTime()
+}
+
+// records a successful complete load of the mapping identified by mapping
+func recordMappingLoad(mapping string, entries int, start time.Time) {
+	mappingEntries.WithLabelValues(mapping).Set(float64(entries))
+	mappingLoadDuration.WithLabelValues(mapping).Observe(time.Since(start).Seconds())
+}
+
+// records a lookup Redis couldn't answer, by why
+func recordRedisFallthrough(result string) {
+	redisFallthrough.WithLabelValues(result).Inc()
+}
+
+// records a lookup answered by a Redis override key
+func recordOverrideHit(shardID string) {
+	overrideHits.WithLabelValues(shardID).Inc()
+}
+
+// records a lookup that resolved the unhealthy shardID and what policy did about it
+func recordUnhealthyShard(shardID, policy string) {
+	unhealthyShardHits.WithLabelValues(shardID, policy).Inc()
+}
+
+// records how a request's shard hint compared with the resolved shard
+func recordShardHint(result string) {
+	shardHints.WithLabelValues(result).Inc()
+}
+
+// records a lookup diverted away from the draining shardID
+func recordDrainedLookup(shardID string) {
+	drainedLookups.WithLabelValues(shardID).Inc()
+}
+
+// records a mapping read aborted by max_mapping_bytes, seen to be at least size bytes
+func recordMappingTooLarge(conf *PluginConfig, object string, size int64) {
+	mappingTooLarge.WithLabelValues(mappingSourceID(conf)).Inc()
+	api.LogErrorf("Mapping %s is at least %d bytes, over max_mapping_bytes %d, not reading it", object, size, conf.MaxMappingBytes)
+}
+
+// records the version of the mapping just loaded, replacing the previous one
+func recordMappingVersion(mapping, version string) {
+	mappingVersion.DeletePartialMatch(prometheus.Labels{"mapping": mapping})
+	mappingVersion.WithLabelValues(mapping, version).Set(1)
+}
+
+// records the content generation of the mapping just loaded
+func recordMappingGeneration(mapping, generation string) {
+	mappingGenerationInfo.DeletePartialMatch(prometheus.Labels{"mapping": mapping})
+	mappingGenerationInfo.WithLabelValues(mapping, generation).Set(1)
+}
+
+// records how many mappings of the last load referenced unknown shards
+func recordInvalidShardReferences(mapping string, references int) {
+	invalidShardReferences.WithLabelValues(mapping).Set(float64(references))
+}
+
+// records the shard a dry-run filter would have routed a request to
+func recordDryRunShard(shardID string) {
+	dryRunShards.WithLabelValues(shardID).Inc()
+}
+
+// records a completed orchestrated lookup answered by tier
+func recordLookup(tier string, start time.Time) {
+	lookupDuration.WithLabelValues(tier).Observe(time.Since(start).Seconds())
+
+	// Cold caches would drag the ratio down for reasons that aren't news
+	if warming() {
+		return
+	}
+	lookupsServed.Add(1)
+	fromCache := tier == tierMemory || tier == tierRedis
+	if fromCache {
+		lookupsFromCache.Add(1)
+	}
+	recentCacheHits.observe(fromCache)
+}
+
+// starts the warmup grace period. Only the first call in the process does,
+// later configs are reloads rather than a startup.
+func beginWarmup(period time.Duration) {
+	if !warmupBegun.CompareAndSwap(false, true) {
+		return
+	}
+	warmupEndsAt.Store(time.Now().Add(period).UnixNano())
+	api.LogInfof("Warming up for up to %v, lookups are left out of the cache hit ratio meanwhile", period)
+}
+
+// ends the warmup grace period early, once a complete mapping is loaded
+func endWarmup() {
+	ends := warmupEndsAt.Load()
+	if ends == 0 || time.Now().UnixNano() >= ends || !warmupEndsAt.CompareAndSwap(ends, time.Now().UnixNano()) {
+		return
+	}
+	api.LogInfof("Warmup ended with the first complete mapping load")
+}
+
+// reports whether the warmup grace period is running
+func warming() bool {
+	return time.Now().UnixNano() < warmupEndsAt.Load()
+}
+
+func cacheHitRatio() float64 {
+	total := lookupsServed.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(lookupsFromCache.Load()) / float64(total)
+}
+
+// The metrics server is process-wide: filter instances are created per stream,
+// so it is started lazily by the first filter and only stopped once every
+// filter-level config that asked for it has been destroyed by Envoy.
+var (
+	metricsServerMu   sync.Mutex
+	metricsServer     *http.Server
+	metricsServerRefs int
+)
+
+// starts the metrics server on addr unless one is already running
+func ensureMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+
+	metricsServerMu.Lock()
+	defer metricsServerMu.Unlock()
+
+	if metricsServer != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	metricsServer = srv
+
+	go func() {
+		api.LogInfof("Starting metrics server on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			api.LogErrorf("Metrics server on %s stopped: %v", addr, err)
+		}
+	}()
+}
+
+// registers a filter-level config as a user of the metrics server
+func acquireMetricsServer() {
+	metricsServerMu.Lock()
+	defer metricsServerMu.Unlock()
+	metricsServerRefs++
+}
+
+// drops a reference taken by acquireMetricsServer, shutting the server down
+// when no filter-level config needs it anymore
+func releaseMetricsServer() {
+	metricsServerMu.Lock()
+	defer metricsServerMu.Unlock()
+
+	metricsServerRefs--
+	if metricsServerRefs > 0 || metricsServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		api.LogWarnf("Failed to shut down metrics server: %v", err)
+	}
+	metricsServer = nil
+}
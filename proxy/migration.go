@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// How a tenant is routed during its migration window, set per entry with
+// migration_policy
+const (
+	MigrationPreferNew = "prefer_new" // to_shard, with from_shard as a candidate
+	MigrationPreferOld = "prefer_old" // from_shard, with to_shard as a candidate
+	MigrationSplit     = "split"      // half of the sticky keys to each shard
+)
+
+// A tenant moving between shards, cached in its assignment so every tier
+// resolves it against the current time
+type migrationWindow struct {
+	FromShard string    `json:"from_shard"`
+	ToShard   string    `json:"to_shard"`
+	Until     time.Time `json:"until"`
+	Policy    string    `json:"policy,omitempty"`
+}
+
+// returns the entry's migration window, nil when it has none or the window
+// has already closed. Entries without all three fields, or moving to the
+// shard they come from, are plain mappings to to_shard.
+func (m TenantShardMapping) migration() *migrationWindow {
+	if m.ToShard == "" || m.FromShard == "" || m.FromShard == m.ToShard || m.MigrationUntil == nil {
+		return nil
+	}
+	if !time.Now().Before(*m.MigrationUntil) {
+		return nil
+	}
+	return &migrationWindow{FromShard: m.FromShard, ToShard: m.ToShard, Until: *m.MigrationUntil, Policy: m.MigrationPolicy}
+}
+
+// resolves the window into the assignment to route by at now, with
+// replicas being the tenant's other replicas. Both shards are candidates
+// while the window is open, only to_shard once it has closed.
+func (w *migrationWindow) resolve(replicas []string, now time.Time) (shardAssignment, error) {
+	if !now.Before(w.Until) {
+		return shardAssignment{ShardID: w.ToShard, ReplicaShardIDs: replicas}, nil
+	}
+
+	candidates := []string{w.ToShard, w.FromShard}
+	for _, replica := range replicas {
+		if replica != w.ToShard && replica != w.FromShard {
+			candidates = append(candidates, replica)
+		}
+	}
+	switch w.Policy {
+	case "", MigrationPreferNew:
+		return shardAssignment{ShardID: w.ToShard, ReplicaShardIDs: candidates}, nil
+	case MigrationPreferOld:
+		return shardAssignment{ShardID: w.FromShard, ReplicaShardIDs: candidates}, nil
+	case MigrationSplit:
+		return shardAssignment{
+			WeightedShards:  []WeightedShard{{ShardID: w.FromShard, Weight: 1}, {ShardID: w.ToShard, Weight: 1}},
+			ReplicaShardIDs: candidates,
+		}, nil
+	}
+	return shardAssignment{}, fmt.Errorf("invalid migration policy %q", w.Policy)
+}
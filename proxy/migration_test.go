@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMigrationWindowResolve(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		policy   string
+		until    time.Time
+		replicas []string
+		want     shardAssignment
+		wantErr  bool
+	}{
+		{
+			name:  "default prefers the new shard",
+			until: now.Add(time.Hour),
+			want:  shardAssignment{ShardID: "shard-new", ReplicaShardIDs: []string{"shard-new", "shard-old"}},
+		},
+		{
+			name:   "prefer_old",
+			policy: MigrationPreferOld,
+			until:  now.Add(time.Hour),
+			want:   shardAssignment{ShardID: "shard-old", ReplicaShardIDs: []string{"shard-new", "shard-old"}},
+		},
+		{
+			name:   "split",
+			policy: MigrationSplit,
+			until:  now.Add(time.Hour),
+			want: shardAssignment{
+				WeightedShards:  []WeightedShard{{ShardID: "shard-old", Weight: 1}, {ShardID: "shard-new", Weight: 1}},
+				ReplicaShardIDs: []string{"shard-new", "shard-old"},
+			},
+		},
+		{
+			name:     "replicas follow both shards once",
+			policy:   MigrationPreferNew,
+			until:    now.Add(time.Hour),
+			replicas: []string{"shard-old", "shard-replica"},
+			want:     shardAssignment{ShardID: "shard-new", ReplicaShardIDs: []string{"shard-new", "shard-old", "shard-replica"}},
+		},
+		{
+			name:     "closed window routes to the new shard only",
+			policy:   MigrationPreferOld,
+			until:    now,
+			replicas: []string{"shard-replica"},
+			want:     shardAssignment{ShardID: "shard-new", ReplicaShardIDs: []string{"shard-replica"}},
+		},
+		{
+			name:    "invalid policy",
+			policy:  "round_robin",
+			until:   now.Add(time.Hour),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window := &migrationWindow{FromShard: "shard-old", ToShard: "shard-new", Until: tt.until, Policy: tt.policy}
+			got, err := window.resolve(tt.replicas, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationAssignment(t *testing.T) {
+	open := time.Now().Add(time.Hour)
+	closed := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name    string
+		mapping TenantShardMapping
+		want    shardAssignment
+	}{
+		{
+			name:    "open window",
+			mapping: TenantShardMapping{ShardID: "shard-ignored", FromShard: "shard-old", ToShard: "shard-new", MigrationUntil: &open},
+			want:    shardAssignment{ShardID: "shard-new", ReplicaShardIDs: []string{"shard-new", "shard-old"}},
+		},
+		{
+			name:    "closed window",
+			mapping: TenantShardMapping{FromShard: "shard-old", ToShard: "shard-new", MigrationUntil: &closed},
+			want:    shardAssignment{ShardID: "shard-new"},
+		},
+		{
+			name:    "no deadline",
+			mapping: TenantShardMapping{FromShard: "shard-old", ToShard: "shard-new"},
+			want:    shardAssignment{ShardID: "shard-new"},
+		},
+		{
+			name:    "moving to the same shard",
+			mapping: TenantShardMapping{FromShard: "shard-new", ToShard: "shard-new", MigrationUntil: &open},
+			want:    shardAssignment{ShardID: "shard-new"},
+		},
+		{
+			name:    "no migration",
+			mapping: TenantShardMapping{ShardID: "shard-1"},
+			want:    shardAssignment{ShardID: "shard-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAssignment(tt.mapping.assignment())
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Envoy attribute holding the first URI SAN of the client certificate, empty
+// without one
+const peerURISANProperty = "connection.uri_san_peer_certificate"
+
+// extracts the tenant ID from a URI SAN of the client certificate, such as a
+// SPIFFE ID, using TenantSANPattern's capture group
+func (f *ShardRouterFilter) extractTenantFromCertificate(header api.RequestHeaderMap) (string, error) {
+	var sans []string
+	if f.config.TenantSANSource == TenantSANSourceXFCC {
+		sans = xfccURISANs(header.Values("x-forwarded-client-cert"))
+	} else if san, err := f.callbacks.GetProperty(peerURISANProperty); err == nil && san != "" {
+		sans = []string{san}
+	}
+	if len(sans) == 0 {
+		return "", errors.New("no client certificate URI SAN")
+	}
+
+	for _, san := range sans {
+		if match := f.config.tenantSANPattern.FindStringSubmatch(san); match != nil && match[1] != "" {
+			api.LogDebugf("Extracted tenant ID from client certificate SAN %s: %s", san, match[1])
+			return match[1], nil
+		}
+	}
+	return "", fmt.Errorf("no client certificate URI SAN matches %s", f.config.TenantSANPattern)
+}
+
+// returns the URI SANs of the first client in an x-forwarded-client-cert
+// header, the one that connected to the edge. Elements are comma-separated,
+// each a list of semicolon-separated key=value pairs whose values may be
+// double-quoted, e.g.
+//
+//	By=spiffe://mesh/edge;Hash=...;URI=spiffe://mesh/tenant/acme,By=...
+func xfccURISANs(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	var sans []string
+	for _, pair := range splitXFCC(firstXFCCElement(values[0]), ';') {
+		key, value, _ := strings.Cut(pair, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "URI") {
+			if value = unquoteXFCC(strings.TrimSpace(value)); value != "" {
+				sans = append(sans, value)
+			}
+		}
+	}
+	return sans
+}
+
+// returns the header up to the first comma outside quotes
+func firstXFCCElement(header string) string {
+	if elements := splitXFCC(header, ','); len(elements) > 0 {
+		return elements[0]
+	}
+	return ""
+}
+
+// splits s on sep, ignoring separators inside double quotes
+func splitXFCC(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// strips the quotes around an XFCC value and unescapes what they contain
+func unquoteXFCC(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var b strings.Builder
+	inner := value[1 : len(value)-1]
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		b.WriteByte(inner[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Malformed NDJSON lines logged individually per document, the rest are
+// only counted
+const maxMalformedLinesLogged = 10
+
+// streams a newline-delimited document, one TenantShardMapping object per
+// line. Blank lines and lines starting with '#' are skipped, malformed lines
+// are logged and skipped. A line longer than maxLine fails the whole read,
+// since skipping it would silently drop a tenant.
+func decodeNDJSONMappings(r io.Reader, maxLine int, visit func(TenantShardMapping) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, min(maxLine, 64*1024)), maxLine)
+
+	line, malformed := 0, 0
+	for scanner.Scan() {
+		line++
+		record := bytes.TrimSpace(scanner.Bytes())
+		if len(record) == 0 || record[0] == '#' {
+			continue
+		}
+
+		var mapping TenantShardMapping
+		err := json.Unmarshal(record, &mapping)
+		if err == nil && mapping.TenantID == "" {
+			err = errors.New("no tenant_id")
+		}
+		if err != nil {
+			malformed++
+			if malformed <= maxMalformedLinesLogged {
+				api.LogWarnf("Skipping malformed mapping on line %d: %v", line, err)
+			}
+			continue
+		}
+		if !visit(mapping) {
+			return nil
+		}
+	}
+	if malformed > maxMalformedLinesLogged {
+		api.LogWarnf("Skipped %d malformed mapping lines in total", malformed)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("line %d is longer than ndjson_max_line_bytes (%d)", line+1, maxLine)
+		}
+		return err
+	}
+	return nil
+}
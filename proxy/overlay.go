@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Answered by the Redis mapping overlay, reported as the tier
+const tierOverlay = "overlay"
+
+// Overlay answers remembered per process, so most lookups don't ask Redis
+const overlayCacheSize = 10000
+
+// A remembered overlay answer, "" when the tenant has no overlay entry
+type overlayEntry struct {
+	assignment string
+	expiresAt  time.Time
+}
+
+// Remembers overlay answers, misses included, for MappingOverlayCacheTTL
+type overlayCache struct {
+	mu      sync.Mutex
+	entries *lru.Cache[string, overlayEntry]
+}
+
+var overlayCaches sync.Map // "addr/prefix" -> *overlayCache
+
+// returns the process-wide cache of the configured overlay, creating it on
+// first use
+func overlayCacheFor(conf *PluginConfig) *overlayCache {
+	id := conf.RedisAddr + "/" + conf.MappingOverlayPrefix
+	if c, ok := overlayCaches.Load(id); ok {
+		return c.(*overlayCache)
+	}
+	entries, _ := lru.New[string, overlayEntry](overlayCacheSize)
+	c, _ := overlayCaches.LoadOrStore(id, &overlayCache{entries: entries})
+	return c.(*overlayCache)
+}
+
+// returns the unexpired answer for key
+func (c *overlayCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries.Get(key)
+	if !ok || time.Now().After(entry.expiresAt) {
+		return "", false
+	}
+	return entry.assignment, true
+}
+
+func (c *overlayCache) add(key, assignment string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Add(key, overlayEntry{assignment: assignment, expiresAt: time.Now().Add(ttl)})
+}
+
+func (c *overlayCache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Remove(key)
+}
+
+// returns the tenant's assignment from <MappingOverlayPrefix><tenant> in
+// Redis, where just-changed tenants are published ahead of the next refresh,
+// or "" when it has none. Like overrides, the overlay is best effort and a
+// failing Redis leaves the tenant to the normal tiers.
+func (f *ShardRouterFilter) lookupOverlay(ctx context.Context, tenantID string) string {
+	if f.redisReader == nil {
+		return ""
+	}
+	redisKey, ok := f.config.redisKey(tenantID)
+	if !ok {
+		return ""
+	}
+
+	cache := overlayCacheFor(f.config)
+	if f.config.MappingOverlayCacheTTL > 0 {
+		if assignment, ok := cache.get(redisKey); ok {
+			return assignment
+		}
+	}
+	if err := f.redisReaderBreaker.allow(); err != nil {
+		return ""
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, f.config.RedisTimeout)
+	defer cancel()
+
+	assignment, err := f.redisReader.Get(callCtx, f.config.MappingOverlayPrefix+redisKey).Result()
+	if err == redis.Nil {
+		f.reportOutcome(ctx, f.redisReaderBreaker, nil)
+		assignment, err = "", nil
+	} else {
+		f.reportOutcome(ctx, f.redisReaderBreaker, err)
+		if err == nil {
+			assignment, err = decodeRedisValue(assignment)
+		}
+	}
+	if err != nil {
+		recordTierResult(tierOverlay, tierErrorResult(err))
+		api.LogWarnf("Mapping overlay lookup failed for tenant %s: %v", tenantID, err)
+		return ""
+	}
+
+	if f.config.MappingOverlayCacheTTL > 0 {
+		cache.add(redisKey, assignment, f.config.MappingOverlayCacheTTL)
+	}
+	if assignment == "" {
+		recordTierResult(tierOverlay, resultMiss)
+	} else {
+		recordTierResult(tierOverlay, resultHit)
+		api.LogDebugf("Mapping overlay has tenant %s -> %s", tenantID, assignment)
+	}
+	return assignment
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Bounds on untrusted request input, past which it is rejected before any
+// parsing. DNS caps names at 253 bytes in 127 labels of up to 63 bytes; the
+// authority may also carry a port and userinfo.
+const (
+	maxAuthorityBytes = 1024
+	maxHostBytes      = 253
+	maxHostLabels     = 127
+	maxLabelBytes     = 63
+)
+
+// reduces an :authority to the host name, dropping any userinfo, port and
+// trailing dot. IP literals have no subdomain to extract, so they are errors,
+// as are names DNS couldn't resolve: empty or overlong labels and bytes that
+// are never valid in a host, such as controls, spaces and NULs.
+func hostName(authority string) (string, error) {
+	if len(authority) > maxAuthorityBytes {
+		return "", fmt.Errorf("authority of %d bytes is over the %d allowed", len(authority), maxAuthorityBytes)
+	}
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		authority = authority[i+1:]
+	}
+
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	} else if strings.HasPrefix(authority, "[") && strings.HasSuffix(authority, "]") {
+		// A bracketed IPv6 literal without a port
+		host = authority[1 : len(authority)-1]
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if host == "" {
+		return "", fmt.Errorf("empty host in authority %q", authority)
+	}
+	if net.ParseIP(host) != nil {
+		return "", fmt.Errorf("host %s is an IP address", host)
+	}
+	if err := checkHostName(host); err != nil {
+		return "", fmt.Errorf("invalid host %q: %v", host, err)
+	}
+	return host, nil
+}
+
+// checks host's length, label count and bytes in a single pass
+func checkHostName(host string) error {
+	if len(host) > maxHostBytes {
+		return fmt.Errorf("%d bytes, over the %d allowed", len(host), maxHostBytes)
+	}
+	labels, labelStart := 1, 0
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case c == '.':
+			if i == labelStart {
+				return errors.New("empty label")
+			}
+			labels++
+			labelStart = i + 1
+		case c <= ' ' || c == 0x7f || strings.IndexByte(`"#%/:<>?@[\]^{|}`, c) >= 0:
+			return fmt.Errorf("byte %q not allowed", c)
+		}
+		if i-labelStart >= maxLabelBytes {
+			return fmt.Errorf("label over %d bytes", maxLabelBytes)
+		}
+	}
+	if labelStart == len(host) {
+		return errors.New("empty label")
+	}
+	if labels > maxHostLabels {
+		return fmt.Errorf("%d labels, over the %d allowed", labels, maxHostLabels)
+	}
+	return nil
+}
+
+// splits an :authority into the labels of its host name, as validated by
+// hostName, so none of them is empty
+func hostLabels(authority string) ([]string, error) {
+	host, err := hostName(authority)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(host, "."), nil
+}
+
+// returns the path segment at index (0-based), ignoring the query and any
+// leading or trailing slashes. Empty segments between two slashes count. The
+// path is walked in place, so it costs nothing per segment skipped, and a
+// segment that is empty or carries control bytes is an error.
+func pathSegment(path string, index int) (string, error) {
+	path, _, _ = strings.Cut(path, "?")
+	path = strings.Trim(path, "/")
+
+	for i := 0; i < index; i++ {
+		slash := strings.IndexByte(path, '/')
+		if slash < 0 {
+			return "", fmt.Errorf("path has no segment %d", index)
+		}
+		path = path[slash+1:]
+	}
+	segment, _, _ := strings.Cut(path, "/")
+	if segment == "" {
+		return "", fmt.Errorf("path has no segment %d", index)
+	}
+	for i := 0; i < len(segment); i++ {
+		if c := segment[i]; c < ' ' || c == 0x7f {
+			return "", fmt.Errorf("path segment %d has control byte %q", index, c)
+		}
+	}
+	return segment, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func FuzzHostName(f *testing.F) {
+	for _, seed := range []string{
+		"acme.example.com",
+		"acme.example.com:8443",
+		"acme.example.com.",
+		"user:pass@acme.example.com:443",
+		"a@b@acme.example.com",
+		"[::1]",
+		"[::1]:443",
+		"[fe80::1%25eth0]:8080",
+		"::1",
+		"10.0.0.1:80",
+		"acme\x00.example.com",
+		"acme.example.com\x00:443",
+		"acme..example.com",
+		".example.com",
+		"..",
+		"",
+		":443",
+		"@",
+		strings.Repeat("a", 64) + ".example.com",
+		strings.Repeat("a.", 127) + "com",
+		strings.Repeat("a", maxAuthorityBytes+1),
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, authority string) {
+		host, err := hostName(authority)
+		if err != nil {
+			return
+		}
+		if err := checkHostName(host); err != nil {
+			t.Fatalf("hostName(%q) accepted %q, which checkHostName rejects: %v", authority, host, err)
+		}
+		if net.ParseIP(host) != nil {
+			t.Fatalf("hostName(%q) accepted the IP address %q", authority, host)
+		}
+	})
+}
+
+func FuzzPathSegment(f *testing.F) {
+	for _, seed := range []struct {
+		path  string
+		index int
+	}{
+		{"/tenants/acme/orders", 1},
+		{"/tenants/acme/orders?x=1", 2},
+		{"//acme", 0},
+		{"/a//b", 1},
+		{"/acme\x00/orders", 0},
+		{"/acme%00/orders", 0},
+		{"?/acme", 0},
+		{"", 0},
+		{"/", 3},
+		{"/acme", -1},
+		{strings.Repeat("/a", 10000), 9999},
+	} {
+		f.Add(seed.path, seed.index)
+	}
+
+	f.Fuzz(func(t *testing.T, path string, index int) {
+		segment, err := pathSegment(path, index)
+		if err != nil {
+			return
+		}
+		if segment == "" || strings.ContainsAny(segment, "/?") {
+			t.Fatalf("pathSegment(%q, %d) = %q, want a non-empty segment without / or ?", path, index, segment)
+		}
+		for i := 0; i < len(segment); i++ {
+			if c := segment[i]; c < ' ' || c == 0x7f {
+				t.Fatalf("pathSegment(%q, %d) = %q, with control byte %q", path, index, segment, c)
+			}
+		}
+		if !strings.Contains(path, segment) {
+			t.Fatalf("pathSegment(%q, %d) = %q, not part of the path", path, index, segment)
+		}
+	})
+}
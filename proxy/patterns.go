@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// A PatternShardMapping ready for matching
+type patternRule struct {
+	pattern string
+	entry   indexEntry
+}
+
+// validates the document's pattern rules, keeping their order
+func compilePatterns(patterns []PatternShardMapping) ([]patternRule, error) {
+	rules := make([]patternRule, 0, len(patterns))
+	for _, p := range patterns {
+		if _, err := path.Match(p.Pattern, ""); err != nil || p.Pattern == "" {
+			return nil, fmt.Errorf("invalid tenant pattern %q", p.Pattern)
+		}
+		mapping := TenantShardMapping{ShardID: p.ShardID, WeightedShards: p.WeightedShards, TTLSeconds: p.TTLSeconds}
+		rules = append(rules, patternRule{
+			pattern: p.Pattern,
+			entry:   indexEntry{assignment: mapping.assignment(), ttl: mapping.ttl()},
+		})
+	}
+	return rules, nil
+}
+
+// returns the entry of the first rule matching the lookup key
+func matchPatterns(rules []patternRule, key string) (indexEntry, bool) {
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.pattern, key); matched {
+			return rule.entry, true
+		}
+	}
+	return indexEntry{}, false
+}
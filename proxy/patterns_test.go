@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	rules, err := compilePatterns([]PatternShardMapping{
+		{Pattern: "demo-eu-*", ShardID: "shard-eu"},
+		{Pattern: "demo-*", ShardID: "shard-demo", TTLSeconds: 30},
+		{Pattern: "load-test-?", WeightedShards: []WeightedShard{{ShardID: "shard-a", Weight: 1}, {ShardID: "shard-b", Weight: 1}}},
+		{Pattern: "[xy]-*", ShardID: "shard-xy"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key       string
+		want      string // assignment, empty for no match
+		wantTTL   time.Duration
+		wantMatch bool
+	}{
+		{key: "demo-eu-1", want: "shard-eu", wantMatch: true},
+		{key: "demo-us-1", want: "shard-demo", wantTTL: 30 * time.Second, wantMatch: true},
+		{key: "load-test-7", want: `[{"shard_id":"shard-a","weight":1},{"shard_id":"shard-b","weight":1}]`, wantMatch: true},
+		{key: "load-test-10"},
+		{key: "x-acme", want: "shard-xy", wantMatch: true},
+		{key: "z-acme"},
+		{key: "demo"},
+		{key: "team/demo-1"},
+	}
+	for _, tt := range tests {
+		entry, ok := matchPatterns(rules, tt.key)
+		if ok != tt.wantMatch || entry.assignment != tt.want || entry.ttl != tt.wantTTL {
+			t.Errorf("matchPatterns(%q) = %+v, %v; want %q, %v, %v", tt.key, entry, ok, tt.want, tt.wantTTL, tt.wantMatch)
+		}
+	}
+}
+
+func TestCompilePatternsRejectsInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "demo-[", "demo-\\"} {
+		if _, err := compilePatterns([]PatternShardMapping{{Pattern: pattern, ShardID: "shard-1"}}); err == nil {
+			t.Errorf("compilePatterns(%q) succeeded", pattern)
+		}
+	}
+}
+
+func TestFindAssignmentReturnsPatterns(t *testing.T) {
+	doc := `{
+		"mappings": [{"tenant_id": "demo-vip", "shard_id": "shard-vip"}],
+		"patterns": [{"pattern": "demo-*", "shard_id": "shard-demo"}]
+	}`
+	assignment, _, _, err := findAssignment(strings.NewReader(doc), &PluginConfig{S3Format: MappingFormatJSON}, "demo-vip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment != "shard-vip" {
+		t.Errorf("exact match = %q, want shard-vip", assignment)
+	}
+
+	assignment, _, rules, err := findAssignment(strings.NewReader(doc), &PluginConfig{S3Format: MappingFormatJSON}, "demo-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment != "" {
+		t.Errorf("unmapped tenant = %q, want no exact match", assignment)
+	}
+	if entry, ok := matchPatterns(rules, "demo-other"); !ok || entry.assignment != "shard-demo" {
+		t.Errorf("pattern match = %+v, %v; want shard-demo", entry, ok)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Every zstd frame starts with this magic number, and no shard ID or JSON
+// value does, so it tells compressed values from raw ones
+const zstdMagic = "\x28\xb5\x2f\xfd"
+
+// Largest value a compressed Redis value may expand to
+const maxDecodedRedisValue = 1 << 20
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedRedisValue))
+)
+
+// encodes a value for writing to Redis with the configured codec
+func (c *PluginConfig) encodeRedisValue(value string) string {
+	if c.RedisValueCodec != RedisValueCodecZstd {
+		return value
+	}
+	return string(zstdEncoder.EncodeAll([]byte(value), nil))
+}
+
+// decodes a value read from Redis. Compressed values are recognized by their
+// magic number rather than the configured codec, so raw values written before
+// zstd was enabled keep working, and so do compressed ones after a rollback.
+func decodeRedisValue(value string) (string, error) {
+	if !strings.HasPrefix(value, zstdMagic) {
+		return value, nil
+	}
+	decoded, err := zstdDecoder.DecodeAll([]byte(value), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress Redis value: %w", err)
+	}
+	return string(decoded), nil
+}
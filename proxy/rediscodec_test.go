@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisValueCodec(t *testing.T) {
+	weighted := `[{"shard_id":"shard-a","weight":90},{"shard_id":"shard-b","weight":10}]`
+	tests := []struct {
+		codec, value string
+		compressed   bool
+	}{
+		{codec: RedisValueCodecRaw, value: "shard-1"},
+		{codec: RedisValueCodecRaw, value: weighted},
+		{codec: "", value: "shard-1"},
+		{codec: RedisValueCodecZstd, value: "shard-1", compressed: true},
+		{codec: RedisValueCodecZstd, value: weighted, compressed: true},
+		{codec: RedisValueCodecZstd, value: ""}, // encodes to no frame at all
+	}
+	for _, tt := range tests {
+		conf := &PluginConfig{RedisValueCodec: tt.codec}
+		encoded := conf.encodeRedisValue(tt.value)
+		if got := strings.HasPrefix(encoded, zstdMagic); got != tt.compressed {
+			t.Errorf("%q codec on %q: compressed = %v, want %v", tt.codec, tt.value, got, tt.compressed)
+		}
+		decoded, err := decodeRedisValue(encoded)
+		if err != nil || decoded != tt.value {
+			t.Errorf("%q codec round trip of %q = %q, %v", tt.codec, tt.value, decoded, err)
+		}
+	}
+}
+
+func TestDecodeRedisValueRejectsCorruptFrames(t *testing.T) {
+	encoded := (&PluginConfig{RedisValueCodec: RedisValueCodecZstd}).encodeRedisValue("shard-1")
+	for _, value := range []string{zstdMagic, encoded[:len(encoded)-2], zstdMagic + "garbage"} {
+		if decoded, err := decodeRedisValue(value); err == nil {
+			t.Errorf("decodeRedisValue(%q) = %q, want an error", value, decoded)
+		}
+	}
+}
+
+func TestDecodeRedisValueCapsExpansion(t *testing.T) {
+	huge := strings.Repeat("a", maxDecodedRedisValue+1)
+	encoded := (&PluginConfig{RedisValueCodec: RedisValueCodecZstd}).encodeRedisValue(huge)
+	if _, err := decodeRedisValue(encoded); err == nil {
+		t.Error("value expanding past the cap was decoded")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of a Redis key part replaced by its hash for being too long
+const hashedRedisKeyPrefix = "hashed:"
+
+// Keys rewritten by redisKey are logged at most once per interval, with the
+// number of rewrites since the last log line
+const redisKeyLogInterval = 10 * time.Second
+
+var (
+	redisKeyLoggedAt  atomic.Int64 // unix nanoseconds
+	redisKeyRewritten atomic.Int64
+)
+
+// returns the part of a tenant's Redis key after the prefix (the field in
+// hash mode): its cache key, escaped with SanitizeRedisKeys and hashed or
+// rejected when the whole key would exceed MaxRedisKeyLength. Reads and
+// writes must both go through here so they always agree. Reports false when
+// the tenant must not be cached in Redis.
+func (c *PluginConfig) redisKey(tenantID string) (string, bool) {
+	key := c.cacheKey(tenantID)
+	original := key
+	if c.SanitizeRedisKeys {
+		key = sanitizeRedisKey(key)
+	}
+
+	prefixLen := 0
+	if c.RedisStorageMode != RedisStorageHash {
+		prefixLen = len(c.RedisKeyPrefix)
+	}
+	if c.MaxRedisKeyLength > 0 && prefixLen+len(key) > c.MaxRedisKeyLength {
+		if c.RedisLongKeyPolicy == RedisLongKeyReject {
+			c.logRedisKeyRewrite(original, "")
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(key))
+		key = hashedRedisKeyPrefix + hex.EncodeToString(sum[:])
+	}
+
+	if key != original {
+		c.logRedisKeyRewrite(original, key)
+	}
+	return key, true
+}
+
+// percent-encodes every byte that isn't printable ASCII, along with '%'
+// itself and the glob metacharacters SCAN patterns would trip over. Distinct
+// keys stay distinct.
+func sanitizeRedisKey(key string) string {
+	clean := true
+	for i := 0; i < len(key); i++ {
+		if !redisKeySafe(key[i]) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return key
+	}
+
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(key) + 8)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if redisKeySafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0x0f])
+	}
+	return b.String()
+}
+
+// reports whether c is left as is by sanitizeRedisKey
+func redisKeySafe(c byte) bool {
+	switch c {
+	case '%', '*', '?', '[', ']', '\\':
+		return false
+	}
+	return c > ' ' && c < 0x7f
+}
+
+// logs a key changed by redisKey, rate limited to one line per
+// redisKeyLogInterval. An empty rewritten key means it was rejected.
+func (c *PluginConfig) logRedisKeyRewrite(original, rewritten string) {
+	count := redisKeyRewritten.Add(1)
+	now := time.Now().UnixNano()
+	last := redisKeyLoggedAt.Load()
+	if now-last < int64(redisKeyLogInterval) || !redisKeyLoggedAt.CompareAndSwap(last, now) {
+		return
+	}
+	redisKeyRewritten.Add(-count)
+
+	if rewritten == "" {
+		c.log().warn("tenant key too long for Redis, not caching it there", "key", original,
+			"max_redis_key_length", c.MaxRedisKeyLength, "rewrites", count)
+		return
+	}
+	c.log().warn("rewrote tenant key for Redis", "key", original, "redis_key", rewritten, "rewrites", count)
+}
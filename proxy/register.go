@@ -0,0 +1,12 @@
+//go:build so
+
+package main
+
+import "github.com/envoyproxy/envoy/contrib/golang/filters/http/source/go/pkg/http"
+
+// Registering links Envoy's cgo glue, whose init calls into Envoy and
+// crashes any binary Envoy hasn't loaded, such as a test binary. The
+// plugin is therefore built with -tags so, and tests without it.
+func init() {
+	http.RegisterHttpFilterFactoryAndConfigParser(Name, filterFactory, &parser{})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+var sighupOnce sync.Once
+
+// reloads every mapping on SIGHUP, so a freshly pushed mapping goes live
+// without waiting for the refresh interval. Installed with the first refresher.
+func watchSighup() {
+	sighupOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				api.LogInfof("Received SIGHUP, refreshing mappings")
+				refreshAll()
+			}
+		}()
+	})
+}
+
+// refreshes every mapping now, concurrently, returning each one's outcome by
+// mapping ID. Mappings already refreshing report errRefreshInProgress.
+func refreshAll() map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error)
+
+	refreshers.Range(func(id, r any) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.(*mappingRefresher).tryRefresh()
+			mu.Lock()
+			results[id.(string)] = err
+			mu.Unlock()
+		}()
+		return true
+	})
+
+	wg.Wait()
+	return results
+}
+
+// formats refreshAll's results, one line per mapping in ID order
+func refreshReport(results map[string]error) string {
+	ids := make([]string, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	for _, id := range ids {
+		switch err := results[id]; {
+		case err == nil:
+			fmt.Fprintf(&b, "%s: refreshed\n", id)
+		case errors.Is(err, errRefreshInProgress):
+			fmt.Fprintf(&b, "%s: skipped, %v\n", id, err)
+		default:
+			fmt.Fprintf(&b, "%s: failed, %v\n", id, err)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Lookup results a RequestHeaders entry can carry to the upstream
+const (
+	RequestHeaderTenant      = "tenant"
+	RequestHeaderEnvironment = "environment"
+	RequestHeaderShard       = "shard"
+	RequestHeaderTier        = "tier"
+	RequestHeaderCandidates  = "candidates"
+)
+
+// parses request_headers, a map of header name to lookup result. Names are
+// lowercased as Envoy stores them.
+func parseRequestHeaders(raw map[string]interface{}) (map[string]string, error) {
+	headers := make(map[string]string, len(raw))
+	for name, source := range raw {
+		str, ok := source.(string)
+		if !ok {
+			return nil, fmt.Errorf("value for %s must be a string", name)
+		}
+		switch str {
+		case RequestHeaderTenant, RequestHeaderEnvironment, RequestHeaderShard, RequestHeaderTier, RequestHeaderCandidates:
+		default:
+			return nil, fmt.Errorf("invalid value %q for %s, expected tenant, environment, shard, tier or candidates", str, name)
+		}
+		name = strings.ToLower(name)
+		if name == "" || strings.HasPrefix(name, ":") || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if _, ok := headers[name]; ok {
+			return nil, fmt.Errorf("duplicate header %s", name)
+		}
+		headers[name] = str
+	}
+	return headers, nil
+}
+
+// removes client-supplied copies of the RequestHeaders, which only the filter
+// may set
+func (f *ShardRouterFilter) stripRequestHeaders(header api.RequestHeaderMap) {
+	for name := range f.config.RequestHeaders {
+		if _, exists := header.Get(name); exists {
+			header.Del(name)
+			f.config.log().debug("removed inbound internal header", "header", name)
+		}
+	}
+}
+
+// sets the RequestHeaders from the request's lookup results, before decoding
+// continues. Results the request doesn't have, such as the tier of a request
+// routed without a lookup, leave their header unset.
+func (f *ShardRouterFilter) setRequestHeaders() {
+	if f.requestHeader == nil || f.config.DryRun {
+		return
+	}
+	for name, source := range f.config.RequestHeaders {
+		var value string
+		switch source {
+		case RequestHeaderTenant:
+			value = f.tenantID
+		case RequestHeaderEnvironment:
+			value = f.environment
+		case RequestHeaderShard:
+			value = f.currentShardID
+		case RequestHeaderTier:
+			value = f.lookupTier
+		case RequestHeaderCandidates:
+			value = strings.Join(f.shardCandidates, ",")
+		}
+		if value != "" {
+			f.requestHeader.Set(name, value)
+		}
+	}
+}
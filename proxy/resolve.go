@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Body of a ResolvePath reply
+type resolveResponse struct {
+	Tenant      string   `json:"tenant"`
+	Environment string   `json:"environment,omitempty"`
+	Shard       string   `json:"shard,omitempty"`
+	Tier        string   `json:"tier,omitempty"`
+	Candidates  []string `json:"candidates,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// reports whether path, ignoring the query, is the configured ResolvePath
+func (f *ShardRouterFilter) isResolveRequest(path string) bool {
+	if f.config.ResolvePath == "" {
+		return false
+	}
+	path, _, _ = strings.Cut(path, "?")
+	return path == f.config.ResolvePath
+}
+
+// answers a ResolvePath request with the shard of its tenant query parameter,
+// looked up through every tier like a routed request. The request is never
+// proxied.
+func (f *ShardRouterFilter) serveResolve(header api.RequestHeaderMap) api.StatusType {
+	decoder := f.callbacks.DecoderFilterCallbacks()
+
+	if !f.hasAdminToken(header) {
+		f.config.log().warn("rejected resolve request without a valid admin token", "path", f.config.ResolvePath)
+		decoder.SendLocalReply(403, "forbidden\n", nil, 0, "shard_router_resolve_forbidden")
+		return api.LocalReply
+	}
+
+	_, rawQuery, _ := strings.Cut(header.Path(), "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil || query.Get("tenant") == "" {
+		decoder.SendLocalReply(400, "tenant query parameter required\n", nil, 0, "shard_router_resolve_bad_request")
+		return api.LocalReply
+	}
+	tenantID, valid := f.normalizeTenantID(query.Get("tenant"))
+	if !valid {
+		sendResolveReply(decoder, 400, resolveResponse{Tenant: tenantID, Error: "invalid tenant"})
+		return api.LocalReply
+	}
+	environment := query.Get("environment")
+
+	// The lookup may block on Redis or S3, as in startLookup
+	go func() {
+		defer decoder.RecoverPanic()
+
+		selection, tier, err := f.orchestratedLookup(f.ctx, tenantID, environment, "")
+		if f.ctx.Err() != nil {
+			return
+		}
+
+		response := resolveResponse{Tenant: tenantID, Environment: environment}
+		switch {
+		case err == nil:
+			response.Shard, response.Tier, response.Candidates = selection.shard, tier, selection.candidates()
+			sendResolveReply(decoder, 200, response)
+		case errors.Is(err, errNoMapping):
+			response.Error = "no mapping"
+			sendResolveReply(decoder, 404, response)
+		default:
+			response.Error = err.Error()
+			sendResolveReply(decoder, 503, response)
+		}
+		f.config.log().debug("served resolve request", "tenant", tenantID, "environment", environment,
+			"shard", selection.shard, "tier", tier, "err", err)
+	}()
+
+	return api.Running
+}
+
+// sends response as the JSON body of a local reply
+func sendResolveReply(decoder api.DecoderFilterCallbacks, status int, response resolveResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		api.LogWarnf("Failed to encode resolve response for tenant %s: %v", response.Tenant, err)
+		decoder.SendLocalReply(500, "internal error\n", nil, 0, "shard_router_resolve_error")
+		return
+	}
+	headers := map[string][]string{"content-type": {"application/json"}}
+	decoder.SendLocalReply(status, string(body)+"\n", headers, 0, "shard_router_resolve")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Tenants with a revalidation in flight, by cache key. Process-wide, so that
+// many requests served the same stale entry only start one.
+var revalidating sync.Map
+
+// refreshes a stale memory cache entry from Redis or the mapping backend in
+// the background. The request that found it is answered with the stale
+// value meanwhile, and may be gone before the refresh ends, so the refresh
+// doesn't run under the stream's context. A refresh answering other than
+// stale is audited as a remap.
+func (f *ShardRouterFilter) revalidate(tenantID, stale string) {
+	key := f.config.cacheKey(tenantID)
+	if _, inFlight := revalidating.LoadOrStore(key, struct{}{}); inFlight {
+		return
+	}
+
+	go func() {
+		defer revalidating.Delete(key)
+
+		shardID, tier, _, err := f.lookupBehindMemory(context.Background(), tenantID)
+		switch {
+		case errors.Is(err, errNoMapping):
+			// The tenant was unmapped, stop serving what it used to have
+			f.forgetInMemory(tenantID)
+			f.config.log().info("stale entry dropped, tenant no longer mapped", "tenant", tenantID)
+		case err != nil:
+			// Keep serving the stale entry until it is StaleMaxAge past its TTL
+			f.config.log().warn("stale entry revalidation failed", "tenant", tenantID, "err", err)
+		default:
+			f.config.log().debug("stale entry revalidated", "tenant", tenantID, "shard", shardID, "tier", tier)
+			if shardID != stale {
+				logShardChange(tenantID, stale, shardID)
+			}
+		}
+	}()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// A mapping object parsed into a lookup index, valid for as long as the
+// object's ETag doesn't change
+type mappingIndex struct {
+	etag     string
+	entries  map[string]indexEntry // lookup key -> entry
+	patterns []patternRule
+}
+
+type indexEntry struct {
+	assignment string
+	ttl        time.Duration
+}
+
+// Indexes of the mapping objects read by per-request S3 lookups, shared by
+// every filter instance. Each lookup still asks S3 whether the object changed,
+// but an unchanged object costs a 304 instead of a download and a scan.
+var mappingIndexes sync.Map // "bucket/key[?versionId=id]" -> *mappingIndex
+
+// builds the index of a mapping document. The first entry for a lookup key
+// wins, as it does for a streaming search.
+func buildMappingIndex(r io.Reader, conf *PluginConfig, etag string) (*mappingIndex, error) {
+	index := &mappingIndex{etag: etag, entries: make(map[string]indexEntry)}
+	meta := &mappingMeta{}
+	err := decodeMappings(r, conf, func(mapping TenantShardMapping) bool {
+		if _, exists := index.entries[mapping.key()]; !exists {
+			index.entries[mapping.key()] = indexEntry{assignment: mapping.assignment(), ttl: mapping.ttl()}
+		}
+		return true
+	}, meta)
+	if err != nil {
+		return nil, err
+	}
+	index.patterns = meta.patterns
+	return index, nil
+}
+
+// searches a mapping object through its cached index, refreshing the index
+// when S3 reports a new ETag. The object's pattern rules are returned too.
+func (f *ShardRouterFilter) lookupInS3Index(ctx context.Context, key, tenantID string) (string, time.Duration, []patternRule, error) {
+	cacheKey := f.config.S3Bucket + "/" + key
+	if f.config.S3VersionID != "" {
+		cacheKey += "?versionId=" + f.config.S3VersionID
+	}
+
+	var cached *mappingIndex
+	etag := ""
+	if v, ok := mappingIndexes.Load(cacheKey); ok {
+		cached = v.(*mappingIndex)
+		etag = cached.etag
+	}
+
+	result, err := fetchMappingObjectWithRetry(ctx, f.s3Client, f.config, key, etag)
+	var awsErr awserr.Error
+	if cached != nil && errors.As(err, &awsErr) && awsErr.Code() == "NotModified" {
+		entry := cached.entries[tenantID]
+		return entry.assignment, entry.ttl, cached.patterns, nil
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer result.Body.Close()
+
+	index, err := buildMappingIndex(result.Body, f.config, aws.StringValue(result.ETag))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	// Without an ETag the next lookup couldn't tell whether it changed
+	if index.etag != "" {
+		mappingIndexes.Store(cacheKey, index)
+	}
+
+	entry := index.entries[tenantID]
+	return entry.assignment, entry.ttl, index.patterns, nil
+}
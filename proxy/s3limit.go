@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bounds the lookups fetching from one S3 mapping source at once, so a burst
+// of distinct cold tenants can't turn into an unbounded number of parallel
+// GetObjects. Like breakers, limiters are process-wide and sized by the
+// first config that needs them.
+type s3Limiter struct {
+	name  string
+	slots chan struct{}
+	wait  time.Duration
+}
+
+var s3Limiters sync.Map // mappingSourceID -> *s3Limiter
+
+// Returned when a lookup couldn't get an S3 slot within S3LookupQueueTimeout
+type s3SaturatedError struct {
+	name string
+}
+
+func (e *s3SaturatedError) Error() string {
+	return "too many concurrent S3 lookups for " + e.name
+}
+
+// returns the process-wide limiter for an S3 mapping source, or nil when
+// MaxConcurrentS3Lookups leaves lookups unbounded
+func s3LimiterFor(name string, conf *PluginConfig) *s3Limiter {
+	if conf.MaxConcurrentS3Lookups <= 0 {
+		return nil
+	}
+	if l, ok := s3Limiters.Load(name); ok {
+		return l.(*s3Limiter)
+	}
+	l, _ := s3Limiters.LoadOrStore(name, &s3Limiter{
+		name:  name,
+		slots: make(chan struct{}, conf.MaxConcurrentS3Lookups),
+		wait:  conf.S3LookupQueueTimeout,
+	})
+	return l.(*s3Limiter)
+}
+
+// takes a slot, waiting at most the queue timeout for one to free up. Every
+// successful acquire must be paired with a release. A nil limiter always
+// succeeds.
+func (l *s3Limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		s3LookupsInFlight.WithLabelValues(l.name).Inc()
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		s3LookupsInFlight.WithLabelValues(l.name).Inc()
+		return nil
+	case <-timer.C:
+		return &s3SaturatedError{name: l.name}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *s3Limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	s3LookupsInFlight.WithLabelValues(l.name).Dec()
+}
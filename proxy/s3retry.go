@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+const (
+	s3RetryBaseDelay = 50 * time.Millisecond
+	s3RetryMaxDelay  = time.Second
+)
+
+// S3 error codes worth retrying, anything else fails the lookup immediately
+var s3RetryableErrorCodes = map[string]bool{
+	"InternalError":             true,
+	"ServiceUnavailable":        true,
+	"SlowDown":                  true,
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"RequestLimitExceeded":      true,
+	"RequestTimeout":            true,
+	request.ErrCodeRequestError: true,
+}
+
+// reports whether a failed GetObject may succeed if tried again
+func s3ErrorRetryable(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if s3RetryableErrorCodes[aerr.Code()] {
+		return true
+	}
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) {
+		return rerr.StatusCode() >= 500
+	}
+	return false
+}
+
+// fetches a mapping object for a lookup, retrying transient errors with
+// exponential backoff and full jitter. The SDK's own retries are disabled so
+// S3MaxRetries is the only retry budget, and ctx bounds the total time.
+func fetchMappingObjectWithRetry(ctx context.Context, client s3Getter, conf *PluginConfig, key, etag string) (*s3.GetObjectOutput, error) {
+	noSDKRetries := func(r *request.Request) { r.Retryer = awsclient.NoOpRetryer{} }
+
+	delay := s3RetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		result, err := fetchMappingObject(ctx, client, conf, key, etag, noSDKRetries)
+		if err == nil || attempt >= conf.S3MaxRetries || !s3ErrorRetryable(err) {
+			return result, err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(delay)) + 1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+		api.LogDebugf("Retrying S3 fetch of %s in %v after: %v", key, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay = min(delay*2, s3RetryMaxDelay)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Readers for the Parse settings: each returns def when key is absent and
+// fails with the usual message when it has the wrong type. Range checks are
+// left to the caller. Maps are read from the settings directly, as each
+// checks its entries in its own way.
+
+func getString(settings map[string]interface{}, key, def string) (string, error) {
+	value, ok := settings[key]
+	if !ok {
+		return def, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", errors.New(key + " must be a string")
+	}
+	return str, nil
+}
+
+func getBool(settings map[string]interface{}, key string, def bool) (bool, error) {
+	value, ok := settings[key]
+	if !ok {
+		return def, nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.New(key + " must be a boolean")
+	}
+	return b, nil
+}
+
+// numbers arrive from JSON as float64 and are truncated
+func getInt(settings map[string]interface{}, key string, def int) (int, error) {
+	num, err := getFloat(settings, key, float64(def))
+	return int(num), err
+}
+
+func getFloat(settings map[string]interface{}, key string, def float64) (float64, error) {
+	value, ok := settings[key]
+	if !ok {
+		return def, nil
+	}
+	num, ok := value.(float64)
+	if !ok {
+		return 0, errors.New(key + " must be a number")
+	}
+	return num, nil
+}
+
+// durations are strings in time.ParseDuration's format
+func getDuration(settings map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	value, ok := settings[key]
+	if !ok {
+		return def, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return 0, errors.New(key + " must be a string duration")
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s format: %v", key, err)
+	}
+	return duration, nil
+}
+
+// an empty string in the list is rejected like a wrong type, while an empty
+// list is returned as given
+func getStringList(settings map[string]interface{}, key string, def []string) ([]string, error) {
+	value, ok := settings[key]
+	if !ok {
+		return def, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New(key + " must be a list of strings")
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok || str == "" {
+			return nil, errors.New(key + " must be a list of strings")
+		}
+		list = append(list, str)
+	}
+	return list, nil
+}
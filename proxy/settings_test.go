@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettingGetters(t *testing.T) {
+	settings := map[string]interface{}{
+		"name":    "acme",
+		"enabled": true,
+		"size":    float64(42.9),
+		"timeout": "250ms",
+		"bad":     "soon",
+		"paths":   []interface{}{"/healthz", "/ready"},
+		"none":    []interface{}{},
+		"holes":   []interface{}{"/healthz", ""},
+	}
+
+	if got, err := getString(settings, "name", "def"); err != nil || got != "acme" {
+		t.Errorf("getString = %q, %v", got, err)
+	}
+	if got, err := getString(settings, "missing", "def"); err != nil || got != "def" {
+		t.Errorf("getString of a missing key = %q, %v", got, err)
+	}
+	if got, err := getBool(settings, "enabled", false); err != nil || !got {
+		t.Errorf("getBool = %v, %v", got, err)
+	}
+	if got, err := getInt(settings, "size", 0); err != nil || got != 42 {
+		t.Errorf("getInt = %v, %v; want 42", got, err)
+	}
+	if got, err := getFloat(settings, "size", 0); err != nil || got != 42.9 {
+		t.Errorf("getFloat = %v, %v; want 42.9", got, err)
+	}
+	if got, err := getDuration(settings, "timeout", 0); err != nil || got != 250*time.Millisecond {
+		t.Errorf("getDuration = %v, %v", got, err)
+	}
+	if got, err := getDuration(settings, "missing", time.Second); err != nil || got != time.Second {
+		t.Errorf("getDuration of a missing key = %v, %v", got, err)
+	}
+	if got, err := getStringList(settings, "paths", nil); err != nil || !slices.Equal(got, []string{"/healthz", "/ready"}) {
+		t.Errorf("getStringList = %q, %v", got, err)
+	}
+	if got, err := getStringList(settings, "none", []string{"def"}); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("getStringList of an empty list = %q, %v; want it as given", got, err)
+	}
+	if got, err := getStringList(settings, "missing", []string{"def"}); err != nil || !slices.Equal(got, []string{"def"}) {
+		t.Errorf("getStringList of a missing key = %q, %v", got, err)
+	}
+
+	for _, tt := range []struct {
+		get  func() error
+		want string
+	}{
+		{func() error { _, err := getString(settings, "size", ""); return err }, "size must be a string"},
+		{func() error { _, err := getBool(settings, "name", false); return err }, "name must be a boolean"},
+		{func() error { _, err := getInt(settings, "name", 0); return err }, "name must be a number"},
+		{func() error { _, err := getDuration(settings, "size", 0); return err }, "size must be a string duration"},
+		{func() error { _, err := getDuration(settings, "bad", 0); return err }, "invalid bad format"},
+		{func() error { _, err := getFloat(settings, "name", 0); return err }, "name must be a number"},
+		{func() error { _, err := getStringList(settings, "name", nil); return err }, "name must be a list of strings"},
+		{func() error { _, err := getStringList(settings, "holes", nil); return err }, "holes must be a list of strings"},
+	} {
+		if err := tt.get(); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("got error %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestParseRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		want     string
+	}{
+		{"wrong string type", map[string]interface{}{"s3_region": 1.0}, "s3_region must be a string"},
+		{"header name of the wrong type", map[string]interface{}{"tenant_header_name": true}, "tenant_header_name must be a string"},
+		{"password of the wrong type", map[string]interface{}{"redis_password": 1.0}, "redis_password must be a string"},
+		{"empty backend list", map[string]interface{}{"mapping_backends": []interface{}{}}, "mapping_backends must not be empty"},
+		{"empty S3 key", map[string]interface{}{"s3_keys": []interface{}{"a.json", ""}}, "s3_keys must be a list of strings"},
+		{"no subdomain labels", map[string]interface{}{"subdomain_label_count": 0.0}, "subdomain_label_count must be positive"},
+		{"sample rate over 1", map[string]interface{}{"debug_sample_rate": 1.5}, "debug_sample_rate must be between 0 and 1"},
+		{"wrong boolean type", map[string]interface{}{"enable_memory_cache": "yes"}, "enable_memory_cache must be a boolean"},
+		{"wrong number type", map[string]interface{}{"memory_cache_size": "large"}, "memory_cache_size must be a number"},
+		{"unparsable duration", map[string]interface{}{"redis_ttl": "soon"}, "invalid redis_ttl format"},
+		{"duration given as a number", map[string]interface{}{"redis_ttl": 60.0}, "redis_ttl must be a string duration"},
+		{"unknown backend", map[string]interface{}{"mapping_backend": "consul"}, "invalid mapping_backend: consul"},
+		{"unknown extraction mode", map[string]interface{}{"tenant_extraction_mode": "jwt"}, "invalid tenant_extraction_mode: jwt"},
+		{"unknown storage mode", map[string]interface{}{"redis_storage_mode": "list"}, "invalid redis_storage_mode: list"},
+		{"unknown eviction", map[string]interface{}{"memory_cache_eviction": "random"}, "invalid memory_cache_eviction: random"},
+		{"non-positive memory cache", map[string]interface{}{"memory_cache_size": 0.0}, "memory_cache_size must be positive"},
+		{"negative redis ttl", map[string]interface{}{"redis_ttl": "-1s"}, "redis_ttl must not be negative"},
+		{"negative path segment", map[string]interface{}{"tenant_path_segment": -1.0}, "tenant_path_segment must not be negative"},
+		{"invalid tenant pattern", map[string]interface{}{"tenant_id_pattern": "("}, "invalid tenant_id_pattern"},
+		{"skip_paths of numbers", map[string]interface{}{"skip_paths": []interface{}{1.0}}, "skip_paths must be a list of strings"},
+		{"invalid JSONPath", map[string]interface{}{"tenant_body_json_path": "tenant"}, "invalid tenant_body_json_path"},
+		{"invalid CIDR", map[string]interface{}{"tenant_cidr_rules": map[string]interface{}{"10.0.0.0/33": "corp"}}, "tenant_cidr_rules"},
+		{"unknown log level", map[string]interface{}{"log_level": "verbose"}, `invalid log_level "verbose"`},
+		{"unknown failure mode", map[string]interface{}{"failure_mode": "retry"}, `invalid failure_mode "retry"`},
+		{"relative resolve path", map[string]interface{}{"resolve_path": "resolve", "admin_token": "secret"}, `resolve_path "resolve" must start with /`},
+		{"drain over 100 percent", map[string]interface{}{"drain_shards": map[string]interface{}{"shard-1": 101.0}}, "drain_shards: percentage for shard-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestSettings(t, tt.settings)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse(%v) = %v, want an error containing %q", tt.settings, err, tt.want)
+			}
+		})
+	}
+}
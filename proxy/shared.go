@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// Filters are created per stream, so everything with a connection pool or a
+// goroutine is process-wide instead: the Redis and S3 clients and AWS
+// credentials here, the refreshers, write-behind workers, unhealthy shard
+// watchers and breakers. Filter-level configs hold a reference from Parse
+// until Destroy, and when the last one is destroyed the clients are closed
+// and the workers stopped. Anything still needed after that is created again
+// on first use.
+var (
+	sharedMu       sync.Mutex
+	sharedRefs     int
+	redisClients   = map[redisClientKey]*redis.Client{}
+	s3Clients      = map[s3ClientKey]*s3.S3{}
+	awsCredentials = map[awsCredentialsKey]*credentials.Credentials{}
+)
+
+// Settings that make two Redis clients interchangeable
+type redisClientKey struct {
+	network      string
+	addr         string
+	username     string
+	password     string
+	db           int
+	poolSize     int
+	minIdleConns int
+	maxRetries   int
+	dialTimeout  time.Duration
+}
+
+// Settings that make two S3 clients interchangeable
+type s3ClientKey struct {
+	region      string
+	endpoint    string
+	pathStyle   bool
+	services    string // S3ServiceEndpoints and the signing region, formatted
+	credentials *credentials.Credentials
+}
+
+// What web identity or assumed-role credentials were created for. Configs
+// for the same role share them, and with them the S3 client keyed on them,
+// instead of each config update starting an STS session of its own.
+type awsCredentialsKey struct {
+	roleARN     string
+	externalID  string
+	tokenFile   string // web identity only
+	sessionName string // web identity only
+	region      string
+	services    string // as in s3ClientKey, the STS endpoint may be among them
+	base        *credentials.Credentials
+}
+
+// returns the shared credentials for key, calling create on first use.
+// create talks to STS, so it runs without the lock held, and if two configs
+// race the first one stored wins.
+func sharedAWSCredentials(key awsCredentialsKey, create func() (*credentials.Credentials, error)) (*credentials.Credentials, error) {
+	sharedMu.Lock()
+	creds, ok := awsCredentials[key]
+	sharedMu.Unlock()
+	if ok {
+		return creds, nil
+	}
+
+	creds, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if existing, ok := awsCredentials[key]; ok {
+		return existing, nil
+	}
+	awsCredentials[key] = creds
+	return creds, nil
+}
+
+// registers a filter-level config as a user of the shared state
+func acquireSharedState() {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	sharedRefs++
+}
+
+// hands a new filter-level config's settings to the shared workers it uses
+// that are already running, so an update takes effect even before its first
+// stream and doesn't wait for Envoy to destroy the config it replaces.
+// Workers not yet running are started on first use, as usual.
+func adoptSharedSettings(conf *PluginConfig) {
+	if conf.S3RefreshInterval > 0 {
+		if r, ok := refreshers.Load(mappingSourceID(conf)); ok {
+			if err := r.(*mappingRefresher).adopt(conf); err != nil {
+				api.LogWarnf("Mapping refresh for %s keeps its previous settings: %v", mappingSourceID(conf), err)
+			}
+		}
+	}
+	if conf.EnableRedisCache {
+		for _, addr := range append([]string{conf.RedisAddr}, conf.RedisReplicaAddrs...) {
+			if b, ok := breakers.Load(redisBreakerName(addr)); ok {
+				b.(*circuitBreaker).adopt(conf)
+			}
+		}
+		if w, ok := writeBehinds.Load(conf.RedisAddr); ok && conf.RedisWriteBehind {
+			w.(*redisWriteBehind).adopt(conf)
+		}
+	}
+	if conf.usesS3() {
+		if b, ok := breakers.Load(backendSourceID(conf, conf.s3Backend())); ok {
+			b.(*circuitBreaker).adopt(conf)
+		}
+	}
+}
+
+// drops a reference taken by acquireSharedState, tearing the shared state
+// down when no filter-level config needs it anymore
+func releaseSharedState() {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	sharedRefs--
+	if sharedRefs > 0 {
+		return
+	}
+
+	// Workers first, the write-behind flushes what it has queued through
+	// the clients closed below
+	refreshers.Range(func(id, r any) bool {
+		refreshers.Delete(id)
+		r.(*mappingRefresher).stop()
+		return true
+	})
+	writeBehinds.Range(func(addr, w any) bool {
+		writeBehinds.Delete(addr)
+		w.(*redisWriteBehind).stop()
+		return true
+	})
+	unhealthyWatchers.Range(func(id, w any) bool {
+		unhealthyWatchers.Delete(id)
+		w.(*unhealthyShardWatcher).stop()
+		return true
+	})
+
+	for key, client := range redisClients {
+		if err := client.Close(); err != nil {
+			api.LogWarnf("Failed to close Redis client for %s: %v", key.addr, err)
+		}
+	}
+	clear(redisClients)
+	clear(s3Clients)
+	clear(awsCredentials)
+	mappingIndexes.Range(func(key, _ any) bool {
+		mappingIndexes.Delete(key)
+		return true
+	})
+	overlayCaches.Range(func(key, _ any) bool {
+		overlayCaches.Delete(key)
+		return true
+	})
+	memoryCaches.Range(func(key, _ any) bool {
+		memoryCaches.Delete(key)
+		return true
+	})
+	api.LogInfof("Shard router shared state released")
+}
+
+// returns the shared Redis client for addr with the config's connection and
+// pool settings, creating it on first use. Callers must not close it.
+func sharedRedisClient(conf *PluginConfig, addr string) *redis.Client {
+	key := redisClientKey{
+		network:      conf.RedisNetwork,
+		addr:         addr,
+		username:     conf.RedisUsername,
+		password:     conf.RedisPassword,
+		db:           conf.RedisDB,
+		poolSize:     conf.RedisPoolSize,
+		minIdleConns: conf.RedisMinIdleConns,
+		maxRetries:   conf.RedisMaxRetries,
+		dialTimeout:  conf.RedisDialTimeout,
+	}
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if client, ok := redisClients[key]; ok {
+		return client
+	}
+	client := newRedisClient(conf, addr)
+	redisClients[key] = client
+	return client
+}
+
+// returns the shared S3 client for the config's region, endpoint and
+// credentials, creating it on first use
+func sharedS3Client(conf *PluginConfig) (*s3.S3, error) {
+	key := s3ClientKey{
+		region:      conf.S3Region,
+		endpoint:    conf.S3Endpoint,
+		pathStyle:   conf.S3PathStyle,
+		services:    fmt.Sprint(conf.S3ServiceEndpoints, conf.S3SigningRegion),
+		credentials: conf.s3Credentials,
+	}
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if client, ok := s3Clients[key]; ok {
+		return client, nil
+	}
+	client, err := newS3Client(conf)
+	if err != nil {
+		return nil, err
+	}
+	s3Clients[key] = client
+	return client, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestSharedAWSCredentials(t *testing.T) {
+	t.Cleanup(func() { clear(awsCredentials) })
+
+	calls := 0
+	create := func() (*credentials.Credentials, error) {
+		calls++
+		return credentials.NewStaticCredentials("id", "secret", ""), nil
+	}
+	key := awsCredentialsKey{roleARN: "arn:aws:iam::123456789012:role/mapping-reader", region: "us-east-1"}
+
+	first, err := sharedAWSCredentials(key, create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sharedAWSCredentials(key, create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || calls != 1 {
+		t.Errorf("same role: got distinct=%v after %d creates, want shared after 1", first != second, calls)
+	}
+
+	other := key
+	other.externalID = "tenant-x"
+	third, err := sharedAWSCredentials(other, create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || calls != 2 {
+		t.Errorf("other external ID: got shared=%v after %d creates, want new after 2", third == first, calls)
+	}
+
+	failing := awsCredentialsKey{roleARN: "arn:aws:iam::123456789012:role/denied"}
+	denied := errors.New("AccessDenied")
+	for range 2 {
+		if _, err := sharedAWSCredentials(failing, func() (*credentials.Credentials, error) { return nil, denied }); err != denied {
+			t.Errorf("got %v, want %v", err, denied)
+		}
+	}
+	if _, ok := awsCredentials[failing]; ok {
+		t.Error("failed credentials were cached")
+	}
+}
+
+// The shared workers outlive the config that started them, so a config
+// update must reach them however Envoy orders the parse and the destroy
+func TestSharedWorkersAdoptNewestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	if err := os.WriteFile(path, []byte(`{"acme": "shard-a"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	settings := func(interval, timeout string, threshold float64) map[string]interface{} {
+		return map[string]interface{}{
+			"mapping_backend":           "file",
+			"mapping_file_path":         path,
+			"redis_addr":                "127.0.0.1:1",
+			"redis_write_behind":        true,
+			"s3_refresh_interval":       interval,
+			"redis_timeout":             timeout,
+			"breaker_failure_threshold": threshold,
+		}
+	}
+
+	a := parseTestFilterConfig(t, settings("1h", "1s", 3))
+	r, err := ensureMappingRefresher(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ensureRedisWriteBehind(a)
+	b := breakerFor(redisBreakerName(a.RedisAddr), a)
+	t.Cleanup(func() { breakers.Delete(redisBreakerName(a.RedisAddr)) })
+
+	newer := parseTestFilterConfig(t, settings("2h", "2s", 7))
+	a.Destroy()
+
+	if conf, _ := r.current(); conf.S3RefreshInterval != 2*time.Hour {
+		t.Errorf("refresh interval = %v, want the newer config's 2h", conf.S3RefreshInterval)
+	}
+	if _, timeout, _ := w.settings(); timeout != 2*time.Second {
+		t.Errorf("write-behind timeout = %v, want the newer config's 2s", timeout)
+	}
+	b.mu.Lock()
+	threshold := b.threshold
+	b.mu.Unlock()
+	if threshold != 7 {
+		t.Errorf("breaker threshold = %d, want the newer config's 7", threshold)
+	}
+
+	// A stream still on the older config doesn't switch them back
+	if _, err := ensureMappingRefresher(a); err != nil {
+		t.Fatal(err)
+	}
+	if conf, _ := r.current(); conf != newer {
+		t.Errorf("refresher went back to settings from an older config")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// A step of a sampled lookup: a tier asked and its result, or a decision
+// such as an alias or a shard swapped out, without a latency
+type traceStep struct {
+	name    string
+	result  string
+	latency time.Duration
+}
+
+// Steps of one lookup sampled by DebugSampleRate, written as a single line
+// once it is done. Every method is a no-op on nil, the unsampled case.
+type lookupTrace struct {
+	steps []traceStep
+}
+
+type lookupTraceKey struct{}
+
+// reports whether this request's lookup is traced. math/rand/v2's global
+// source is per-thread, so sampling takes no lock.
+func (c *PluginConfig) sampleLookup() bool {
+	return c.DebugSampleRate > 0 && rand.Float64() < c.DebugSampleRate
+}
+
+// returns ctx carrying trace. The trace lives in the lookup's context rather
+// than on the filter, so a revalidation running behind it records nothing.
+func withLookupTrace(ctx context.Context, trace *lookupTrace) context.Context {
+	return context.WithValue(ctx, lookupTraceKey{}, trace)
+}
+
+// returns the trace of the lookup ctx belongs to, nil when it isn't sampled
+func lookupTraceFrom(ctx context.Context) *lookupTrace {
+	trace, _ := ctx.Value(lookupTraceKey{}).(*lookupTrace)
+	return trace
+}
+
+// records a tier's result, timed from start
+func (t *lookupTrace) tier(name, result string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, traceStep{name: name, result: result, latency: time.Since(start)})
+}
+
+// records a decision taken between tiers
+func (t *lookupTrace) note(name, value string) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, traceStep{name: name, result: value})
+}
+
+// writes the trace at info level whatever log_level says, so only Envoy's
+// own level for the golang logger can drop it, e.g.
+//
+//	sampled lookup tenant=acme shard=shard-2 tier=redis latency=1.3ms steps="memory:miss:3µs redis:hit:1.2ms"
+func (t *lookupTrace) write(tenantID, environment string, selection shardSelection, tier string, elapsed time.Duration, err error) {
+	if t == nil {
+		return
+	}
+
+	var steps strings.Builder
+	for i, step := range t.steps {
+		if i > 0 {
+			steps.WriteByte(' ')
+		}
+		steps.WriteString(step.name)
+		steps.WriteByte(':')
+		steps.WriteString(step.result)
+		if step.latency > 0 {
+			steps.WriteByte(':')
+			steps.WriteString(step.latency.String())
+		}
+	}
+
+	kv := []any{"tenant", tenantID}
+	if environment != "" {
+		kv = append(kv, "environment", environment)
+	}
+	kv = append(kv, "shard", selection.shard, "tier", tier, "latency", elapsed, "steps", steps.String())
+	if candidates := selection.candidates(); len(candidates) > 0 {
+		kv = append(kv, "candidates", strings.Join(candidates, ","))
+	}
+	if err != nil {
+		kv = append(kv, "err", err)
+	}
+	logger{level: api.Trace}.info("sampled lookup", kv...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// fetches mappings for many tenants at once, RedisBatchSize keys per round
+// trip (MGET in string mode, HMGET in hash mode). A failed batch is logged
+// and skipped, so the result holds whatever succeeded; tenants without a
+// mapping are absent from it.
+func fetchRedisBatch(ctx context.Context, client redis.Cmdable, conf *PluginConfig, tenantIDs []string) map[string]string {
+	result := make(map[string]string, len(tenantIDs))
+
+	for start := 0; start < len(tenantIDs); start += conf.RedisBatchSize {
+		end := min(start+conf.RedisBatchSize, len(tenantIDs))
+		batch := tenantIDs[start:end]
+
+		var values []any
+		var err error
+		if conf.RedisStorageMode == RedisStorageHash {
+			values, err = client.HMGet(ctx, conf.RedisHashKey, batch...).Result()
+		} else {
+			keys := make([]string, len(batch))
+			for i, tenantID := range batch {
+				keys[i] = conf.RedisKeyPrefix + tenantID
+			}
+			values, err = client.MGet(ctx, keys...).Result()
+		}
+		if err != nil {
+			api.LogWarnf("Redis batch lookup of %d tenants failed: %v", len(batch), err)
+			continue
+		}
+
+		for i, value := range values {
+			raw, ok := value.(string)
+			if !ok || raw == "" {
+				continue
+			}
+			shardID, err := decodeRedisValue(raw)
+			if err != nil {
+				api.LogWarnf("Skipping Redis mapping for tenant %s: %v", batch[i], err)
+				continue
+			}
+			result[batch[i]] = shardID
+		}
+	}
+
+	return result
+}
+
+// seeds the snapshot with every mapping currently cached in Redis, so tier 3
+// can answer known tenants before the first S3 load has finished
+func (r *mappingRefresher) warmFromRedis() {
+	conf, _ := r.current()
+	client := sharedRedisClient(conf, conf.RedisAddr)
+
+	// Bound the whole scan, it is only a head start on the S3 load
+	ctx, cancel := context.WithTimeout(context.Background(), 10*conf.RedisTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var shards map[string]string
+	var err error
+	if conf.RedisStorageMode == RedisStorageHash {
+		shards, err = scanRedisHash(ctx, client, conf)
+	} else {
+		shards, err = scanRedisKeys(ctx, client, conf)
+	}
+	if err != nil {
+		api.LogWarnf("Failed to warm mapping from Redis: %v", err)
+	}
+	if len(shards) == 0 {
+		return
+	}
+
+	// Redis only holds recently used tenants, so misses must still reach S3
+	if r.snapshot.CompareAndSwap(nil, &mappingSnapshot{shards: shards, loadedAt: time.Now(), partial: true, backend: conf.MappingBackend}) {
+		api.LogInfof("Warmed mapping from Redis: %d tenants in %v", len(shards), time.Since(start))
+	}
+}
+
+// collects tenant IDs with SCAN and resolves them with batched MGETs
+func scanRedisKeys(ctx context.Context, client redis.Cmdable, conf *PluginConfig) (map[string]string, error) {
+	shards := make(map[string]string)
+	match := escapeRedisPattern(conf.RedisKeyPrefix) + "*"
+
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, match, int64(conf.RedisBatchSize)).Result()
+		if err != nil {
+			return shards, err
+		}
+
+		tenantIDs := make([]string, len(keys))
+		for i, key := range keys {
+			tenantIDs[i] = strings.TrimPrefix(key, conf.RedisKeyPrefix)
+		}
+		for tenantID, shardID := range fetchRedisBatch(ctx, client, conf, tenantIDs) {
+			shards[tenantID] = internAssignment(shardID)
+		}
+
+		if next == 0 {
+			return shards, nil
+		}
+		cursor = next
+	}
+}
+
+// reads the mapping hash with HSCAN, which returns fields and values together
+func scanRedisHash(ctx context.Context, client redis.Cmdable, conf *PluginConfig) (map[string]string, error) {
+	shards := make(map[string]string)
+
+	var cursor uint64
+	for {
+		pairs, next, err := client.HScan(ctx, conf.RedisHashKey, cursor, "", int64(conf.RedisBatchSize)).Result()
+		if err != nil {
+			return shards, err
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			shardID, err := decodeRedisValue(pairs[i+1])
+			if err != nil {
+				api.LogWarnf("Skipping Redis mapping for tenant %s: %v", pairs[i], err)
+				continue
+			}
+			shards[pairs[i]] = internAssignment(shardID)
+		}
+
+		if next == 0 {
+			return shards, nil
+		}
+		cursor = next
+	}
+}
+
+// escapes glob metacharacters so a key prefix matches literally in SCAN
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// Body POSTed to ChangeWebhookURL when a refresh loads a changed mapping
+type mappingChangeEvent struct {
+	Event          string    `json:"event"`
+	Mapping        string    `json:"mapping"`
+	OldVersion     string    `json:"old_version"`
+	NewVersion     string    `json:"new_version"`
+	OldContentHash string    `json:"old_content_hash"`
+	NewContentHash string    `json:"new_content_hash"`
+	OldEntries     int       `json:"old_entries"`
+	NewEntries     int       `json:"new_entries"`
+	EntriesDelta   int       `json:"entries_delta"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+var webhookClient = &http.Client{}
+
+// reports whether loaded differs from the snapshot it replaced. The first
+// load, and the first after a Redis warm-up, isn't a change.
+func mappingChanged(previous, loaded *mappingSnapshot) bool {
+	if previous == nil || previous.partial {
+		return false
+	}
+	return previous.version != loaded.version || previous.hash != loaded.hash
+}
+
+// POSTs the change from previous to loaded to ChangeWebhookURL in the
+// background, so a slow receiver never holds up the refresh. Failures are
+// only logged.
+func notifyMappingChange(conf *PluginConfig, previous, loaded *mappingSnapshot) {
+	event := mappingChangeEvent{
+		Event:          "mapping_changed",
+		Mapping:        mappingSourceID(conf),
+		OldVersion:     previous.version,
+		NewVersion:     loaded.version,
+		OldContentHash: previous.hash,
+		NewContentHash: loaded.hash,
+		OldEntries:     len(previous.shards),
+		NewEntries:     len(loaded.shards),
+		EntriesDelta:   len(loaded.shards) - len(previous.shards),
+		Timestamp:      time.Now().UTC(),
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		api.LogWarnf("Failed to encode mapping change event for %s: %v", event.Mapping, err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.ChangeWebhookTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.ChangeWebhookURL, bytes.NewReader(body))
+		if err != nil {
+			api.LogWarnf("Failed to build mapping change notification for %s: %v", event.Mapping, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			api.LogWarnf("Failed to send mapping change notification for %s: %v", event.Mapping, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			api.LogWarnf("Mapping change notification for %s was rejected with status %d", event.Mapping, resp.StatusCode)
+			return
+		}
+		api.LogDebugf("Sent mapping change notification for %s: version %q -> %q, %+d entries",
+			event.Mapping, event.OldVersion, event.NewVersion, event.EntriesDelta)
+	}()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// Represents a single mapping write-back, resolved against the config of the
+// filter that produced it so writers can be shared across configs
+type redisWrite struct {
+	hashKey string // set in hash mode
+	key     string // the hash field in hash mode, the full key otherwise
+	value   string
+	ttl     time.Duration
+}
+
+// queues the write on pipe
+func (w redisWrite) apply(ctx context.Context, pipe redis.Pipeliner) {
+	if w.hashKey != "" {
+		// Hash fields cannot expire individually, so the TTL applies to the
+		// whole hash. NX keeps our writes from pushing the expiry out forever.
+		pipe.HSet(ctx, w.hashKey, w.key, w.value)
+		if w.ttl > 0 {
+			pipe.ExpireNX(ctx, w.hashKey, w.ttl)
+		}
+		return
+	}
+	pipe.Set(ctx, w.key, w.value, w.ttl)
+}
+
+// Drains write-backs for one Redis primary in the background, pipelining up
+// to RedisBatchSize writes per round trip. Writers are process-wide, filter
+// instances only enqueue.
+type redisWriteBehind struct {
+	addr    string
+	breaker *circuitBreaker
+	queue   chan redisWrite // sized by the config that started the worker
+
+	// Taken from the newest config using the worker
+	mu       sync.Mutex
+	client   redis.Cmdable
+	timeout  time.Duration
+	batch    int
+	parseSeq uint64
+
+	// Closed to stop run, which closes done once it has drained the queue
+	done     chan struct{}
+	stopping chan struct{}
+}
+
+var writeBehinds sync.Map // primary addr -> *redisWriteBehind
+
+// returns the writer for the configured primary, starting it on first use.
+// An existing writer takes on conf's settings if conf is newer than the
+// config it has them from.
+func ensureRedisWriteBehind(conf *PluginConfig) *redisWriteBehind {
+	if w, ok := writeBehinds.Load(conf.RedisAddr); ok {
+		w.(*redisWriteBehind).adopt(conf)
+		return w.(*redisWriteBehind)
+	}
+
+	w := &redisWriteBehind{
+		addr:     conf.RedisAddr,
+		breaker:  breakerFor(redisBreakerName(conf.RedisAddr), conf),
+		queue:    make(chan redisWrite, conf.RedisWriteBehindBufferSize),
+		client:   sharedRedisClient(conf, conf.RedisAddr),
+		timeout:  conf.RedisTimeout,
+		batch:    conf.RedisBatchSize,
+		parseSeq: conf.parseSeq,
+
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+	if existing, loaded := writeBehinds.LoadOrStore(conf.RedisAddr, w); loaded {
+		existing.(*redisWriteBehind).adopt(conf)
+		return existing.(*redisWriteBehind)
+	}
+
+	go w.run()
+	return w
+}
+
+// switches to conf's client, timeout and batch size unless they come from an
+// older config. The queue keeps the size it was started with.
+func (w *redisWriteBehind) adopt(conf *PluginConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if conf.parseSeq <= w.parseSeq {
+		return
+	}
+	w.client = sharedRedisClient(conf, conf.RedisAddr)
+	w.timeout, w.batch, w.parseSeq = conf.RedisTimeout, conf.RedisBatchSize, conf.parseSeq
+}
+
+// returns the client, timeout and batch size to write with
+func (w *redisWriteBehind) settings() (redis.Cmdable, time.Duration, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.client, w.timeout, w.batch
+}
+
+// enqueues a write without blocking, dropping it when the buffer is full
+func (w *redisWriteBehind) enqueue(write redisWrite) bool {
+	select {
+	case w.queue <- write:
+		return true
+	default:
+		writeBehindDropped.WithLabelValues(dropBufferFull).Inc()
+		return false
+	}
+}
+
+func (w *redisWriteBehind) run() {
+	defer close(w.done)
+
+	var pending []redisWrite
+	for {
+		select {
+		case write := <-w.queue:
+			pending = append(pending[:0], write)
+			pending = w.take(pending)
+			w.flush(pending)
+		case <-w.stopping:
+			// Flush what was already queued, later writes are never picked up
+			for {
+				pending = w.take(pending[:0])
+				if len(pending) == 0 {
+					return
+				}
+				w.flush(pending)
+			}
+		}
+	}
+}
+
+// adds whatever is already waiting to pending, up to a full batch
+func (w *redisWriteBehind) take(pending []redisWrite) []redisWrite {
+	_, _, batch := w.settings()
+	for len(pending) < batch {
+		select {
+		case write := <-w.queue:
+			pending = append(pending, write)
+		default:
+			return pending
+		}
+	}
+	return pending
+}
+
+// stops the worker once it has flushed the writes queued so far
+func (w *redisWriteBehind) stop() {
+	close(w.stopping)
+	<-w.done
+	api.LogDebugf("Stopped Redis write-behind for %s", w.addr)
+}
+
+// writes a batch in one pipeline, dropping it if Redis is unavailable
+func (w *redisWriteBehind) flush(pending []redisWrite) {
+	if err := w.breaker.allow(); err != nil {
+		writeBehindDropped.WithLabelValues(dropBreakerOpen).Add(float64(len(pending)))
+		return
+	}
+
+	client, timeout, _ := w.settings()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, write := range pending {
+			write.apply(ctx, pipe)
+		}
+		return nil
+	})
+	if err != nil {
+		w.breaker.failure()
+		writeBehindDropped.WithLabelValues(dropError).Add(float64(len(pending)))
+		api.LogWarnf("Failed to write %d cached mappings to Redis %s: %v", len(pending), w.addr, err)
+		return
+	}
+
+	w.breaker.success()
+	api.LogDebugf("Wrote %d cached mappings to Redis %s", len(pending), w.addr)
+}